@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/processor"
+)
+
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	items, err := s.votes.DeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(items)
+}
+
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.votes.DeadLetter(strings.TrimSpace(r.PathValue("id")))
+	if !ok {
+		http.Error(w, "dead letter not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+func (s *Server) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if err := s.votes.ReplayDeadLetter(strings.TrimSpace(r.PathValue("id"))); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case strings.Contains(err.Error(), "no decodable vote"):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handleDiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if err := s.votes.DiscardDeadLetter(strings.TrimSpace(r.PathValue("id"))); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleQueueDepth(w http.ResponseWriter, r *http.Request) {
+	depth, err := s.votes.QueueDepth(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(depth)
+}
+
+func (s *Server) handleGetTuning(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.votes.Tuning(r.Context()))
+}
+
+// handlePutTuning changes only the fields present in the body, e.g.
+// {"workers": 512} or {"autoscale": false, "queue_limit": 200000}.
+func (s *Server) handlePutTuning(w http.ResponseWriter, r *http.Request) {
+	var u processor.TuningUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	t, err := s.votes.Tune(r.Context(), u)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "partitioned") {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/audit"
+)
+
+func (s *Server) handleAuditBundle(w http.ResponseWriter, r *http.Request) {
+	if s.auditKey == nil {
+		http.Error(w, "audit export is not configured", http.StatusNotImplemented)
+		return
+	}
+	id := strings.TrimSpace(r.PathValue("id"))
+	var buf bytes.Buffer
+	if err := audit.Export(s.store, s.ledger, id, s.auditKey, &buf); err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		} else if strings.Contains(err.Error(), "retry") {
+			status = http.StatusServiceUnavailable
+		} else if strings.Contains(err.Error(), "cannot be audited") {
+			status = http.StatusUnprocessableEntity
+		} else if strings.Contains(err.Error(), "still open") {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.audit.tar.gz"`)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/certify"
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// certificateResponse embeds the signed document verbatim; the signature
+// covers the "document" value byte for byte.
+type certificateResponse struct {
+	PollID    string          `json:"poll_id"`
+	Algorithm string          `json:"algorithm"`
+	Document  json.RawMessage `json:"document"`
+	Signature string          `json:"signature"`
+	PublicKey string          `json:"public_key"`
+}
+
+func toCertificateResponse(c models.Certificate) certificateResponse {
+	return certificateResponse{
+		PollID:    c.PollID,
+		Algorithm: "ed25519",
+		Document:  json.RawMessage(c.Document),
+		Signature: c.Signature,
+		PublicKey: c.PublicKey,
+	}
+}
+
+func (s *Server) handleCertify(w http.ResponseWriter, r *http.Request) {
+	if s.certKey == nil {
+		http.Error(w, "certification is not configured", http.StatusNotImplemented)
+		return
+	}
+	id := strings.TrimSpace(r.PathValue("id"))
+	cert, err := certify.Issue(s.store, id, s.certKey, time.Now())
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		} else if strings.Contains(err.Error(), "still open") || strings.Contains(err.Error(), "already certified") || strings.Contains(err.Error(), "not been decrypted") {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(toCertificateResponse(cert))
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.PathValue("id"))
+	cert, ok := s.store.GetCertificate(id)
+	if !ok {
+		http.Error(w, "certificate not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(toCertificateResponse(cert))
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/elgamal"
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// checkEncryptedBallot validates an encrypted ballot's proofs before it is
+// queued, so a bad ballot gets a 400 instead of failing in the worker. The
+// store checks them again when it applies the ballot.
+func (s *Server) checkEncryptedBallot(req models.VoteRequest) (int, error) {
+	ep, ok := s.store.GetEncryptedPoll(req.PollID)
+	if !ok {
+		if _, exists := s.store.GetPollSnapshot(req.PollID); !exists {
+			return http.StatusNotFound, errors.New("poll not found")
+		}
+		return http.StatusBadRequest, errors.New("poll does not accept encrypted ballots")
+	}
+	if !ep.IsOpen {
+		return http.StatusConflict, errors.New("poll is closed")
+	}
+	opts := make([]string, 0, len(ep.Tally))
+	for id := range ep.Tally {
+		opts = append(opts, id)
+	}
+	if err := elgamal.VerifyBallot(ep.Config, req.PollID, req.VoterID, opts, *req.Encrypted); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return 0, nil
+}
+
+func (s *Server) handleGetEncryption(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.PathValue("id"))
+	ep, ok := s.store.GetEncryptedPoll(id)
+	if !ok {
+		http.Error(w, "poll not found or not encrypted", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ep)
+}
+
+func (s *Server) handlePutEncryption(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.PathValue("id"))
+	var cfg models.EncryptionConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := elgamal.ValidateConfig(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetPollEncryption(id, cfg); err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		} else if strings.Contains(err.Error(), "already has votes") {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type decryptionReq struct {
+	Partials []models.PartialDecryption `json:"partials"`
+}
+
+// handleDecryption combines trustee shares for a closed poll, checking every
+// share's proof, and publishes the totals.
+func (s *Server) handleDecryption(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.PathValue("id"))
+	var req decryptionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ep, ok := s.store.GetEncryptedPoll(id)
+	if !ok {
+		http.Error(w, "poll not found or not encrypted", http.StatusNotFound)
+		return
+	}
+	if ep.IsOpen {
+		http.Error(w, "poll is still open", http.StatusConflict)
+		return
+	}
+	d, err := elgamal.Combine(ep.Config, id, ep.Tally, req.Partials, ep.Ballots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetPollDecryption(id, d); err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		} else if strings.Contains(err.Error(), "still open") || strings.Contains(err.Error(), "already decrypted") {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d)
+}
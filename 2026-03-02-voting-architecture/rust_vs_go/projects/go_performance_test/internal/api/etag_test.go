@@ -0,0 +1,24 @@
+package api
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"42-abc"`
+	for _, c := range []struct {
+		header string
+		want   bool
+	}{
+		{``, false},
+		{`"42-abc"`, true},
+		{`W/"42-abc"`, true},
+		{`"41-abc", "42-abc"`, true},
+		{`"41-abc",W/"42-abc"`, true},
+		{`*`, true},
+		{`"42-abd"`, false},
+		{`"41-abc", "43-abc"`, false},
+	} {
+		if got := etagMatches(c.header, etag); got != c.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", c.header, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+// handleHealth always answers 200 while the service accepts votes; a
+// degraded vote transport is reported in the body, not as a failure.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	h := s.votes.Health()
+	status := "ok"
+	if h.Degraded {
+		status = "degraded"
+	}
+	storeStatus := "ok"
+	st := s.store
+	for {
+		u, ok := st.(interface{ Unwrap() store.Store })
+		if !ok {
+			break
+		}
+		st = u.Unwrap()
+	}
+	if b, ok := st.(interface{ Open() bool }); ok && b.Open() {
+		status, storeStatus = "degraded", "circuit_open"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		Store  string `json:"store"`
+		Queue  any    `json:"queue"`
+	}{status, storeStatus, h})
+}
+
+// handleMetrics writes gauges and counters in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	h := s.votes.Health()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{transport=%q} %d\n", name, help, name, kind, name, h.Transport, v)
+	}
+	var degraded int64
+	if h.Degraded {
+		degraded = 1
+	}
+	metric("poll_queue_degraded", "gauge", "1 while Redis is unreachable and votes are spooled locally.", degraded)
+	if depth, err := s.votes.QueueDepth(r.Context()); err == nil {
+		metric("poll_queue_depth", "gauge", "Votes waiting in the vote transport.", depth.Queued)
+	}
+	if f := h.Failover; f != nil {
+		metric("poll_queue_spool_depth", "gauge", "Votes spooled locally and not yet replayed to Redis.", f.SpoolDepth)
+		metric("poll_queue_spooled_total", "counter", "Votes spooled locally during Redis outages.", f.Spooled)
+		metric("poll_queue_replayed_total", "counter", "Spooled votes replayed to Redis.", f.Replayed)
+	}
+}
@@ -1,17 +1,25 @@
 package api
 
 import (
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/thiagonasc/poll/internal/ledger"
 	"github.com/thiagonasc/poll/internal/models"
 	"github.com/thiagonasc/poll/internal/processor"
 	"github.com/thiagonasc/poll/internal/seed"
+	"github.com/thiagonasc/poll/internal/signing"
 	"github.com/thiagonasc/poll/internal/store"
 )
 
@@ -19,6 +27,9 @@ type OptionItemDTO struct {
     ID    string `json:"id"`
     Label string `json:"label"`
     Votes int    `json:"votes"`
+    // Pending counts accepted votes still queued; it is only shown where
+    // the option's poll is known.
+    Pending *int64 `json:"pending,omitempty"`
 }
 
 type PollResponse struct {
@@ -27,48 +38,40 @@ type PollResponse struct {
 	IsOpen   bool            `json:"is_open"`
 	Options  []OptionItemDTO `json:"options"`
 	Voters   []string        `json:"voters"`
+	Pending  int64           `json:"pending"`
+}
+
+// pollResponse builds a poll's results, with the votes still queued for
+// each option next to its confirmed count.
+func (s *Server) pollResponse(snap store.PollSnapshot) PollResponse {
+	pending := s.votes.Pending(snap.ID)
+	pr := PollResponse{ID: snap.ID, Question: snap.Question, IsOpen: snap.IsOpen, Voters: snap.Voters}
+	for _, o := range snap.Options {
+		n := pending[o.ID]
+		pr.Options = append(pr.Options, OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes, Pending: &n})
+		pr.Pending += n
+	}
+	return pr
 }
 
 type Server struct {
     store  store.Store
     votes  *processor.Processor
+    ledger *ledger.Ledger
     closer func()
+
+    auditKey ed25519.PrivateKey
+    certKey  ed25519.PrivateKey
+
+    sync syncVotes
+    // results serves GET /polls?id= when the results cache is on.
+    results *store.Results
 }
 
 func NewServer() *Server {
-    var st store.Store
-    var closer func()
-    dsn := strings.TrimSpace(os.Getenv("DB_URL"))
-    backend := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_BACKEND")))
-
-    switch backend {
-    case "postgres", "pg", "postgresql":
-        if dsn != "" {
-            if pg, c, err := store.NewPostgres(dsn); err == nil {
-                st = pg
-                closer = c
-            } else {
-                log.Printf("failed to init postgres store: %v, falling back to memory", err)
-            }
-        } else {
-            log.Printf("STORE_BACKEND=postgres but DB_URL is empty; falling back to memory store")
-        }
-    case "memory", "mem", "inmemory", "in-memory":
-    default:
-        if dsn != "" {
-            if pg, c, err := store.NewPostgres(dsn); err == nil {
-                st = pg
-                closer = c
-            } else {
-                log.Printf("failed to init postgres store: %v, falling back to memory", err)
-            }
-        }
-    }
-    if st == nil {
-        ms := store.New()
+    st, closer := store.Open()
+    if ms, ok := st.(*store.MemoryStore); ok {
         seed.SeedDemo(ms)
-        st = ms
-        closer = func() {}
     }
 
 	bufSize := 1_000_000
@@ -87,22 +90,114 @@ func NewServer() *Server {
 			log.Printf("invalid VOTE_WORKERS=%q, using auto", v)
 		}
 	}
+	var checks *store.CheckCache
+	if _, mem := st.(*store.MemoryStore); !mem && !strings.EqualFold(strings.TrimSpace(os.Getenv("STORE_CHECK_CACHE")), "off") {
+		checks = store.NewCheckCache(st)
+		st = checks
+	}
+	if path := strings.TrimSpace(os.Getenv("STORE_JOURNAL_FILE")); path != "" {
+		if j, err := store.NewJournal(st, path); err == nil {
+			st = j
+			storeCloser := closer
+			closer = func() {
+				storeCloser()
+				if err := j.Close(); err != nil {
+					log.Printf("journal: %v", err)
+				}
+			}
+		} else {
+			log.Printf("failed to open STORE_JOURNAL_FILE=%q: %v; applied votes are not journaled", path, err)
+		}
+	}
+	var results *store.Results
+	if mode := store.ResultsFromEnv(); mode != "off" {
+		results = store.NewResults(st, mode)
+		st = results
+	}
 	vp := processor.New(st, bufSize, workers)
-	return &Server{store: st, votes: vp, closer: closer}
+	if checks != nil && vp.Redis() != nil {
+		channel := strings.TrimSpace(os.Getenv("STORE_CHECK_CACHE_CHANNEL"))
+		if channel == "" {
+			channel = "poll:check-cache"
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		checks.Broadcast(ctx, vp.Redis(), channel)
+		storeCloser := closer
+		closer = func() {
+			cancel()
+			storeCloser()
+		}
+	}
+	rootEvery := 10 * time.Second
+	if v := strings.TrimSpace(os.Getenv("RECEIPT_ROOT_INTERVAL")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			rootEvery = d
+		} else {
+			log.Printf("invalid RECEIPT_ROOT_INTERVAL=%q, using default %s", v, rootEvery)
+		}
+	}
+	lg := ledger.New(st, rootEvery)
+	srv := &Server{store: st, votes: vp, ledger: lg, closer: closer, sync: loadSyncVotes(), results: results}
+	if v := strings.TrimSpace(os.Getenv("AUDIT_KEY_FILE")); v != "" {
+		if k, err := signing.LoadPrivateKey(v); err == nil {
+			srv.auditKey = k
+		} else {
+			log.Printf("failed to load AUDIT_KEY_FILE=%q: %v; audit export disabled", v, err)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("CERT_KEY_FILE")); v != "" {
+		if k, err := signing.LoadPrivateKey(v); err == nil {
+			srv.certKey = k
+		} else {
+			log.Printf("failed to load CERT_KEY_FILE=%q: %v; certification disabled", v, err)
+		}
+	}
+	return srv
 }
 
 func (s *Server) Routes() {
     registerSwagger()
     http.HandleFunc("/vote", s.handleVote)
+    http.HandleFunc("GET /votes/{id}", s.handleVoteStatus)
     http.HandleFunc("/polls", s.handlePolls)
     http.HandleFunc("/options", s.handleOptions)
+    http.HandleFunc("GET /polls/{id}/voters/{voter_id}", s.handleVoterStatus)
+    http.HandleFunc("GET /polls/{id}/root", s.handleReceiptRoot)
+    http.HandleFunc("GET /polls/{id}/receipts/{receipt}", s.handleReceipt)
+    http.HandleFunc("GET /polls/{id}/audit-bundle", s.handleAuditBundle)
+    http.HandleFunc("GET /polls/{id}/encryption", s.handleGetEncryption)
+    http.HandleFunc("PUT /polls/{id}/encryption", s.handlePutEncryption)
+    http.HandleFunc("POST /polls/{id}/decryption", s.handleDecryption)
+    http.HandleFunc("POST /polls/{id}/certify", s.handleCertify)
+    http.HandleFunc("GET /polls/{id}/certificate", s.handleCertificate)
+    http.HandleFunc("GET /healthz", s.handleHealth)
+    http.HandleFunc("GET /metrics", s.handleMetrics)
+    http.HandleFunc("GET /admin/queue", s.handleQueueDepth)
+    http.HandleFunc("GET /admin/processor", s.handleGetTuning)
+    http.HandleFunc("PUT /admin/processor", s.handlePutTuning)
+    http.HandleFunc("GET /admin/dead-letters", s.handleListDeadLetters)
+    http.HandleFunc("GET /admin/dead-letters/{id}", s.handleGetDeadLetter)
+    http.HandleFunc("POST /admin/dead-letters/{id}/replay", s.handleReplayDeadLetter)
+    http.HandleFunc("DELETE /admin/dead-letters/{id}", s.handleDiscardDeadLetter)
 }
 
 func (s *Server) Close() {
-	s.votes.Close()
+	s.Shutdown(context.Background())
+}
+
+// Shutdown drains the vote processor until ctx expires, then closes the
+// ledger and the store. Call it after the HTTP server has stopped so no new
+// votes arrive.
+func (s *Server) Shutdown(ctx context.Context) processor.DrainReport {
+	rep := s.votes.Shutdown(ctx)
+	s.ledger.Close()
+	if s.results != nil {
+		s.results.Close()
+	}
 	if s.closer != nil {
 		s.closer()
 	}
+	return rep
 }
 
 func (s *Server) handleVote(w http.ResponseWriter, r *http.Request) {
@@ -118,12 +213,40 @@ func (s *Server) handleVote(w http.ResponseWriter, r *http.Request) {
 	req.PollID = strings.TrimSpace(req.PollID)
 	req.OptionID = strings.TrimSpace(req.OptionID)
 	req.VoterID = strings.TrimSpace(req.VoterID)
-	if req.PollID == "" || req.OptionID == "" || req.VoterID == "" {
+	if req.PollID == "" || req.VoterID == "" || (req.OptionID == "" && req.Encrypted == nil) {
 		http.Error(w, "poll_id, option_id, voter_id are required", http.StatusBadRequest)
 		return
 	}
 
-	if err := s.store.CheckPollAndOption(req.PollID, req.OptionID); err != nil {
+	// A retry of a vote that was already accepted gets the original answer,
+	// even if the poll has closed since.
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > 255 {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return
+	}
+	if key != "" {
+		acc, ok, err := s.votes.Replayed(key, req)
+		if err != nil {
+			enqueueError(w, err)
+			return
+		}
+		if ok {
+			s.answerVote(w, r, req.PollID, acc, true)
+			return
+		}
+	}
+
+	if req.Encrypted != nil {
+		if status, err := s.checkEncryptedBallot(req); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	} else if err := s.store.CheckPollAndOption(req.PollID, req.OptionID); err != nil {
+		if store.IsTransient(err) {
+			storeUnavailable(w, err)
+			return
+		}
 		switch err.Error() {
 		case "poll not found":
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -131,17 +254,93 @@ func (s *Server) handleVote(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusConflict)
 		case "option not found in poll":
 			http.Error(w, err.Error(), http.StatusNotFound)
+		case "poll requires encrypted ballots":
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		default:
 			http.Error(w, "bad request", http.StatusBadRequest)
 		}
 		return
 	}
 
-	if ok := s.votes.Enqueue(req); !ok {
-		http.Error(w, "server is busy, please retry", http.StatusServiceUnavailable)
+	req.ReceiptID = store.NewReceipt()
+	if key == "" {
+		voteID, err := s.votes.Enqueue(req)
+		if err != nil {
+			enqueueError(w, err)
+			return
+		}
+		s.answerVote(w, r, req.PollID, processor.Accepted{VoteID: voteID, Receipt: req.ReceiptID}, false)
+		return
+	}
+	acc, replayed, err := s.votes.EnqueueIdempotent(key, req)
+	if err != nil {
+		enqueueError(w, err)
 		return
 	}
+	s.answerVote(w, r, req.PollID, acc, replayed)
+}
+
+// enqueueError maps errors from Processor.Enqueue, EnqueueIdempotent and
+// Replayed.
+func enqueueError(w http.ResponseWriter, err error) {
+	switch {
+	case strings.Contains(err.Error(), "already voted"):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case strings.Contains(err.Error(), "different vote"):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case strings.Contains(err.Error(), "in progress"):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "server is busy, please retry", http.StatusServiceUnavailable)
+	}
+}
+
+// storeUnavailable answers 503 with Retry-After, taken from the circuit
+// breaker when it is open.
+func storeUnavailable(w http.ResponseWriter, err error) {
+	wait, ok := store.IsUnavailable(err)
+	if !ok {
+		wait = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "store is unavailable, please retry", http.StatusServiceUnavailable)
+}
+
+// writeAccepted answers 202 with the vote ID and receipt. A response
+// replayed for a repeated Idempotency-Key is marked with a header.
+func writeAccepted(w http.ResponseWriter, acc processor.Accepted, replayed bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(acc)
+}
+
+func (s *Server) handleVoteStatus(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.PathValue("id"))
+	st, ok := s.votes.Status(id)
+	if !ok {
+		http.Error(w, "vote not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+func (s *Server) handleVoterStatus(w http.ResponseWriter, r *http.Request) {
+	vs, err := s.votes.VoterStatus(strings.TrimSpace(r.PathValue("id")), strings.TrimSpace(r.PathValue("voter_id")))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(vs)
 }
 
 func (s *Server) handleGetOption(w http.ResponseWriter, r *http.Request) {
@@ -175,30 +374,28 @@ func (s *Server) handlePolls(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimSpace(r.URL.Query().Get("id"))
 		w.Header().Set("Content-Type", "application/json")
 		if id == "" {
-			snaps := s.store.ListPollSnapshots()
+			snaps, err := s.store.ListPollSnapshots()
+			if err != nil {
+				http.Error(w, "failed to list polls", http.StatusInternalServerError)
+				return
+			}
 			out := make([]PollResponse, 0, len(snaps))
 			for _, snap := range snaps {
-				pr := PollResponse{ID: snap.ID, Question: snap.Question, IsOpen: snap.IsOpen}
-				for _, o := range snap.Options {
-					pr.Options = append(pr.Options, OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes})
-				}
-				pr.Voters = snap.Voters
-				out = append(out, pr)
+				out = append(out, s.pollResponse(snap))
 			}
 			_ = json.NewEncoder(w).Encode(out)
 			return
 		}
+		if s.results != nil {
+			s.cachedPoll(w, r, id)
+			return
+		}
 		snap, ok := s.store.GetPollSnapshot(id)
 		if !ok {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		resp := PollResponse{ID: snap.ID, Question: snap.Question, IsOpen: snap.IsOpen}
-		for _, o := range snap.Options {
-			resp.Options = append(resp.Options, OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes})
-		}
-		resp.Voters = snap.Voters
-		_ = json.NewEncoder(w).Encode(resp)
+		_ = json.NewEncoder(w).Encode(s.pollResponse(snap))
 	case http.MethodPost:
 		var req createPollReq
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -247,6 +444,8 @@ func (s *Server) handlePolls(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "frozen") {
+				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
 			return
@@ -263,10 +462,14 @@ func (s *Server) handlePolls(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "frozen") {
+				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
 			return
 		}
+		s.votes.ForgetPoll(id)
+		s.ledger.Forget(id)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	default:
@@ -297,9 +500,18 @@ func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
 		}
 		pollID := strings.TrimSpace(r.URL.Query().Get("poll_id"))
 		items := s.store.ListOptions(pollID)
+		var pending map[string]int64
+		if pollID != "" {
+			pending = s.votes.Pending(pollID)
+		}
 		out := make([]OptionItemDTO, 0, len(items))
 		for _, o := range items {
-			out = append(out, OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes})
+			dto := OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes}
+			if pending != nil {
+				n := pending[o.ID]
+				dto.Pending = &n
+			}
+			out = append(out, dto)
 		}
 		_ = json.NewEncoder(w).Encode(out)
 	case http.MethodPost:
@@ -316,7 +528,7 @@ func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
-			} else if strings.Contains(err.Error(), "already exists") {
+			} else if strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "frozen") || strings.Contains(err.Error(), "encrypted") {
 				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
@@ -337,6 +549,8 @@ func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "frozen") {
+				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
 			return
@@ -352,6 +566,8 @@ func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "frozen") || strings.Contains(err.Error(), "encrypted") {
+				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
 			return
@@ -402,7 +618,7 @@ func (s *Server) handleVoters(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
-			} else if strings.Contains(err.Error(), "already exists") {
+			} else if strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "frozen") {
 				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
@@ -420,6 +636,8 @@ func (s *Server) handleVoters(w http.ResponseWriter, r *http.Request) {
 			status := http.StatusBadRequest
 			if strings.Contains(err.Error(), "not found") {
 				status = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "frozen") {
+				status = http.StatusConflict
 			}
 			http.Error(w, err.Error(), status)
 			return
@@ -430,6 +648,43 @@ func (s *Server) handleVoters(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// cachedPoll answers from the results cache. The ETag is the snapshot
+// version followed by a hash of the pending counts, which change without a
+// new version, so If-None-Match gets 304 only while the whole body is
+// unchanged.
+func (s *Server) cachedPoll(w http.ResponseWriter, r *http.Request, id string) {
+	snap, version, ok := s.results.Snapshot(id)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	resp := s.pollResponse(snap)
+	h := fnv.New64a()
+	for _, o := range resp.Options {
+		fmt.Fprintf(h, "%s=%d;", o.ID, *o.Pending)
+	}
+	etag := fmt.Sprintf(`"%d-%x"`, version, h.Sum64())
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag or is
+// "*". Tags are compared weakly, as RFC 9110 asks for If-None-Match, so
+// W/"x" matches "x".
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) handleGetPoll(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -445,14 +700,8 @@ func (s *Server) handleGetPoll(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "poll not found", http.StatusNotFound)
 		return
 	}
-	resp := PollResponse{ID: snap.ID, Question: snap.Question, IsOpen: snap.IsOpen}
-	opts := make([]OptionItemDTO, 0, len(snap.Options))
-	for _, o := range snap.Options {
-		opts = append(opts, OptionItemDTO{ID: o.ID, Label: o.Label, Votes: o.Votes})
-	}
-	sort.Slice(opts, func(i, j int) bool { return opts[i].Label < opts[j].Label })
-	resp.Options = opts
-	resp.Voters = snap.Voters
+	resp := s.pollResponse(snap)
+	sort.Slice(resp.Options, func(i, j int) bool { return resp.Options[i].Label < resp.Options[j].Label })
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
@@ -22,6 +22,9 @@ const openAPISpec = `{
       "post": {
         "tags": ["LoadTest"],
         "summary": "Submit a vote",
+        "parameters": [
+          { "name": "Idempotency-Key", "in": "header", "required": false, "schema": {"type":"string","maxLength":255}, "description": "Retries with the same key get the first response back instead of a second vote" }
+        ],
         "requestBody": {
           "required": true,
           "content": {
@@ -31,14 +34,25 @@ const openAPISpec = `{
           }
         },
         "responses": {
-          "202": { "description": "Accepted" },
+          "200": { "description": "Counted (sync mode, see VOTE_MODE)", "content": {"application/json": {"schema": {"type":"object","properties":{"vote_id":{"type":"string"},"receipt":{"type":"string"},"status":{"type":"string","example":"applied"}}}}} },
+          "202": { "description": "Accepted", "content": {"application/json": {"schema": {"type":"object","properties":{"vote_id":{"type":"string","description":"Poll GET /votes/{vote_id} for the final outcome"},"receipt":{"type":"string","description":"Ballot receipt; look up its inclusion proof at /polls/{id}/receipts/{receipt}"}}}}} },
           "404": { "description": "Poll/Option not found" },
-          "409": { "description": "Poll is closed" },
-          "503": { "description": "Server busy" }
+          "409": { "description": "Poll is closed, the voter already voted, or a request with the same Idempotency-Key is in progress" },
+          "422": { "description": "Idempotency-Key was used for a different vote" },
+          "503": { "description": "Server busy, or the store is unavailable; see the Retry-After header" }
         }
       }
     },
     "/polls": {
+      "get": {
+        "tags": ["LoadTest"],
+        "summary": "Poll results, or all polls without id",
+        "parameters": [
+          {"name": "id", "in": "query", "required": false, "schema": {"type": "string"}},
+          {"name": "If-None-Match", "in": "header", "required": false, "schema": {"type": "string"}, "description": "ETag of a previous response for this poll"}
+        ],
+        "responses": {"200": {"description": "OK; with id, carries an ETag"}, "304": {"description": "Results unchanged since the given ETag"}, "404": {"description": "Poll not found"}}
+      },
       "post": {
         "tags": ["LoadTest"],
         "summary": "Create a poll",
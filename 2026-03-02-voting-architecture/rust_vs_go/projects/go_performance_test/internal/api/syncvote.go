@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/processor"
+)
+
+// syncVotes selects the polls whose votes are answered with their final
+// outcome: all of them with VOTE_MODE=sync, or those listed in
+// VOTE_SYNC_POLLS. The vote still goes through the queue; the handler
+// waits up to timeout for a worker to apply it.
+type syncVotes struct {
+	all     bool
+	polls   map[string]struct{}
+	timeout time.Duration
+}
+
+func loadSyncVotes() syncVotes {
+	sv := syncVotes{polls: make(map[string]struct{}), timeout: 2 * time.Second}
+	switch v := strings.TrimSpace(os.Getenv("VOTE_MODE")); v {
+	case "", "async":
+	case "sync":
+		sv.all = true
+	default:
+		log.Printf("invalid VOTE_MODE=%q, using async", v)
+	}
+	for _, id := range strings.Split(os.Getenv("VOTE_SYNC_POLLS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			sv.polls[id] = struct{}{}
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("VOTE_SYNC_TIMEOUT")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			sv.timeout = d
+		} else {
+			log.Printf("invalid VOTE_SYNC_TIMEOUT=%q, using default %s", v, sv.timeout)
+		}
+	}
+	return sv
+}
+
+func (sv syncVotes) enabled(pollID string) bool {
+	if sv.all {
+		return true
+	}
+	_, ok := sv.polls[pollID]
+	return ok
+}
+
+type voteCounted struct {
+	processor.Accepted
+	Status string `json:"status"`
+}
+
+// answerVote replies to an accepted vote. In sync mode it waits for the
+// outcome and answers 200 if the vote was counted, 409 if the voter had
+// already voted or the poll closed, and 404 if the poll or option went
+// away. Otherwise, or once the wait times out, it answers 202.
+func (s *Server) answerVote(w http.ResponseWriter, r *http.Request, pollID string, acc processor.Accepted, replayed bool) {
+	if !s.sync.enabled(pollID) {
+		writeAccepted(w, acc, replayed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.sync.timeout)
+	defer cancel()
+	st, ok := s.votes.Wait(ctx, acc.VoteID)
+	if !ok || st.Status == processor.StatusDeadLettered {
+		// Not applied yet, or waiting on an operator: the client can follow
+		// up on GET /votes/{id}.
+		writeAccepted(w, acc, replayed)
+		return
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	switch st.Status {
+	case processor.StatusApplied:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(voteCounted{Accepted: acc, Status: st.Status})
+	case processor.StatusDuplicate, processor.StatusClosed:
+		http.Error(w, st.Error, http.StatusConflict)
+	default:
+		if strings.Contains(st.Error, "not found") {
+			http.Error(w, st.Error, http.StatusNotFound)
+		} else {
+			http.Error(w, st.Error, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package audit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/ledger"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+const Format = "poll-audit-bundle/v1"
+
+const (
+	fileManifest  = "manifest.json"
+	fileSignature = "manifest.sig"
+	filePoll      = "poll.json"
+	fileBallots   = "ballots.ndjson"
+	fileCounts    = "counts.json"
+	fileLedger    = "ledger.json"
+)
+
+type PollDefinition struct {
+	ID       string      `json:"id"`
+	Question string      `json:"question"`
+	IsOpen   bool        `json:"is_open"`
+	Options  []OptionDef `json:"options"`
+}
+
+type OptionDef struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type Count struct {
+	OptionID string `json:"option_id"`
+	Votes    int    `json:"votes"`
+}
+
+type Manifest struct {
+	Format    string            `json:"format"`
+	PollID    string            `json:"poll_id"`
+	CreatedAt time.Time         `json:"created_at"`
+	PublicKey string            `json:"public_key"`
+	Files     map[string]string `json:"files"`
+}
+
+// Export writes a signed tar.gz bundle for a closed poll to w. The bundled
+// ledger head is the one lg publishes for the poll, and the ballots are
+// exactly the ones under it.
+func Export(s store.Store, lg *ledger.Ledger, pollID string, key ed25519.PrivateKey, w io.Writer) error {
+	snap, ok := s.GetPollSnapshot(pollID)
+	if !ok {
+		return errors.New("poll not found")
+	}
+	if snap.IsOpen {
+		return errors.New("poll is still open")
+	}
+	if _, enc := s.GetEncryptedPoll(pollID); enc {
+		return errors.New("encrypted polls are verified with tally-verify")
+	}
+	def := PollDefinition{ID: snap.ID, Question: snap.Question, IsOpen: snap.IsOpen}
+	counts := make([]Count, 0, len(snap.Options))
+	total := 0
+	for _, o := range snap.Options {
+		def.Options = append(def.Options, OptionDef{ID: o.ID, Label: o.Label})
+		counts = append(counts, Count{OptionID: o.ID, Votes: o.Votes})
+		total += o.Votes
+	}
+	head, err := lg.PublishPoll(pollID)
+	if err != nil {
+		return err
+	}
+	ballots, err := s.ListBallots(pollID)
+	if err != nil {
+		return err
+	}
+	if total != len(ballots) {
+		// Votes counted before ballots were recorded have no ballot to
+		// replay, so the counts could never be reproduced.
+		return fmt.Errorf("poll has %d counted votes but %d recorded ballots; it has votes from before ballots were recorded and cannot be audited", total, len(ballots))
+	}
+	if head.TreeSize != len(ballots) || ledger.RootOf(ballots).String() != head.Root {
+		return errors.New("ballots do not match the published ledger head; retry")
+	}
+	var nd bytes.Buffer
+	enc := json.NewEncoder(&nd)
+	for _, b := range ballots {
+		if err := enc.Encode(b); err != nil {
+			return err
+		}
+	}
+	files := map[string][]byte{fileBallots: nd.Bytes()}
+	for name, v := range map[string]any{filePoll: def, fileCounts: counts, fileLedger: head} {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		files[name] = b
+	}
+	m := Manifest{
+		Format:    Format,
+		PollID:    pollID,
+		CreatedAt: time.Now().UTC(),
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Files:     map[string]string{},
+	}
+	for name, b := range files {
+		sum := sha256.Sum256(b)
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	files[fileManifest] = mb
+	files[fileSignature] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, mb)))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{fileManifest, fileSignature, filePoll, fileCounts, fileLedger, fileBallots} {
+		b := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: m.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Report is the outcome of verifying a bundle.
+type Report struct {
+	PollID      string         `json:"poll_id"`
+	Ballots     int            `json:"ballots"`
+	Tally       map[string]int `json:"tally"`
+	Root        string         `json:"root"`
+	PublishedAt time.Time      `json:"published_at"`
+	EmbeddedKey bool           `json:"embedded_key"`
+	// RootChecked is set when the head was matched against a root the
+	// verifier obtained independently.
+	RootChecked bool `json:"root_checked"`
+}
+
+// Verify checks the manifest signature and file digests, recomputes the
+// tally by replaying every ballot into a fresh MemoryStore, and checks the
+// recomputed counts against the bundle and the ballots against the bundled
+// ledger head. If pub is nil the key embedded in the manifest is used,
+// which only proves integrity. root, when set, is a published root the
+// verifier got elsewhere (GET /polls/{id}/root, a certificate); the head
+// must match it, which ties the ballots to what voters' receipts prove
+// against.
+func Verify(r io.Reader, pub ed25519.PublicKey, root string) (Report, error) {
+	var rep Report
+	files, err := readBundle(r)
+	if err != nil {
+		return rep, err
+	}
+	mb, ok := files[fileManifest]
+	if !ok {
+		return rep, errors.New("bundle has no manifest")
+	}
+	var m Manifest
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return rep, fmt.Errorf("manifest: %w", err)
+	}
+	if m.Format != Format {
+		return rep, fmt.Errorf("unsupported bundle format %q", m.Format)
+	}
+	if pub == nil {
+		raw, err := base64.StdEncoding.DecodeString(m.PublicKey)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return rep, errors.New("manifest public key is invalid")
+		}
+		pub = ed25519.PublicKey(raw)
+		rep.EmbeddedKey = true
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(files[fileSignature])))
+	if err != nil {
+		return rep, errors.New("signature is not valid base64")
+	}
+	if !ed25519.Verify(pub, mb, sig) {
+		return rep, errors.New("manifest signature does not verify")
+	}
+	for _, name := range []string{filePoll, fileCounts, fileLedger, fileBallots} {
+		if _, ok := m.Files[name]; !ok {
+			return rep, fmt.Errorf("manifest does not cover %s", name)
+		}
+	}
+	for name, want := range m.Files {
+		sum := sha256.Sum256(files[name])
+		if hex.EncodeToString(sum[:]) != want {
+			return rep, fmt.Errorf("%s digest does not match manifest", name)
+		}
+	}
+
+	var def PollDefinition
+	var counts []Count
+	var head ledger.Head
+	for name, v := range map[string]any{filePoll: &def, fileCounts: &counts, fileLedger: &head} {
+		if err := json.Unmarshal(files[name], v); err != nil {
+			return rep, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if def.ID != m.PollID {
+		return rep, errors.New("poll definition does not match manifest")
+	}
+
+	ms := store.New()
+	if err := ms.CreatePoll(def.ID, def.Question, true); err != nil {
+		return rep, err
+	}
+	for _, o := range def.Options {
+		if err := ms.AddOption(def.ID, o.ID, o.Label); err != nil {
+			return rep, fmt.Errorf("option %s: %w", o.ID, err)
+		}
+	}
+	var ballots []models.Ballot
+	dec := json.NewDecoder(bytes.NewReader(files[fileBallots]))
+	for {
+		var b models.Ballot
+		if err := dec.Decode(&b); err == io.EOF {
+			break
+		} else if err != nil {
+			return rep, fmt.Errorf("%s: %w", fileBallots, err)
+		}
+		// Receipts are unique, so they stand in for the voter identity.
+		v := models.VoteRequest{PollID: def.ID, OptionID: b.OptionID, VoterID: b.Receipt, ReceiptID: b.Receipt}
+		if err := ms.ApplyVote(v); err != nil {
+			return rep, fmt.Errorf("ballot %s: %w", b.Receipt, err)
+		}
+		ballots = append(ballots, b)
+	}
+
+	rep.PollID = def.ID
+	rep.Ballots = len(ballots)
+	rep.Tally = map[string]int{}
+	for _, o := range ms.ListOptions(def.ID) {
+		rep.Tally[o.ID] = o.Votes
+	}
+	if len(counts) != len(rep.Tally) {
+		return rep, errors.New("reported counts do not cover every option")
+	}
+	for _, c := range counts {
+		got, ok := rep.Tally[c.OptionID]
+		if !ok {
+			return rep, fmt.Errorf("reported count for unknown option %s", c.OptionID)
+		}
+		if got != c.Votes {
+			return rep, fmt.Errorf("option %s: reported %d votes, ballots give %d", c.OptionID, c.Votes, got)
+		}
+	}
+	rep.Root = ledger.RootOf(ballots).String()
+	rep.PublishedAt = head.PublishedAt
+	if head.PollID != def.ID || head.TreeSize != len(ballots) || head.Root != rep.Root {
+		return rep, errors.New("ballots do not reproduce the published ledger head")
+	}
+	if root != "" {
+		if !strings.EqualFold(strings.TrimSpace(root), head.Root) {
+			return rep, errors.New("ledger head does not match the given published root")
+		}
+		rep.RootChecked = true
+	}
+	return rep, nil
+}
+
+func readBundle(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = b
+	}
+}
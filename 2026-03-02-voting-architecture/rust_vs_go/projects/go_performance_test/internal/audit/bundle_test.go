@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/ledger"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+const pollID = "p1"
+
+func closedPoll(t *testing.T) *store.MemoryStore {
+	t.Helper()
+	s := store.New()
+	if err := s.CreatePoll(pollID, "q?", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []string{"a", "b"} {
+		if err := s.AddOption(pollID, o, "option "+o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, o := range []string{"a", "b", "a"} {
+		v := models.VoteRequest{PollID: pollID, OptionID: o, VoterID: string(rune('x' + i)), ReceiptID: "r" + string(rune('0'+i))}
+		if err := s.ApplyVote(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.UpdatePoll(pollID, "q?", false); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func export(t *testing.T, s store.Store, key ed25519.PrivateKey) ([]byte, ledger.Head) {
+	t.Helper()
+	lg := ledger.New(s, time.Hour)
+	defer lg.Close()
+	var buf bytes.Buffer
+	if err := Export(s, lg, pollID, key, &buf); err != nil {
+		t.Fatal(err)
+	}
+	head, ok := lg.Head(pollID)
+	if !ok {
+		t.Fatal("no published head")
+	}
+	return buf.Bytes(), head
+}
+
+func TestRoundTrip(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	bundle, head := export(t, closedPoll(t), key)
+
+	rep, err := Verify(bytes.NewReader(bundle), pub, head.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Ballots != 3 || rep.Tally["a"] != 2 || rep.Tally["b"] != 1 {
+		t.Fatalf("report = %+v", rep)
+	}
+	if rep.Root != head.Root || !rep.RootChecked || rep.EmbeddedKey {
+		t.Fatalf("report = %+v, head = %+v", rep, head)
+	}
+
+	rep, err = Verify(bytes.NewReader(bundle), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.EmbeddedKey || rep.RootChecked {
+		t.Fatalf("report = %+v", rep)
+	}
+}
+
+func TestVerifyRejectsOtherRoot(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	bundle, _ := export(t, closedPoll(t), key)
+	other := ledger.RootOf([]models.Ballot{{Receipt: "r0", OptionID: "a"}}).String()
+	if _, err := Verify(bytes.NewReader(bundle), pub, other); err == nil {
+		t.Fatal("bundle verified against a root it was not published under")
+	}
+}
+
+func TestVerifyRejectsOtherKey(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	bundle, _ := export(t, closedPoll(t), key)
+	if _, err := Verify(bytes.NewReader(bundle), other, ""); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("err = %v, want a signature error", err)
+	}
+}
+
+func TestVerifyRejectsEditedFile(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	bundle, _ := export(t, closedPoll(t), key)
+	files := unpack(t, bundle)
+	files[fileCounts] = bytes.Replace(files[fileCounts], []byte(`"votes": 2`), []byte(`"votes": 3`), 1)
+	if _, err := Verify(bytes.NewReader(pack(t, files)), pub, ""); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Fatalf("err = %v, want a digest error", err)
+	}
+}
+
+// A signer who rewrites the ballots and re-signs still cannot match the
+// published head.
+func TestVerifyRejectsResignedBallots(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	bundle, head := export(t, closedPoll(t), key)
+	files := unpack(t, bundle)
+	files[fileBallots] = bytes.Replace(files[fileBallots], []byte(`"option_id":"b"`), []byte(`"option_id":"a"`), 1)
+	files[fileCounts] = bytes.Replace(files[fileCounts], []byte(`"votes": 2`), []byte(`"votes": 3`), 1)
+	files[fileCounts] = bytes.Replace(files[fileCounts], []byte(`"votes": 1`), []byte(`"votes": 0`), 1)
+	resign(t, files, key)
+	if _, err := Verify(bytes.NewReader(pack(t, files)), pub, head.Root); err == nil || !strings.Contains(err.Error(), "ledger head") {
+		t.Fatalf("err = %v, want a ledger head error", err)
+	}
+}
+
+func TestVerifyRejectsWrongCounts(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	bundle, _ := export(t, closedPoll(t), key)
+	files := unpack(t, bundle)
+	files[fileCounts] = bytes.Replace(files[fileCounts], []byte(`"votes": 2`), []byte(`"votes": 3`), 1)
+	resign(t, files, key)
+	if _, err := Verify(bytes.NewReader(pack(t, files)), pub, ""); err == nil || !strings.Contains(err.Error(), "reported") {
+		t.Fatalf("err = %v, want a count error", err)
+	}
+}
+
+func TestExportRefusesOpenPoll(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := closedPoll(t)
+	if err := s.UpdatePoll(pollID, "q?", true); err != nil {
+		t.Fatal(err)
+	}
+	lg := ledger.New(s, time.Hour)
+	defer lg.Close()
+	if err := Export(s, lg, pollID, key, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "still open") {
+		t.Fatalf("err = %v, want still open", err)
+	}
+}
+
+// missingBallots stands in for a poll with votes counted before ballots
+// were recorded: the counts cover more votes than there are ballots.
+type missingBallots struct{ store.Store }
+
+func (m missingBallots) ListBallots(pollID string) ([]models.Ballot, error) {
+	b, err := m.Store.ListBallots(pollID)
+	if len(b) > 0 {
+		b = b[1:]
+	}
+	return b, err
+}
+
+func TestExportRefusesPollWithoutBallots(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := missingBallots{closedPoll(t)}
+	lg := ledger.New(s, time.Hour)
+	defer lg.Close()
+	if err := Export(s, lg, pollID, key, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "cannot be audited") {
+		t.Fatalf("err = %v, want cannot be audited", err)
+	}
+}
+
+func unpack(t *testing.T, bundle []byte) map[string][]byte {
+	t.Helper()
+	files, err := readBundle(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func pack(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, b := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// resign updates the manifest digests and signs it again with key.
+func resign(t *testing.T, files map[string][]byte, key ed25519.PrivateKey) {
+	t.Helper()
+	var m Manifest
+	if err := json.Unmarshal(files[fileManifest], &m); err != nil {
+		t.Fatal(err)
+	}
+	for name := range m.Files {
+		sum := sha256.Sum256(files[name])
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files[fileManifest] = mb
+	files[fileSignature] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, mb)))
+}
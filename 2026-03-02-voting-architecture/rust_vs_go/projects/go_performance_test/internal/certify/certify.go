@@ -0,0 +1,67 @@
+package certify
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/ledger"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/signing"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+const Format = "poll-result/v1"
+
+// Document is the certified result. It is serialized with encoding/json,
+// whose fixed field order makes the bytes canonical.
+type Document struct {
+	Format      string         `json:"format"`
+	PollID      string         `json:"poll_id"`
+	Question    string         `json:"question"`
+	CertifiedAt time.Time      `json:"certified_at"`
+	Options     []OptionResult `json:"options"`
+	TotalVotes  int            `json:"total_votes"`
+	Ballots     int            `json:"ballots"`
+	LedgerRoot  string         `json:"ledger_root"`
+}
+
+type OptionResult struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Votes int    `json:"votes"`
+}
+
+// Issue builds and signs the result document of a closed poll, then freezes
+// the poll and stores the certificate. The document is built from the poll
+// as the store freezes it, so nothing can change in between.
+func Issue(s store.Store, pollID string, key ed25519.PrivateKey, now time.Time) (models.Certificate, error) {
+	return s.CertifyPoll(pollID, func(snap store.PollSnapshot, ballots []models.Ballot) (models.Certificate, error) {
+		doc := Document{
+			Format:      Format,
+			PollID:      pollID,
+			Question:    snap.Question,
+			CertifiedAt: now.UTC().Truncate(time.Second),
+			Options:     make([]OptionResult, 0, len(snap.Options)),
+			Ballots:     len(ballots),
+			LedgerRoot:  ledger.RootOf(ballots).String(),
+		}
+		for _, o := range snap.Options {
+			doc.Options = append(doc.Options, OptionResult{ID: o.ID, Label: o.Label, Votes: o.Votes})
+			doc.TotalVotes += o.Votes
+		}
+		sort.Slice(doc.Options, func(i, j int) bool { return doc.Options[i].ID < doc.Options[j].ID })
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return models.Certificate{}, err
+		}
+		return models.Certificate{
+			PollID:    pollID,
+			Document:  string(b),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, b)),
+			PublicKey: string(signing.EncodePublicKey(key.Public().(ed25519.PublicKey))),
+		}, nil
+	})
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/audit"
+	"github.com/thiagonasc/poll/internal/ledger"
+	"github.com/thiagonasc/poll/internal/signing"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func init() {
+	register("audit-export", "write a signed audit bundle for a closed poll", auditExport)
+	register("audit-verify", "verify an audit bundle offline", auditVerify)
+}
+
+func auditExport(args []string) error {
+	fs := flag.NewFlagSet("audit-export", flag.ContinueOnError)
+	pollID := fs.String("poll", "", "poll ID to export")
+	keyFile := fs.String("key", os.Getenv("AUDIT_KEY_FILE"), "ed25519 PKCS#8 PEM signing key")
+	out := fs.String("out", "", "output file (default <poll>.audit.tar.gz)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*pollID) == "" || strings.TrimSpace(*keyFile) == "" {
+		return errors.New("-poll and -key are required")
+	}
+	key, err := signing.LoadPrivateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = *pollID + ".audit.tar.gz"
+	}
+	st, closer := store.Open()
+	defer closer()
+	// Ledger positions are kept in the store, so this publishes the same
+	// head the service does for the poll.
+	lg := ledger.New(st, time.Hour)
+	defer lg.Close()
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := audit.Export(st, lg, *pollID, key, f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(*out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println(*out)
+	return nil
+}
+
+func auditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	in := fs.String("in", "", "audit bundle to verify")
+	pubFile := fs.String("pubkey", "", "trusted ed25519 public key PEM (default: key embedded in the bundle)")
+	root := fs.String("root", "", "published ledger root to match (from GET /polls/{id}/root or the certificate)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("-in is required")
+	}
+	var pub ed25519.PublicKey
+	if *pubFile != "" {
+		k, err := signing.LoadPublicKey(*pubFile)
+		if err != nil {
+			return err
+		}
+		pub = k
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rep, err := audit.Verify(f, pub, *root)
+	if err != nil {
+		return err
+	}
+	if rep.EmbeddedKey {
+		fmt.Fprintln(os.Stderr, "warning: signature checked against the bundle's own key; pass -pubkey to pin the signer")
+	}
+	if !rep.RootChecked {
+		fmt.Fprintln(os.Stderr, "warning: ledger head not compared with an independently published root; pass -root")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
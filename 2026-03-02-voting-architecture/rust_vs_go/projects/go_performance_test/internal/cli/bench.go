@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func init() {
+	register("bench-store", "compare the Postgres vote paths (single statement vs transaction)", runBenchStore)
+}
+
+// runBenchStore is a one-off comparison with latency percentiles; for
+// repeatable numbers use BenchmarkApplyVoteCTE and BenchmarkApplyVoteTx in
+// internal/store.
+func runBenchStore(args []string) error {
+	fs := flag.NewFlagSet("bench-store", flag.ContinueOnError)
+	dsn := fs.String("db", os.Getenv("DB_URL"), "Postgres DSN")
+	paths := fs.String("paths", "tx,cte", "vote paths to run, in order")
+	votes := fs.Int("votes", 20000, "votes per path")
+	conc := fs.Int("c", 64, "concurrent voters")
+	options := fs.Int("options", 1, "options per poll; 1 puts every vote on one hot option")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*dsn) == "" {
+		return errors.New("-db or DB_URL is required")
+	}
+	if *votes <= 0 || *conc <= 0 || *options <= 0 {
+		return errors.New("-votes, -c and -options must be positive")
+	}
+	st, closer, err := store.NewPostgres(strings.TrimSpace(*dsn))
+	if err != nil {
+		return err
+	}
+	defer closer()
+	pg, ok := st.(*store.PostgresStore)
+	if !ok {
+		return errors.New("not a Postgres store")
+	}
+
+	fmt.Printf("%-5s %8s %10s %9s %9s %9s %7s\n", "path", "votes", "votes/s", "p50", "p99", "max", "errors")
+	for _, path := range strings.Split(*paths, ",") {
+		path = strings.TrimSpace(path)
+		if err := pg.SetVotePath(path); err != nil {
+			return err
+		}
+		r, err := benchPath(pg, *votes, *conc, *options)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-5s %8d %10.0f %9s %9s %9s %7d\n", path, *votes, float64(*votes)/r.elapsed.Seconds(),
+			r.quantile(0.50), r.quantile(0.99), r.quantile(1), r.errors)
+	}
+	return nil
+}
+
+type benchResult struct {
+	elapsed time.Duration
+	lat     []time.Duration
+	errors  int64
+}
+
+func (r benchResult) quantile(q float64) time.Duration {
+	i := int(q * float64(len(r.lat)-1))
+	return r.lat[i].Round(10 * time.Microsecond)
+}
+
+// benchPath votes into a fresh poll, which is deleted afterwards, with
+// every vote checked and then applied as the service would.
+func benchPath(pg *store.PostgresStore, votes, conc, options int) (benchResult, error) {
+	pollID := "bench-" + store.NewReceipt()
+	if err := pg.CreatePoll(pollID, "bench "+pollID, true); err != nil {
+		return benchResult{}, err
+	}
+	defer func() { _ = pg.DeletePoll(pollID) }()
+	opts := make([]string, options)
+	for i := range opts {
+		opts[i] = fmt.Sprintf("%s-%d", pollID, i)
+		if err := pg.AddOption(pollID, opts[i], fmt.Sprint("option ", i)); err != nil {
+			return benchResult{}, err
+		}
+	}
+
+	lat := make([]time.Duration, votes)
+	var next, failed atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < conc; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= votes {
+					return
+				}
+				v := models.VoteRequest{PollID: pollID, OptionID: opts[i%options], VoterID: fmt.Sprint("voter-", i), VoteID: fmt.Sprint(pollID, "-", i)}
+				t := time.Now()
+				err := pg.CheckPollAndOption(v.PollID, v.OptionID)
+				if err == nil {
+					err = pg.ApplyVote(v)
+				}
+				lat[i] = time.Since(t)
+				if err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	r := benchResult{elapsed: time.Since(start), lat: lat, errors: failed.Load()}
+	sort.Slice(r.lat, func(i, j int) bool { return r.lat[i] < r.lat[j] })
+	return r, nil
+}
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{}
+
+func register(name, summary string, run func(args []string) error) {
+	commands[name] = command{summary: summary, run: run}
+}
+
+// Run executes the named subcommand with its arguments.
+func Run(name string, args []string) error {
+	c, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", name, Usage())
+	}
+	return c.run(args)
+}
+
+func Usage() string {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("usage: poll [command] [flags]\n\nWithout a command the HTTP service is started.\n\ncommands:\n")
+	for _, n := range names {
+		fmt.Fprintf(&b, "  %-16s %s\n", n, commands[n].summary)
+	}
+	return b.String()
+}
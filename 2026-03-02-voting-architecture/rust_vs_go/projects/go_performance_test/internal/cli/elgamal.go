@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/elgamal"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func init() {
+	register("elgamal-keygen", "deal a threshold ElGamal key for an encrypted poll", elgamalKeygen)
+	register("encrypt-ballot", "encrypt a vote as a POST /vote body", encryptBallot)
+	register("tally-share", "compute a trustee's partial decryption of a tally", tallyShare)
+	register("tally-verify", "check that published totals decrypt from the aggregate", tallyVerify)
+}
+
+func writeJSON(path string, v any, perm os.FileMode) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), perm)
+}
+
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func elgamalKeygen(args []string) error {
+	fs := flag.NewFlagSet("elgamal-keygen", flag.ContinueOnError)
+	trustees := fs.Int("trustees", 3, "number of trustees")
+	threshold := fs.Int("threshold", 2, "trustees needed to decrypt")
+	out := fs.String("out", ".", "directory for config.json and trustee-N.json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, shares, err := elgamal.GenerateKey(*trustees, *threshold)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(*out, "config.json"), cfg, 0o644); err != nil {
+		return err
+	}
+	for _, sh := range shares {
+		if err := writeJSON(filepath.Join(*out, fmt.Sprintf("trustee-%d.json", sh.Trustee)), sh, 0o600); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("wrote config.json and %d trustee shares to %s; PUT config.json to /polls/{id}/encryption\n", len(shares), *out)
+	return nil
+}
+
+func encryptBallot(args []string) error {
+	fs := flag.NewFlagSet("encrypt-ballot", flag.ContinueOnError)
+	cfgPath := fs.String("config", "config.json", "poll encryption config")
+	pollID := fs.String("poll", "", "poll ID")
+	options := fs.String("options", "", "comma-separated option IDs of the poll")
+	option := fs.String("option", "", "option to vote for")
+	voter := fs.String("voter", "", "voter ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pollID == "" || *options == "" || *option == "" || *voter == "" {
+		return errors.New("-poll, -options, -option and -voter are required")
+	}
+	var cfg models.EncryptionConfig
+	if err := readJSON(*cfgPath, &cfg); err != nil {
+		return err
+	}
+	b, err := elgamal.EncryptBallot(cfg, *pollID, *voter, strings.Split(*options, ","), *option)
+	if err != nil {
+		return err
+	}
+	return printJSON(models.VoteRequest{PollID: *pollID, VoterID: *voter, Encrypted: &b})
+}
+
+func tallyShare(args []string) error {
+	fs := flag.NewFlagSet("tally-share", flag.ContinueOnError)
+	sharePath := fs.String("share", "", "this trustee's share file")
+	in := fs.String("in", "", "GET /polls/{id}/encryption response for the closed poll")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *sharePath == "" || *in == "" {
+		return errors.New("-share and -in are required")
+	}
+	var sh elgamal.Share
+	if err := readJSON(*sharePath, &sh); err != nil {
+		return err
+	}
+	var ep models.EncryptedPoll
+	if err := readJSON(*in, &ep); err != nil {
+		return err
+	}
+	if ep.IsOpen {
+		return errors.New("poll is still open")
+	}
+	pd, err := elgamal.PartialDecrypt(ep.PollID, ep.Tally, sh)
+	if err != nil {
+		return err
+	}
+	return printJSON(pd)
+}
+
+// tallyVerify checks a published decryption. With -poll the aggregate is
+// also recomputed from the stored ballots.
+func tallyVerify(args []string) error {
+	fs := flag.NewFlagSet("tally-verify", flag.ContinueOnError)
+	in := fs.String("in", "", "GET /polls/{id}/encryption response to verify offline")
+	pollID := fs.String("poll", "", "verify a poll from the configured store instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var ep models.EncryptedPoll
+	switch {
+	case *in != "":
+		if err := readJSON(*in, &ep); err != nil {
+			return err
+		}
+	case *pollID != "":
+		st, closer := store.Open()
+		defer closer()
+		var ok bool
+		if ep, ok = st.GetEncryptedPoll(*pollID); !ok {
+			return errors.New("poll not found or not encrypted")
+		}
+		ballots, err := st.ListBallots(*pollID)
+		if err != nil {
+			return err
+		}
+		sums, err := elgamal.SumBallots(ballots)
+		if err != nil {
+			return err
+		}
+		for opt, c := range ep.Tally {
+			want, ok := sums[opt]
+			if !ok {
+				want = elgamal.Identity()
+			}
+			if want != c {
+				return fmt.Errorf("option %s: stored aggregate does not match the ballots", opt)
+			}
+		}
+		fmt.Printf("aggregate matches %d stored ballots\n", ep.Ballots)
+	default:
+		return errors.New("-in or -poll is required")
+	}
+	if ep.Decryption == nil {
+		return errors.New("poll has not been decrypted")
+	}
+	if err := elgamal.VerifyDecryption(ep.Config, ep.PollID, ep.Tally, *ep.Decryption, ep.Ballots); err != nil {
+		return err
+	}
+	fmt.Println("decrypted totals match the aggregate:")
+	return printJSON(ep.Decryption.Totals)
+}
@@ -0,0 +1,330 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+
+	"github.com/thiagonasc/poll/internal/elgamal"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/queue"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func init() {
+	register("replay", "re-apply votes from a file queue, Redis stream, spill file or applied-vote journal", runReplay)
+}
+
+// runReplay applies the votes a source holds to the configured store. The
+// file queue and the streams transport only hold votes not yet acked, so
+// replaying them recovers votes that were queued but never applied, for
+// example after a restore from a backup taken while votes were in flight.
+// VOTE_SPILL_FILE likewise holds votes left unprocessed at shutdown.
+//
+// To rebuild a store, replay the applied-vote journal (STORE_JOURNAL_FILE)
+// with -from ndjson -rebuild into a store that has the polls and options.
+// -rebuild lets votes into polls that have closed since: each closed poll
+// is opened while the replay runs and closed again when it ends. Certified
+// polls cannot be reopened, so their votes are rejected.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "", "source: journal (file queue directory), stream (Redis stream) or ndjson")
+	in := fs.String("in", "", "journal directory or NDJSON file (- for stdin)")
+	redisURL := fs.String("redis", os.Getenv("REDIS_URL"), "Redis URL for -from stream")
+	stream := fs.String("stream", "", "stream key (default {$REDIS_QUEUE_NAME}:stream)")
+	pollID := fs.String("poll", "", "only replay votes for this poll")
+	dryRun := fs.Bool("dry-run", false, "validate and report without applying")
+	rebuild := fs.Bool("rebuild", false, "also apply votes for polls that have closed, reopening them while the replay runs")
+	every := fs.Int("progress", 10000, "report progress every n records, 0 for never")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var source func(fn func(queue.Delivery) error) error
+	switch *from {
+	case "journal":
+		if *in == "" {
+			return errors.New("-in is required with -from journal")
+		}
+		source = func(fn func(queue.Delivery) error) error { return queue.ReadJournal(*in, fn) }
+	case "ndjson":
+		if *in == "" {
+			return errors.New("-in is required with -from ndjson")
+		}
+		source = func(fn func(queue.Delivery) error) error { return readNDJSON(*in, fn) }
+	case "stream":
+		opt, err := redis.ParseURL(strings.TrimSpace(*redisURL))
+		if err != nil {
+			return fmt.Errorf("-redis: %v", err)
+		}
+		rdb := redis.NewClient(opt)
+		defer rdb.Close()
+		if *stream == "" {
+			name := strings.TrimSpace(os.Getenv("REDIS_QUEUE_NAME"))
+			if name == "" {
+				name = "votes"
+			}
+			*stream = "{" + name + "}:stream"
+		}
+		source = func(fn func(queue.Delivery) error) error {
+			return queue.ReadStream(context.Background(), rdb, *stream, fn)
+		}
+	default:
+		return errors.New("-from must be journal, stream or ndjson")
+	}
+
+	st, closer := store.Open()
+	defer closer()
+	if _, ok := st.(*store.MemoryStore); ok {
+		// An in-memory target has no polls and is gone on exit.
+		return errors.New("replay needs a Postgres target; set DB_URL")
+	}
+	r := &replayer{st: st, dryRun: *dryRun, rebuild: *rebuild, pollID: strings.TrimSpace(*pollID), every: *every,
+		rejected: map[string]int{}, seen: map[string]struct{}{}, polls: map[string]*replayPoll{}, start: time.Now()}
+	err := source(r.replay)
+	if cerr := r.closeReopened(); err == nil {
+		err = cerr
+	}
+	r.summary(os.Stdout)
+	return err
+}
+
+// replayer puts each record through the checks POST /vote makes and then
+// ApplyVote. Stores skip vote IDs they already applied, so a record that
+// is already in the store counts as applied again rather than rejected.
+type replayer struct {
+	st      store.Store
+	dryRun  bool
+	rebuild bool
+	pollID  string
+	every   int
+
+	read, applied, skipped int
+	rejected               map[string]int
+	// seen catches repeat voters within a dry run, where the store does not
+	// change.
+	seen map[string]struct{}
+	// polls holds, with -rebuild, each poll as first read, and reopened the
+	// closed ones opened for the replay.
+	polls    map[string]*replayPoll
+	reopened []string
+	start    time.Time
+}
+
+type replayPoll struct {
+	question string
+	closed   bool
+	options  map[string]bool
+}
+
+func (r *replayer) replay(d queue.Delivery) error {
+	r.read++
+	if r.every > 0 && r.read%r.every == 0 {
+		fmt.Fprintf(os.Stderr, "replay: %d read, %d applied, %d rejected, %d skipped (%s)\n",
+			r.read, r.applied, r.rejectedTotal(), r.skipped, time.Since(r.start).Round(time.Second))
+	}
+	if d.Err != nil {
+		r.rejected["undecodable record"]++
+		return nil
+	}
+	v := d.Vote
+	if r.pollID != "" && v.PollID != r.pollID {
+		r.skipped++
+		return nil
+	}
+	if v.PollID == "" || v.VoterID == "" || (v.OptionID == "" && v.Encrypted == nil) {
+		r.rejected["poll_id, option_id, voter_id are required"]++
+		return nil
+	}
+	if err := r.check(v); err != nil {
+		r.rejected[err.Error()]++
+		return nil
+	}
+	if r.dryRun {
+		r.applied++
+		return nil
+	}
+	if err := r.apply(v); err != nil {
+		r.rejected[err.Error()]++
+		return nil
+	}
+	r.applied++
+	return nil
+}
+
+// check validates v without changing the store. Encrypted ballots have
+// their proofs verified here, so a dry run reports forged ones; ApplyVote
+// verifies them again.
+func (r *replayer) check(v models.VoteRequest) error {
+	var closed *replayPoll
+	if r.rebuild {
+		p, err := r.open(v.PollID)
+		if err != nil {
+			return err
+		}
+		if p.closed {
+			closed = p
+		}
+	}
+	if v.Encrypted != nil {
+		ep, ok := r.st.GetEncryptedPoll(v.PollID)
+		if !ok {
+			if _, exists := r.st.GetPollSnapshot(v.PollID); !exists {
+				return errors.New("poll not found")
+			}
+			return errors.New("poll does not accept encrypted ballots")
+		}
+		if !ep.IsOpen && closed == nil {
+			return errors.New("poll is closed")
+		}
+		opts := make([]string, 0, len(ep.Tally))
+		for id := range ep.Tally {
+			opts = append(opts, id)
+		}
+		if err := elgamal.VerifyBallot(ep.Config, v.PollID, v.VoterID, opts, *v.Encrypted); err != nil {
+			return err
+		}
+	} else if closed != nil {
+		// Only in a dry run: the poll stays closed, so check the option here.
+		if !closed.options[v.OptionID] {
+			return errors.New("option not found in poll")
+		}
+	} else if err := r.st.CheckPollAndOption(v.PollID, v.OptionID); err != nil {
+		return err
+	}
+	if !r.dryRun {
+		return nil
+	}
+	k := v.PollID + "/" + v.VoterID
+	if _, dup := r.seen[k]; dup {
+		return errors.New("voter has already voted in this poll")
+	}
+	r.seen[k] = struct{}{}
+	if voted, err := r.st.HasVoted(v.PollID, v.VoterID); err == nil && voted {
+		return errors.New("voter already counted in target store")
+	}
+	return nil
+}
+
+// open reads a poll the first time a rebuild meets it and opens it if it
+// is closed. A dry run leaves it closed.
+func (r *replayer) open(pollID string) (*replayPoll, error) {
+	if p, ok := r.polls[pollID]; ok {
+		return p, nil
+	}
+	snap, ok := r.st.GetPollSnapshot(pollID)
+	if !ok {
+		return nil, errors.New("poll not found")
+	}
+	p := &replayPoll{question: snap.Question, closed: !snap.IsOpen, options: map[string]bool{}}
+	for _, o := range snap.Options {
+		p.options[o.ID] = true
+	}
+	if p.closed && !r.dryRun {
+		if err := r.st.UpdatePoll(pollID, snap.Question, true); err != nil {
+			return nil, err
+		}
+		r.reopened = append(r.reopened, pollID)
+		p.closed = false
+	}
+	r.polls[pollID] = p
+	return p, nil
+}
+
+// closeReopened closes the polls open reopened.
+func (r *replayer) closeReopened() error {
+	var first error
+	for _, id := range r.reopened {
+		if err := r.st.UpdatePoll(id, r.polls[id].question, false); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: poll %s was reopened and could not be closed again: %v\n", id, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// apply retries transient store errors a few times before giving up.
+func (r *replayer) apply(v models.VoteRequest) error {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+		if err = r.st.ApplyVote(v); !store.IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *replayer) rejectedTotal() int {
+	n := 0
+	for _, c := range r.rejected {
+		n += c
+	}
+	return n
+}
+
+func (r *replayer) summary(w io.Writer) {
+	verb := "applied"
+	if r.dryRun {
+		verb = "would apply"
+	}
+	fmt.Fprintf(w, "read %d, %s %d, rejected %d, skipped %d in %s\n",
+		r.read, verb, r.applied, r.rejectedTotal(), r.skipped, time.Since(r.start).Round(time.Millisecond))
+	reasons := make([]string, 0, len(r.rejected))
+	for reason := range r.rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if r.rejected[reasons[i]] != r.rejected[reasons[j]] {
+			return r.rejected[reasons[i]] > r.rejected[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %8d  %s\n", r.rejected[reason], reason)
+	}
+}
+
+// readNDJSON reads one vote per line, as written by VOTE_SPILL_FILE and
+// STORE_JOURNAL_FILE.
+func readNDJSON(path string, fn func(queue.Delivery) error) error {
+	var src io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := sc.Bytes()
+		if len(strings.TrimSpace(string(raw))) == 0 {
+			continue
+		}
+		d := queue.Delivery{ID: fmt.Sprint(line), Raw: append([]byte(nil), raw...)}
+		d.Err = json.Unmarshal(d.Raw, &d.Vote)
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/rla"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func init() {
+	register("rla", "run or resume a ballot-polling risk-limiting audit", runRLA)
+}
+
+func runRLA(args []string) error {
+	fs := flag.NewFlagSet("rla", flag.ContinueOnError)
+	pollID := fs.String("poll", "", "poll ID to audit")
+	risk := fs.Float64("risk", 0.05, "risk limit (alpha)")
+	seed := fs.String("seed", "", "public random seed for the sample")
+	statePath := fs.String("state", "", "audit state file (default <poll>.rla.json); resumed when it exists")
+	maxSamples := fs.Int("max", 0, "draws before escalating to a full recount (default: number of ballots)")
+	batch := fs.Int("batch", 0, "draws to take in this run, 0 means until the audit finishes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *statePath == "" {
+		if strings.TrimSpace(*pollID) == "" {
+			return errors.New("-poll or -state is required")
+		}
+		*statePath = *pollID + ".rla.json"
+	}
+
+	st, closer := store.Open()
+	defer closer()
+
+	var a *rla.Audit
+	if prev, err := rla.Load(*statePath); err == nil {
+		if *pollID != "" && *pollID != prev.PollID {
+			return fmt.Errorf("state file belongs to poll %s", prev.PollID)
+		}
+		if *seed != "" && *seed != prev.Seed {
+			return errors.New("seed differs from the saved audit")
+		}
+		if a, err = rla.Resume(st, prev); err != nil {
+			return err
+		}
+		fmt.Printf("resuming audit of %s at draw %d\n", prev.PollID, len(prev.Samples)+1)
+	} else if os.IsNotExist(err) {
+		if a, err = rla.Start(st, strings.TrimSpace(*pollID), *risk, *seed, *maxSamples); err != nil {
+			return err
+		}
+		if err := rla.Save(*statePath, a.State); err != nil {
+			return err
+		}
+		fmt.Printf("audit of %s: winner %s, %d ballots, risk limit %g\n", a.State.PollID, a.State.Winner, a.State.Ballots, a.State.RiskLimit)
+	} else {
+		return err
+	}
+
+	for n := 0; !a.Done() && (*batch <= 0 || n < *batch); n++ {
+		smp, err := a.Step()
+		if err != nil {
+			return err
+		}
+		losers := make([]string, 0, len(smp.T))
+		for k := range smp.T {
+			losers = append(losers, k)
+		}
+		sort.Strings(losers)
+		parts := make([]string, 0, len(losers))
+		for _, k := range losers {
+			parts = append(parts, fmt.Sprintf("T[%s]=%.4f", k, smp.T[k]))
+		}
+		fmt.Printf("draw %d: ballot #%d (%s) for %s  %s\n", smp.Draw, smp.Index, smp.Receipt, smp.OptionID, strings.Join(parts, " "))
+		if err := rla.Save(*statePath, a.State); err != nil {
+			return err
+		}
+	}
+	if err := rla.Save(*statePath, a.State); err != nil {
+		return err
+	}
+	fmt.Printf("status: %s", a.State.Status)
+	if a.State.Reason != "" {
+		fmt.Printf(" (%s)", a.State.Reason)
+	}
+	fmt.Println()
+	return nil
+}
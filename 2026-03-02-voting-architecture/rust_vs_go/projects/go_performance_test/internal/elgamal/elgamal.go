@@ -0,0 +1,542 @@
+package elgamal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// Exponential ElGamal over the 2048-bit MODP group of RFC 3526. P is a safe
+// prime, so G=2 generates the subgroup of prime order Q=(P-1)/2. A vote m
+// is encrypted as (g^r, g^m h^r); multiplying ciphertexts adds the votes.
+
+const modp2048 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	P   *big.Int
+	Q   *big.Int
+	G   = big.NewInt(2)
+	one = big.NewInt(1)
+)
+
+func init() {
+	P, _ = new(big.Int).SetString(modp2048, 16)
+	Q = new(big.Int).Rsh(P, 1)
+}
+
+type ciphertext struct {
+	a, b *big.Int
+}
+
+func enc(x *big.Int) string { return x.Text(16) }
+
+// element parses a hex group element and checks it lies in the order-Q
+// subgroup, which the proofs below depend on.
+func element(s string) (*big.Int, error) {
+	x, ok := new(big.Int).SetString(s, 16)
+	if !ok || x.Cmp(one) < 0 || x.Cmp(P) >= 0 {
+		return nil, errors.New("invalid group element")
+	}
+	if new(big.Int).Exp(x, Q, P).Cmp(one) != 0 {
+		return nil, errors.New("group element outside subgroup")
+	}
+	return x, nil
+}
+
+func scalar(s string) (*big.Int, error) {
+	x, ok := new(big.Int).SetString(s, 16)
+	if !ok || x.Sign() < 0 || x.Cmp(Q) >= 0 {
+		return nil, errors.New("invalid scalar")
+	}
+	return x, nil
+}
+
+func parseCiphertext(c models.Ciphertext) (ciphertext, error) {
+	a, err := element(c.A)
+	if err != nil {
+		return ciphertext{}, err
+	}
+	b, err := element(c.B)
+	if err != nil {
+		return ciphertext{}, err
+	}
+	return ciphertext{a, b}, nil
+}
+
+func (c ciphertext) model() models.Ciphertext {
+	return models.Ciphertext{A: enc(c.a), B: enc(c.b)}
+}
+
+func randScalar() *big.Int {
+	k, err := rand.Int(rand.Reader, Q)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func exp(x, e *big.Int) *big.Int { return new(big.Int).Exp(x, e, P) }
+
+func mul(xs ...*big.Int) *big.Int {
+	r := big.NewInt(1)
+	for _, x := range xs {
+		r.Mul(r, x).Mod(r, P)
+	}
+	return r
+}
+
+// expNeg returns x^-e for x in the order-Q subgroup.
+func expNeg(x, e *big.Int) *big.Int {
+	n := new(big.Int).Sub(Q, new(big.Int).Mod(e, Q))
+	return exp(x, n)
+}
+
+func gPow(m int64) *big.Int { return exp(G, big.NewInt(m)) }
+
+// challenge is the Fiat-Shamir hash of a labelled transcript, reduced mod Q.
+func challenge(label string, parts ...any) *big.Int {
+	h := sha256.New()
+	h.Write([]byte("poll-elgamal-v1/" + label))
+	for _, p := range parts {
+		var b []byte
+		switch v := p.(type) {
+		case string:
+			b = []byte(v)
+		case *big.Int:
+			b = v.Bytes()
+		}
+		var n [4]byte
+		n[0], n[1], n[2], n[3] = byte(len(b)>>24), byte(len(b)>>16), byte(len(b)>>8), byte(len(b))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), Q)
+}
+
+// Identity is the encryption of zero with zero randomness.
+func Identity() models.Ciphertext { return models.Ciphertext{A: "1", B: "1"} }
+
+// Add returns the homomorphic sum of two ciphertexts.
+func Add(x, y models.Ciphertext) (models.Ciphertext, error) {
+	cx, err := parseCiphertext(x)
+	if err != nil {
+		return models.Ciphertext{}, err
+	}
+	cy, err := parseCiphertext(y)
+	if err != nil {
+		return models.Ciphertext{}, err
+	}
+	return ciphertext{mul(cx.a, cy.a), mul(cx.b, cy.b)}.model(), nil
+}
+
+// Commitment is a digest of a ballot's ciphertexts, used as its ledger leaf.
+func Commitment(b models.EncryptedBallot) string {
+	cs := append([]models.EncryptedChoice(nil), b.Choices...)
+	sort.Slice(cs, func(i, j int) bool { return cs[i].OptionID < cs[j].OptionID })
+	parts := make([]string, 0, len(cs))
+	for _, c := range cs {
+		parts = append(parts, c.OptionID+"="+c.Ciphertext.A+","+c.Ciphertext.B)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, ";")))
+	return fmt.Sprintf("%x", sum)
+}
+
+// EncryptBallot encrypts a vote for chosen as one 0/1 ciphertext per option,
+// each with a disjunctive Chaum-Pedersen proof, plus a proof that the
+// ciphertexts sum to exactly one vote. The proofs are bound to the poll and
+// the voter, so the ballot cannot be cast again under another voter ID.
+func EncryptBallot(cfg models.EncryptionConfig, pollID, voterID string, optionIDs []string, chosen string) (models.EncryptedBallot, error) {
+	h, err := element(cfg.PublicKey)
+	if err != nil {
+		return models.EncryptedBallot{}, fmt.Errorf("public key: %w", err)
+	}
+	found := false
+	for _, id := range optionIDs {
+		if id == chosen {
+			found = true
+		}
+	}
+	if !found {
+		return models.EncryptedBallot{}, errors.New("option not found in poll")
+	}
+	var out models.EncryptedBallot
+	sumR := big.NewInt(0)
+	sumA, sumB := big.NewInt(1), big.NewInt(1)
+	for _, id := range optionIDs {
+		var m int64
+		if id == chosen {
+			m = 1
+		}
+		r := randScalar()
+		c := ciphertext{exp(G, r), mul(gPow(m), exp(h, r))}
+		out.Choices = append(out.Choices, models.EncryptedChoice{
+			OptionID:   id,
+			Ciphertext: c.model(),
+			Proof:      proveBit(h, pollID, voterID, id, c, m, r),
+		})
+		sumR.Add(sumR, r).Mod(sumR, Q)
+		sumA, sumB = mul(sumA, c.a), mul(sumB, c.b)
+	}
+	out.SumProof = proveSum(h, pollID, voterID, ciphertext{sumA, sumB}, sumR)
+	return out, nil
+}
+
+func proveBit(h *big.Int, pollID, voterID, optionID string, c ciphertext, m int64, r *big.Int) []string {
+	cs := [2]*big.Int{}
+	zs := [2]*big.Int{}
+	t1 := [2]*big.Int{}
+	t2 := [2]*big.Int{}
+	sim := 1 - m
+	cs[sim], zs[sim] = randScalar(), randScalar()
+	t1[sim] = mul(exp(G, zs[sim]), expNeg(c.a, cs[sim]))
+	t2[sim] = mul(exp(h, zs[sim]), expNeg(mul(c.b, expNeg(G, big.NewInt(sim))), cs[sim]))
+	w := randScalar()
+	t1[m], t2[m] = exp(G, w), exp(h, w)
+	e := challenge("bit", pollID, voterID, optionID, h, c.a, c.b, t1[0], t2[0], t1[1], t2[1])
+	cs[m] = new(big.Int).Sub(e, cs[sim])
+	cs[m].Mod(cs[m], Q)
+	zs[m] = new(big.Int).Mul(cs[m], r)
+	zs[m].Add(zs[m], w).Mod(zs[m], Q)
+	return []string{enc(cs[0]), enc(cs[1]), enc(zs[0]), enc(zs[1])}
+}
+
+func verifyBit(h *big.Int, pollID, voterID, optionID string, c ciphertext, proof []string) error {
+	if len(proof) != 4 {
+		return errors.New("malformed proof")
+	}
+	v := make([]*big.Int, 4)
+	for i, s := range proof {
+		x, err := scalar(s)
+		if err != nil {
+			return err
+		}
+		v[i] = x
+	}
+	cs, zs := v[:2], v[2:]
+	var t1, t2 [2]*big.Int
+	for j := 0; j < 2; j++ {
+		t1[j] = mul(exp(G, zs[j]), expNeg(c.a, cs[j]))
+		t2[j] = mul(exp(h, zs[j]), expNeg(mul(c.b, expNeg(G, big.NewInt(int64(j)))), cs[j]))
+	}
+	e := challenge("bit", pollID, voterID, optionID, h, c.a, c.b, t1[0], t2[0], t1[1], t2[1])
+	sum := new(big.Int).Add(cs[0], cs[1])
+	if sum.Mod(sum, Q).Cmp(e) != 0 {
+		return errors.New("choice proof does not verify")
+	}
+	return nil
+}
+
+// proveSum shows log_g(A) == log_h(B/g), i.e. the summed ciphertext
+// encrypts exactly one.
+func proveSum(h *big.Int, pollID, voterID string, c ciphertext, r *big.Int) []string {
+	w := randScalar()
+	t1, t2 := exp(G, w), exp(h, w)
+	e := challenge("sum", pollID, voterID, h, c.a, c.b, t1, t2)
+	z := new(big.Int).Mul(e, r)
+	z.Add(z, w).Mod(z, Q)
+	return []string{enc(e), enc(z)}
+}
+
+func verifySum(h *big.Int, pollID, voterID string, c ciphertext, proof []string) error {
+	if len(proof) != 2 {
+		return errors.New("malformed sum proof")
+	}
+	e, err := scalar(proof[0])
+	if err != nil {
+		return err
+	}
+	z, err := scalar(proof[1])
+	if err != nil {
+		return err
+	}
+	bg := mul(c.b, expNeg(G, one))
+	t1 := mul(exp(G, z), expNeg(c.a, e))
+	t2 := mul(exp(h, z), expNeg(bg, e))
+	if challenge("sum", pollID, voterID, h, c.a, c.b, t1, t2).Cmp(e) != 0 {
+		return errors.New("sum proof does not verify")
+	}
+	return nil
+}
+
+// VerifyBallot checks that b has exactly one 0/1 ciphertext per option,
+// that together they encrypt a single vote, and that the proofs were made
+// for this poll and voter.
+func VerifyBallot(cfg models.EncryptionConfig, pollID, voterID string, optionIDs []string, b models.EncryptedBallot) error {
+	h, err := element(cfg.PublicKey)
+	if err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+	want := make(map[string]bool, len(optionIDs))
+	for _, id := range optionIDs {
+		want[id] = true
+	}
+	if len(b.Choices) != len(want) {
+		return errors.New("ballot must hold one ciphertext per option")
+	}
+	sumA, sumB := big.NewInt(1), big.NewInt(1)
+	seen := map[string]bool{}
+	for _, ch := range b.Choices {
+		if !want[ch.OptionID] || seen[ch.OptionID] {
+			return errors.New("ballot must hold one ciphertext per option")
+		}
+		seen[ch.OptionID] = true
+		c, err := parseCiphertext(ch.Ciphertext)
+		if err != nil {
+			return err
+		}
+		if err := verifyBit(h, pollID, voterID, ch.OptionID, c, ch.Proof); err != nil {
+			return fmt.Errorf("option %s: %w", ch.OptionID, err)
+		}
+		sumA, sumB = mul(sumA, c.a), mul(sumB, c.b)
+	}
+	return verifySum(h, pollID, voterID, ciphertext{sumA, sumB}, b.SumProof)
+}
+
+// Share is one trustee's piece of the decryption key.
+type Share struct {
+	PollID  string                  `json:"poll_id,omitempty"`
+	Trustee int                     `json:"trustee"`
+	Secret  string                  `json:"secret"`
+	Config  models.EncryptionConfig `json:"config"`
+}
+
+// GenerateKey deals a key with Shamir's scheme so that any threshold of the
+// trustees can decrypt. The dealer should discard the shares once handed out.
+func GenerateKey(trustees, threshold int) (models.EncryptionConfig, []Share, error) {
+	if threshold < 1 || trustees < threshold {
+		return models.EncryptionConfig{}, nil, errors.New("need 1 <= threshold <= trustees")
+	}
+	coef := make([]*big.Int, threshold)
+	for i := range coef {
+		coef[i] = randScalar()
+	}
+	cfg := models.EncryptionConfig{PublicKey: enc(exp(G, coef[0])), Threshold: threshold}
+	secrets := make([]*big.Int, trustees)
+	for i := 1; i <= trustees; i++ {
+		x := big.NewInt(int64(i))
+		y := big.NewInt(0)
+		for k := threshold - 1; k >= 0; k-- {
+			y.Mul(y, x).Add(y, coef[k]).Mod(y, Q)
+		}
+		secrets[i-1] = y
+		cfg.VerificationKeys = append(cfg.VerificationKeys, enc(exp(G, y)))
+	}
+	shares := make([]Share, trustees)
+	for i, s := range secrets {
+		shares[i] = Share{Trustee: i + 1, Secret: enc(s), Config: cfg}
+	}
+	return cfg, shares, nil
+}
+
+// PartialDecrypt computes a trustee's decryption share of every tallied
+// option, each with a proof that it used the key behind its verification key.
+func PartialDecrypt(pollID string, tally map[string]models.Ciphertext, sh Share) (models.PartialDecryption, error) {
+	s, err := scalar(sh.Secret)
+	if err != nil {
+		return models.PartialDecryption{}, err
+	}
+	if sh.Trustee < 1 || sh.Trustee > len(sh.Config.VerificationKeys) {
+		return models.PartialDecryption{}, errors.New("trustee index out of range")
+	}
+	hi, err := element(sh.Config.VerificationKeys[sh.Trustee-1])
+	if err != nil {
+		return models.PartialDecryption{}, err
+	}
+	if exp(G, s).Cmp(hi) != 0 {
+		return models.PartialDecryption{}, errors.New("share does not match its verification key")
+	}
+	out := models.PartialDecryption{Trustee: sh.Trustee, Shares: map[string]models.DecryptionShare{}}
+	for opt, ct := range tally {
+		c, err := parseCiphertext(ct)
+		if err != nil {
+			return models.PartialDecryption{}, err
+		}
+		d := exp(c.a, s)
+		w := randScalar()
+		t1, t2 := exp(G, w), exp(c.a, w)
+		e := challenge("decrypt", pollID, opt, hi, c.a, d, t1, t2)
+		z := new(big.Int).Mul(e, s)
+		z.Add(z, w).Mod(z, Q)
+		out.Shares[opt] = models.DecryptionShare{D: enc(d), Proof: []string{enc(e), enc(z)}}
+	}
+	return out, nil
+}
+
+func verifyPartial(cfg models.EncryptionConfig, pollID string, tally map[string]ciphertext, pd models.PartialDecryption) (map[string]*big.Int, error) {
+	if pd.Trustee < 1 || pd.Trustee > len(cfg.VerificationKeys) {
+		return nil, errors.New("trustee index out of range")
+	}
+	hi, err := element(cfg.VerificationKeys[pd.Trustee-1])
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*big.Int, len(tally))
+	for opt, c := range tally {
+		ds, ok := pd.Shares[opt]
+		if !ok || len(ds.Proof) != 2 {
+			return nil, fmt.Errorf("trustee %d: missing share for option %s", pd.Trustee, opt)
+		}
+		d, err := element(ds.D)
+		if err != nil {
+			return nil, err
+		}
+		e, err := scalar(ds.Proof[0])
+		if err != nil {
+			return nil, err
+		}
+		z, err := scalar(ds.Proof[1])
+		if err != nil {
+			return nil, err
+		}
+		t1 := mul(exp(G, z), expNeg(hi, e))
+		t2 := mul(exp(c.a, z), expNeg(d, e))
+		if challenge("decrypt", pollID, opt, hi, c.a, d, t1, t2).Cmp(e) != 0 {
+			return nil, fmt.Errorf("trustee %d: decryption proof for option %s does not verify", pd.Trustee, opt)
+		}
+		out[opt] = d
+	}
+	return out, nil
+}
+
+// Combine verifies the partial decryptions and recovers each option's total,
+// searching totals up to maxVotes.
+func Combine(cfg models.EncryptionConfig, pollID string, tally map[string]models.Ciphertext, partials []models.PartialDecryption, maxVotes int) (models.Decryption, error) {
+	cts := make(map[string]ciphertext, len(tally))
+	for opt, ct := range tally {
+		c, err := parseCiphertext(ct)
+		if err != nil {
+			return models.Decryption{}, err
+		}
+		cts[opt] = c
+	}
+	sorted := append([]models.PartialDecryption(nil), partials...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Trustee < sorted[j].Trustee })
+	used := []models.PartialDecryption{}
+	ds := []map[string]*big.Int{}
+	for _, pd := range sorted {
+		if len(used) > 0 && used[len(used)-1].Trustee == pd.Trustee {
+			continue
+		}
+		d, err := verifyPartial(cfg, pollID, cts, pd)
+		if err != nil {
+			return models.Decryption{}, err
+		}
+		used = append(used, pd)
+		ds = append(ds, d)
+		if len(used) == cfg.Threshold {
+			break
+		}
+	}
+	if len(used) < cfg.Threshold {
+		return models.Decryption{}, fmt.Errorf("need %d trustee shares, got %d", cfg.Threshold, len(used))
+	}
+	lambda := make([]*big.Int, len(used))
+	for i, pi := range used {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for j, pj := range used {
+			if i == j {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(pj.Trustee))).Mod(num, Q)
+			den.Mul(den, big.NewInt(int64(pj.Trustee-pi.Trustee))).Mod(den, Q)
+		}
+		lambda[i] = num.Mul(num, new(big.Int).ModInverse(den, Q)).Mod(num, Q)
+	}
+	out := models.Decryption{Totals: map[string]int{}, Partials: used}
+	for opt, c := range cts {
+		ax := big.NewInt(1)
+		for i := range used {
+			ax = mul(ax, exp(ds[i][opt], lambda[i]))
+		}
+		gm := mul(c.b, new(big.Int).ModInverse(ax, P))
+		m, ok := discreteLog(gm, maxVotes)
+		if !ok {
+			return models.Decryption{}, fmt.Errorf("option %s: total exceeds %d votes", opt, maxVotes)
+		}
+		out.Totals[opt] = m
+	}
+	return out, nil
+}
+
+// VerifyDecryption re-derives the totals from the recorded partial
+// decryptions and checks them against the published totals.
+func VerifyDecryption(cfg models.EncryptionConfig, pollID string, tally map[string]models.Ciphertext, d models.Decryption, maxVotes int) error {
+	got, err := Combine(cfg, pollID, tally, d.Partials, maxVotes)
+	if err != nil {
+		return err
+	}
+	if len(got.Totals) != len(d.Totals) {
+		return errors.New("published totals do not cover the tally")
+	}
+	for opt, n := range got.Totals {
+		if d.Totals[opt] != n {
+			return fmt.Errorf("option %s: published %d, aggregate decrypts to %d", opt, d.Totals[opt], n)
+		}
+	}
+	return nil
+}
+
+func discreteLog(gm *big.Int, max int) (int, bool) {
+	acc := big.NewInt(1)
+	for m := 0; m <= max; m++ {
+		if acc.Cmp(gm) == 0 {
+			return m, true
+		}
+		acc = mul(acc, G)
+	}
+	return 0, false
+}
+
+// SumBallots recomputes the per-option aggregate from stored ballots.
+func SumBallots(ballots []models.Ballot) (map[string]models.Ciphertext, error) {
+	out := map[string]models.Ciphertext{}
+	for _, b := range ballots {
+		if b.Encrypted == nil {
+			return nil, errors.New("ballot " + b.Receipt + " is not encrypted")
+		}
+		for _, ch := range b.Encrypted.Choices {
+			cur, ok := out[ch.OptionID]
+			if !ok {
+				cur = Identity()
+			}
+			sum, err := Add(cur, ch.Ciphertext)
+			if err != nil {
+				return nil, err
+			}
+			out[ch.OptionID] = sum
+		}
+	}
+	return out, nil
+}
+
+// ValidateConfig checks that a poll's public parameters are well formed.
+func ValidateConfig(cfg models.EncryptionConfig) error {
+	if _, err := element(cfg.PublicKey); err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+	if cfg.Threshold < 1 || cfg.Threshold > len(cfg.VerificationKeys) {
+		return errors.New("need 1 <= threshold <= number of verification keys")
+	}
+	for i, vk := range cfg.VerificationKeys {
+		if _, err := element(vk); err != nil {
+			return fmt.Errorf("verification key %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package elgamal
+
+import (
+	"maps"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+var options = []string{"a", "b", "c"}
+
+func TestGroup(t *testing.T) {
+	if P.BitLen() != 2048 || !P.ProbablyPrime(20) || !Q.ProbablyPrime(20) {
+		t.Fatal("P is not the RFC 3526 2048-bit safe prime")
+	}
+	if !strings.HasPrefix(P.Text(16), "ffffffffffffffffc90fdaa22168c234") {
+		t.Fatalf("P = %s...", P.Text(16)[:32])
+	}
+	if exp(G, Q).Cmp(one) != 0 {
+		t.Fatal("G does not generate the order-Q subgroup")
+	}
+	// P-1 has order 2, so it is a valid residue outside the subgroup.
+	if _, err := element(new(big.Int).Sub(P, one).Text(16)); err == nil {
+		t.Fatal("element accepted P-1")
+	}
+	for _, s := range []string{"0", P.Text(16), "zz"} {
+		if _, err := element(s); err == nil {
+			t.Fatalf("element accepted %q", s)
+		}
+	}
+}
+
+// Decrypting with the dealt key's secret recovers the message; this checks
+// the encoding (g^r, g^m h^r) and Add against known plaintexts.
+func TestAddIsHomomorphic(t *testing.T) {
+	x := randScalar()
+	h := exp(G, x)
+	encrypt := func(m int64) models.Ciphertext {
+		r := randScalar()
+		return ciphertext{exp(G, r), mul(gPow(m), exp(h, r))}.model()
+	}
+	sum := Identity()
+	for _, m := range []int64{1, 0, 1, 1, 0} {
+		var err error
+		if sum, err = Add(sum, encrypt(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := parseCiphertext(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm := mul(c.b, expNeg(c.a, x))
+	if m, ok := discreteLog(gm, 10); !ok || m != 3 {
+		t.Fatalf("decrypted %d, %v; want 3", m, ok)
+	}
+}
+
+func TestBallotRoundTrip(t *testing.T) {
+	cfg, _, err := GenerateKey(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chosen := range options {
+		b, err := EncryptBallot(cfg, "p1", "v1", options, chosen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyBallot(cfg, "p1", "v1", options, b); err != nil {
+			t.Fatalf("vote for %s: %v", chosen, err)
+		}
+	}
+	if _, err := EncryptBallot(cfg, "p1", "v1", options, "z"); err == nil {
+		t.Fatal("encrypted a vote for an unknown option")
+	}
+}
+
+func TestVerifyBallotRejectsTampering(t *testing.T) {
+	cfg, _, err := GenerateKey(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := func() models.EncryptedBallot {
+		b, err := EncryptBallot(cfg, "p1", "v1", options, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	other := fresh()
+	cases := []struct {
+		name   string
+		poll   string
+		voter  string
+		opts   []string
+		mutate func(*models.EncryptedBallot)
+	}{
+		{name: "other voter", voter: "v2"},
+		{name: "other poll", poll: "p2"},
+		{name: "extra option", opts: []string{"a", "b", "c", "d"}},
+		{name: "missing choice", mutate: func(b *models.EncryptedBallot) { b.Choices = b.Choices[:2] }},
+		{name: "duplicate choice", mutate: func(b *models.EncryptedBallot) { b.Choices[1] = b.Choices[0] }},
+		{name: "two votes for a", mutate: func(b *models.EncryptedBallot) {
+			// Doubling the ciphertext encrypts 2, which the bit proof rules out.
+			sum, err := Add(b.Choices[0].Ciphertext, b.Choices[0].Ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Choices[0].Ciphertext = sum
+		}},
+		{name: "choice from another ballot", mutate: func(b *models.EncryptedBallot) { b.Choices[1] = other.Choices[1] }},
+		{name: "sum proof from another ballot", mutate: func(b *models.EncryptedBallot) { b.SumProof = other.SumProof }},
+		{name: "swapped proofs", mutate: func(b *models.EncryptedBallot) {
+			b.Choices[0].Proof, b.Choices[1].Proof = b.Choices[1].Proof, b.Choices[0].Proof
+		}},
+		{name: "ciphertext outside group", mutate: func(b *models.EncryptedBallot) {
+			b.Choices[0].Ciphertext.A = new(big.Int).Sub(P, one).Text(16)
+		}},
+		{name: "short proof", mutate: func(b *models.EncryptedBallot) { b.SumProof = b.SumProof[:1] }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := fresh()
+			if tc.mutate != nil {
+				tc.mutate(&b)
+			}
+			poll, voter, opts := "p1", "v1", options
+			if tc.poll != "" {
+				poll = tc.poll
+			}
+			if tc.voter != "" {
+				voter = tc.voter
+			}
+			if tc.opts != nil {
+				opts = tc.opts
+			}
+			if err := VerifyBallot(cfg, poll, voter, opts, b); err == nil {
+				t.Fatal("tampered ballot verified")
+			}
+		})
+	}
+}
+
+// Any threshold of the dealt shares interpolates to the secret behind the
+// public key.
+func TestSharesRecoverKey(t *testing.T) {
+	cfg, shares, err := GenerateKey(5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := element(cfg.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range [][]int{{1, 2, 3}, {1, 3, 5}, {2, 4, 5}, {3, 4, 5}} {
+		secret := big.NewInt(0)
+		for _, i := range set {
+			num, den := big.NewInt(1), big.NewInt(1)
+			for _, j := range set {
+				if i != j {
+					num.Mul(num, big.NewInt(int64(j)))
+					den.Mul(den, big.NewInt(int64(j-i)))
+				}
+			}
+			s, err := scalar(shares[i-1].Secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := num.Mul(num, new(big.Int).ModInverse(den.Mod(den, Q), Q))
+			secret.Add(secret, l.Mul(l, s)).Mod(secret, Q)
+		}
+		if exp(G, secret).Cmp(pk) != 0 {
+			t.Fatalf("shares %v do not recover the key", set)
+		}
+	}
+	if _, _, err := GenerateKey(2, 3); err == nil {
+		t.Fatal("dealt a threshold above the number of trustees")
+	}
+}
+
+func TestThresholdTally(t *testing.T) {
+	cfg, shares, err := GenerateKey(5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	votes := []string{"a", "b", "a", "c", "a", "b"}
+	var ballots []models.Ballot
+	for i, v := range votes {
+		voter := string(rune('A' + i))
+		b, err := EncryptBallot(cfg, "p1", voter, options, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ballots = append(ballots, models.Ballot{Receipt: voter, Encrypted: &b})
+	}
+	tally, err := SumBallots(ballots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials := map[int]models.PartialDecryption{}
+	partial := func(trustee int) models.PartialDecryption {
+		if pd, ok := partials[trustee]; ok {
+			return pd
+		}
+		pd, err := PartialDecrypt("p1", tally, shares[trustee-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		partials[trustee] = pd
+		return pd
+	}
+	want := map[string]int{"a": 3, "b": 2, "c": 1}
+	for _, set := range [][]int{{1, 2, 3}, {5, 2, 4}, {1, 3, 4, 5}} {
+		var pds []models.PartialDecryption
+		for _, i := range set {
+			pds = append(pds, partial(i))
+		}
+		d, err := Combine(cfg, "p1", tally, pds, len(votes))
+		if err != nil {
+			t.Fatalf("trustees %v: %v", set, err)
+		}
+		for opt, n := range want {
+			if d.Totals[opt] != n {
+				t.Fatalf("trustees %v: totals %v, want %v", set, d.Totals, want)
+			}
+		}
+		if err := VerifyDecryption(cfg, "p1", tally, d, len(votes)); err != nil {
+			t.Fatal(err)
+		}
+		d.Totals["a"]--
+		if err := VerifyDecryption(cfg, "p1", tally, d, len(votes)); err == nil {
+			t.Fatal("verified wrong totals")
+		}
+	}
+
+	if _, err := Combine(cfg, "p1", tally, []models.PartialDecryption{partial(1), partial(2)}, len(votes)); err == nil {
+		t.Fatal("combined below the threshold")
+	}
+	if _, err := Combine(cfg, "p1", tally, []models.PartialDecryption{partial(1), partial(1), partial(2)}, len(votes)); err == nil {
+		t.Fatal("counted one trustee twice")
+	}
+	if _, err := Combine(cfg, "p2", tally, []models.PartialDecryption{partial(1), partial(2), partial(3)}, len(votes)); err == nil {
+		t.Fatal("partials for one poll verified for another")
+	}
+
+	// A trustee who publishes a wrong share is caught by its proof.
+	bad := partial(3)
+	bad.Shares = maps.Clone(bad.Shares)
+	ds := bad.Shares["a"]
+	d, _ := element(ds.D)
+	ds.D = mul(d, G).Text(16)
+	bad.Shares["a"] = ds
+	if _, err := Combine(cfg, "p1", tally, []models.PartialDecryption{partial(1), partial(2), bad}, len(votes)); err == nil {
+		t.Fatal("combined a forged decryption share")
+	}
+
+	// A share dealt to trustee 2 cannot pose as trustee 3's.
+	sh := shares[1]
+	sh.Trustee = 3
+	if _, err := PartialDecrypt("p1", tally, sh); err == nil {
+		t.Fatal("share used under another trustee index")
+	}
+}
@@ -0,0 +1,247 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+// Head is a published Merkle root over the first TreeSize ballots of a poll.
+type Head struct {
+	PollID      string    `json:"poll_id"`
+	TreeSize    int       `json:"tree_size"`
+	Root        string    `json:"root"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// Proof is an inclusion proof for one ballot against a published head.
+type Proof struct {
+	PollID    string   `json:"poll_id"`
+	Receipt   string   `json:"receipt"`
+	OptionID  string   `json:"option_id"`
+	LeafHash  string   `json:"leaf_hash"`
+	LeafIndex int      `json:"leaf_index"`
+	Head      Head     `json:"head"`
+	AuditPath []string `json:"audit_path"`
+}
+
+type published struct {
+	head    Head
+	tree    *tree
+	options []string
+	index   map[string]int
+}
+
+// Ledger periodically publishes a Merkle root over each poll's ballots and
+// answers inclusion proofs against the latest published root. Ballots are
+// taken in the order the store places them (see store.SequenceBallots), so
+// each published tree extends the previous one, and only ballots placed
+// since the last publish are read, with the last one already in the tree
+// to check that the poll was not deleted and created again meanwhile.
+type Ledger struct {
+	store store.Store
+
+	// pubMu serializes publishing; mu guards polls for readers.
+	pubMu sync.Mutex
+	mu    sync.RWMutex
+	polls map[string]*published
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(s store.Store, interval time.Duration) *Ledger {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	l := &Ledger{
+		store: s,
+		polls: make(map[string]*published),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-t.C:
+				if err := l.Publish(); err != nil {
+					log.Printf("ledger: publish: %v", err)
+				}
+			}
+		}
+	}()
+	return l
+}
+
+// Publish extends the tree of every poll with newly placed ballots. If the
+// store cannot be read, every head is kept as it was; a poll whose new
+// ballots cannot be read keeps its head until the next publish.
+func (l *Ledger) Publish() error {
+	l.pubMu.Lock()
+	defer l.pubMu.Unlock()
+	sizes, err := l.store.SequenceBallots()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	for id := range l.polls {
+		if _, ok := sizes[id]; !ok {
+			delete(l.polls, id)
+		}
+	}
+	l.mu.Unlock()
+	var first error
+	for id, n := range sizes {
+		if _, err := l.extend(id, n); err != nil && first == nil {
+			first = fmt.Errorf("poll %s: %w", id, err)
+		}
+	}
+	return first
+}
+
+// PublishPoll places any new ballots and publishes the poll's head at once.
+func (l *Ledger) PublishPoll(pollID string) (Head, error) {
+	l.pubMu.Lock()
+	defer l.pubMu.Unlock()
+	sizes, err := l.store.SequenceBallots()
+	if err != nil {
+		return Head{}, err
+	}
+	n, ok := sizes[pollID]
+	if !ok {
+		return Head{}, errors.New("poll not found")
+	}
+	return l.extend(pollID, n)
+}
+
+// extend grows pollID's tree to size n. Callers hold pubMu.
+func (l *Ledger) extend(pollID string, n int) (Head, error) {
+	l.mu.RLock()
+	cur := l.polls[pollID]
+	l.mu.RUnlock()
+	have := 0
+	var leaves []Hash
+	var options []string
+	var ballots []models.Ballot
+	if cur != nil && n == 0 && cur.head.TreeSize == 0 {
+		return cur.head, nil
+	}
+	if cur != nil && cur.head.TreeSize > 0 && n >= cur.head.TreeSize {
+		// Read from the last ballot already in the tree: if it is not
+		// there, the poll was deleted and created again (possibly by
+		// another instance), and its tree is rebuilt from scratch.
+		have = cur.head.TreeSize
+		from, err := l.store.ListBallotsFrom(pollID, have-1)
+		if err != nil {
+			return Head{}, err
+		}
+		if len(from) > 0 && LeafHash(from[0]) == cur.tree.levels[0][have-1] {
+			if n == have {
+				return cur.head, nil
+			}
+			leaves, options, ballots = cur.tree.levels[0], cur.options, from[1:]
+		} else {
+			have, cur = 0, nil
+		}
+	}
+	// A smaller size also means the poll was deleted and created again.
+	if have == 0 {
+		var err error
+		if ballots, err = l.store.ListBallotsFrom(pollID, 0); err != nil {
+			return Head{}, err
+		}
+	}
+	if have+len(ballots) < n {
+		return Head{}, fmt.Errorf("store placed %d ballots but returned %d", n, have+len(ballots))
+	}
+	ballots = ballots[:n-have]
+	// Capping the slices makes append copy them, so the current tree's
+	// readers are not disturbed.
+	leaves, options = leaves[:have:have], options[:have:have]
+	for _, b := range ballots {
+		leaves = append(leaves, LeafHash(b))
+		options = append(options, b.OptionID)
+	}
+	t := buildTree(leaves)
+	pub := &published{
+		head:    Head{PollID: pollID, TreeSize: t.size(), Root: t.root().String(), PublishedAt: time.Now().UTC()},
+		tree:    t,
+		options: options,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if have > 0 {
+		// Readers only look receipts up under mu, so the index can grow in
+		// place.
+		pub.index = cur.index
+	} else {
+		pub.index = make(map[string]int, len(ballots))
+	}
+	for i, b := range ballots {
+		pub.index[b.Receipt] = have + i
+	}
+	l.polls[pollID] = pub
+	return pub.head, nil
+}
+
+// Forget drops a poll's tree, for when the poll is deleted and its ID may
+// be reused.
+func (l *Ledger) Forget(pollID string) {
+	l.pubMu.Lock()
+	defer l.pubMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.polls, pollID)
+}
+
+func (l *Ledger) Head(pollID string) (Head, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	pub, ok := l.polls[pollID]
+	if !ok {
+		return Head{}, false
+	}
+	return pub.head, true
+}
+
+func (l *Ledger) Prove(pollID, receipt string) (Proof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	pub, ok := l.polls[pollID]
+	if !ok {
+		return Proof{}, errors.New("no root published for poll")
+	}
+	i, ok := pub.index[receipt]
+	if !ok {
+		return Proof{}, errors.New("receipt not found")
+	}
+	path := pub.tree.path(i)
+	hexPath := make([]string, len(path))
+	for j, h := range path {
+		hexPath[j] = h.String()
+	}
+	return Proof{
+		PollID:    pollID,
+		Receipt:   receipt,
+		OptionID:  pub.options[i],
+		LeafHash:  pub.tree.levels[0][i].String(),
+		LeafIndex: i,
+		Head:      pub.head,
+		AuditPath: hexPath,
+	}, nil
+}
+
+func (l *Ledger) Close() {
+	close(l.stop)
+	<-l.done
+}
@@ -0,0 +1,181 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+func vote(t *testing.T, s store.Store, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: fmt.Sprint("v", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verify(t *testing.T, p Proof) {
+	t.Helper()
+	leaf, err := ParseHash(p.LeafHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ParseHash(p.Head.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := make([]Hash, len(p.AuditPath))
+	for i, h := range p.AuditPath {
+		if path[i], err = ParseHash(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !VerifyInclusion(leaf, p.LeafIndex, p.Head.TreeSize, path, root) {
+		t.Fatalf("proof for %s at %d does not verify", p.Receipt, p.LeafIndex)
+	}
+}
+
+// Each published head commits to the ballots of the one before it, and
+// receipts prove against the latest head.
+func TestLedgerAppendOnly(t *testing.T) {
+	s := store.New()
+	if err := s.CreatePoll("p1", "q?", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddOption("p1", "a", "A"); err != nil {
+		t.Fatal(err)
+	}
+	lg := New(s, time.Hour)
+	defer lg.Close()
+
+	var heads []Head
+	have := 0
+	for _, n := range []int{1, 5, 8, 13} {
+		vote(t, s, have, n)
+		have = n
+		h, err := lg.PublishPoll("p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.TreeSize != n {
+			t.Fatalf("head size %d, want %d", h.TreeSize, n)
+		}
+		heads = append(heads, h)
+	}
+
+	ballots, err := s.ListBallots("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range heads {
+		if got := RootOf(ballots[:h.TreeSize]).String(); got != h.Root {
+			t.Fatalf("head of size %d has root %s; its ballots give %s", h.TreeSize, h.Root, got)
+		}
+	}
+	for _, b := range ballots {
+		p, err := lg.Prove("p1", b.Receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Head != heads[len(heads)-1] || p.LeafHash != LeafHash(b).String() {
+			t.Fatalf("proof for %s is not against the latest head", b.Receipt)
+		}
+		verify(t, p)
+	}
+	if _, err := lg.Prove("p1", "nope"); err == nil {
+		t.Fatal("proved an unknown receipt")
+	}
+}
+
+// failing makes ListBallotsFrom fail while set.
+type failing struct {
+	store.Store
+	fail bool
+}
+
+func (f *failing) ListBallotsFrom(pollID string, from int) ([]models.Ballot, error) {
+	if f.fail {
+		return nil, errors.New("store unavailable")
+	}
+	return f.Store.ListBallotsFrom(pollID, from)
+}
+
+func TestLedgerKeepsHeadOnError(t *testing.T) {
+	mem := store.New()
+	if err := mem.CreatePoll("p1", "q?", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.AddOption("p1", "a", "A"); err != nil {
+		t.Fatal(err)
+	}
+	s := &failing{Store: mem}
+	lg := New(s, time.Hour)
+	defer lg.Close()
+
+	vote(t, s, 0, 3)
+	if err := lg.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := lg.Head("p1")
+	vote(t, s, 3, 6)
+	s.fail = true
+	if err := lg.Publish(); err == nil {
+		t.Fatal("publish hid a store error")
+	}
+	if after, _ := lg.Head("p1"); after != before {
+		t.Fatalf("head moved to %+v on a failed publish", after)
+	}
+	s.fail = false
+	if err := lg.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := lg.Head("p1"); after.TreeSize != 6 {
+		t.Fatalf("head size %d after recovery, want 6", after.TreeSize)
+	}
+}
+
+// A poll deleted and created again behind the ledger's back, with at least
+// as many ballots as before, gets a tree of its own ballots only.
+func TestLedgerRebuildsRecreatedPoll(t *testing.T) {
+	s := store.New()
+	create := func() {
+		t.Helper()
+		if err := s.CreatePoll("p1", "q?", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddOption("p1", "a", "A"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lg := New(s, time.Hour)
+	defer lg.Close()
+
+	create()
+	vote(t, s, 0, 3)
+	if _, err := lg.PublishPoll("p1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{3, 5} {
+		if err := s.DeletePoll("p1"); err != nil {
+			t.Fatal(err)
+		}
+		create()
+		vote(t, s, 0, n)
+		head, err := lg.PublishPoll("p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ballots, err := s.ListBallots("p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := RootOf(ballots).String(); head.Root != want || head.TreeSize != n {
+			t.Fatalf("%d ballots: head %s size %d, want %s size %d", n, head.Root, head.TreeSize, want, n)
+		}
+	}
+}
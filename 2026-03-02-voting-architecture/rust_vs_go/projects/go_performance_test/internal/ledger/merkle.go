@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// The tree follows RFC 6962: leaves are hashed as sha256(0x00 || data) and
+// interior nodes as sha256(0x01 || left || right). A ballot's leaf data is
+// "<receipt>:<option_id>", or "<receipt>:<commitment>" for encrypted ballots.
+
+type Hash [sha256.Size]byte
+
+func (h Hash) String() string { return hex.EncodeToString(h[:]) }
+
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(h) {
+		return h, errors.New("invalid hash")
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+func LeafHash(b models.Ballot) Hash {
+	if b.Commitment != "" {
+		return sha256.Sum256([]byte("\x00" + b.Receipt + ":" + b.Commitment))
+	}
+	return sha256.Sum256([]byte("\x00" + b.Receipt + ":" + b.OptionID))
+}
+
+func nodeHash(left, right Hash) Hash {
+	var buf [1 + 2*sha256.Size]byte
+	buf[0] = 0x01
+	copy(buf[1:], left[:])
+	copy(buf[1+sha256.Size:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// tree keeps every level so audit paths can be served without rehashing.
+// Pairing bottom-up and promoting a lone last node yields the same shape
+// as RFC 6962's largest-power-of-two split.
+type tree struct {
+	levels [][]Hash
+}
+
+func buildTree(leaves []Hash) *tree {
+	t := &tree{levels: [][]Hash{leaves}}
+	for cur := leaves; len(cur) > 1; {
+		next := make([]Hash, 0, (len(cur)+1)/2)
+		for i := 0; i < len(cur); i += 2 {
+			if i+1 < len(cur) {
+				next = append(next, nodeHash(cur[i], cur[i+1]))
+			} else {
+				next = append(next, cur[i])
+			}
+		}
+		t.levels = append(t.levels, next)
+		cur = next
+	}
+	return t
+}
+
+func (t *tree) size() int { return len(t.levels[0]) }
+
+func (t *tree) root() Hash {
+	if t.size() == 0 {
+		return sha256.Sum256(nil)
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+func (t *tree) path(index int) []Hash {
+	out := []Hash{}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sib := index ^ 1; sib < len(level) {
+			out = append(out, level[sib])
+		}
+		index >>= 1
+	}
+	return out
+}
+
+// RootOf returns the Merkle root over ballots in the given order.
+func RootOf(ballots []models.Ballot) Hash {
+	leaves := make([]Hash, len(ballots))
+	for i, b := range ballots {
+		leaves[i] = LeafHash(b)
+	}
+	return buildTree(leaves).root()
+}
+
+// VerifyInclusion checks an audit path per RFC 9162 section 2.1.3.2.
+func VerifyInclusion(leaf Hash, index, size int, path []Hash, root Hash) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r[:], root[:])
+}
@@ -0,0 +1,191 @@
+package ledger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// The leaves and roots below are the RFC 6962 test vectors used by the
+// Certificate Transparency implementations.
+var ctLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var ctRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func rawLeaf(t *testing.T, hexData string) Hash {
+	t.Helper()
+	data, err := hex.DecodeString(hexData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha256.Sum256(append([]byte{0}, data...))
+}
+
+func TestKnownRoots(t *testing.T) {
+	if got := buildTree(nil).root().String(); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("empty root = %s", got)
+	}
+	var leaves []Hash
+	for i, l := range ctLeaves {
+		leaves = append(leaves, rawLeaf(t, l))
+		if got := buildTree(leaves).root().String(); got != ctRoots[i] {
+			t.Fatalf("root of %d leaves = %s, want %s", i+1, got, ctRoots[i])
+		}
+	}
+}
+
+// mth and auditPath are RFC 6962 section 2.1's recursive definitions,
+// which the level-by-level tree must agree with.
+func mth(d []Hash) Hash {
+	switch len(d) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return d[0]
+	}
+	k := split(len(d))
+	return nodeHash(mth(d[:k]), mth(d[k:]))
+}
+
+func auditPath(m int, d []Hash) []Hash {
+	if len(d) <= 1 {
+		return nil
+	}
+	k := split(len(d))
+	if m < k {
+		return append(auditPath(m, d[:k]), mth(d[k:]))
+	}
+	return append(auditPath(m-k, d[k:]), mth(d[:k]))
+}
+
+// split is the largest power of two smaller than n.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func leaves(n int) []Hash {
+	out := make([]Hash, n)
+	for i := range out {
+		out[i] = sha256.Sum256([]byte(fmt.Sprint("\x00leaf ", i)))
+	}
+	return out
+}
+
+func TestTreeMatchesRFC(t *testing.T) {
+	for n := 0; n <= 70; n++ {
+		d := leaves(n)
+		tr := buildTree(d)
+		root := tr.root()
+		if want := mth(d); root != want {
+			t.Fatalf("size %d: root %s, want %s", n, root, want)
+		}
+		for m := 0; m < n; m++ {
+			path := tr.path(m)
+			want := auditPath(m, d)
+			if fmt.Sprint(path) != fmt.Sprint(want) {
+				t.Fatalf("size %d leaf %d: path differs from RFC 6962", n, m)
+			}
+			if !VerifyInclusion(d[m], m, n, path, root) {
+				t.Fatalf("size %d leaf %d: valid proof rejected", n, m)
+			}
+		}
+	}
+}
+
+func TestVerifyInclusionRejectsTampering(t *testing.T) {
+	const n = 13
+	d := leaves(n)
+	tr := buildTree(d)
+	root := tr.root()
+	for m := 0; m < n; m++ {
+		path := tr.path(m)
+		if VerifyInclusion(d[(m+1)%n], m, n, path, root) {
+			t.Fatalf("leaf %d: proof accepted for another leaf", m)
+		}
+		if VerifyInclusion(d[m], (m+1)%n, n, path, root) {
+			t.Fatalf("leaf %d: proof accepted at another index", m)
+		}
+		// The size only binds through the proof's shape, so try sizes that
+		// change it; a neighbouring size can share the same shape.
+		if VerifyInclusion(d[m], m, 2*n, path, root) || VerifyInclusion(d[m], m, n/2, path, root) {
+			t.Fatalf("leaf %d: proof accepted for another tree size", m)
+		}
+		if VerifyInclusion(d[m], m, n, path, mth(d[:n-1])) {
+			t.Fatalf("leaf %d: proof accepted against another root", m)
+		}
+		if VerifyInclusion(d[m], m, n, path[:len(path)-1], root) {
+			t.Fatalf("leaf %d: truncated path accepted", m)
+		}
+		if VerifyInclusion(d[m], m, n, append(append([]Hash(nil), path...), root), root) {
+			t.Fatalf("leaf %d: extended path accepted", m)
+		}
+		for i := range path {
+			bad := append([]Hash(nil), path...)
+			bad[i][0] ^= 1
+			if VerifyInclusion(d[m], m, n, bad, root) {
+				t.Fatalf("leaf %d: path with element %d flipped accepted", m, i)
+			}
+		}
+	}
+	if VerifyInclusion(d[0], -1, n, tr.path(0), root) || VerifyInclusion(d[0], n, n, tr.path(0), root) {
+		t.Fatal("out of range index accepted")
+	}
+}
+
+// A leaf must not be mistaken for an interior node (RFC 6962's domain
+// separation): the bytes of an interior node, hashed as a leaf, do not
+// verify where the node does.
+func TestLeafNodeSeparation(t *testing.T) {
+	d := leaves(4)
+	tr := buildTree(d)
+	inner := nodeHash(d[0], d[1])
+	if !VerifyInclusion(inner, 0, 2, []Hash{nodeHash(d[2], d[3])}, tr.root()) {
+		t.Fatal("sanity: the interior node does verify against a two-leaf view")
+	}
+	var data [2 * sha256.Size]byte
+	copy(data[:], d[0][:])
+	copy(data[sha256.Size:], d[1][:])
+	asLeaf := sha256.Sum256(append([]byte{0}, data[:]...))
+	if asLeaf == inner {
+		t.Fatal("leaf and node hashes collide")
+	}
+	if VerifyInclusion(asLeaf, 0, 2, []Hash{nodeHash(d[2], d[3])}, tr.root()) {
+		t.Fatal("interior node data accepted as a leaf")
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	h := leaves(1)[0]
+	got, err := ParseHash(h.String())
+	if err != nil || got != h {
+		t.Fatalf("ParseHash(%s) = %s, %v", h, got, err)
+	}
+	for _, s := range []string{"", "zz", h.String()[2:], h.String() + "00"} {
+		if _, err := ParseHash(s); err == nil {
+			t.Fatalf("ParseHash accepted %q", s)
+		}
+	}
+}
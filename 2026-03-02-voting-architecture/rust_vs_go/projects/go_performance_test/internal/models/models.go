@@ -12,10 +12,90 @@ type Poll struct {
 	IsOpen   bool                   `json:"is_open"`
 	Options  map[string]*OptionItem `json:"-"`
 	Voters   map[string]struct{}    `json:"-"`
+	Ballots  []Ballot               `json:"-"`
+
+	Encryption *EncryptionConfig     `json:"-"`
+	Tally      map[string]Ciphertext `json:"-"`
+	Decryption *Decryption           `json:"-"`
+
+	Frozen      bool         `json:"-"`
+	Certificate *Certificate `json:"-"`
+}
+
+// Ballot is one counted vote, detached from the voter. Encrypted ballots
+// leave OptionID empty and carry the ciphertexts and their digest instead.
+type Ballot struct {
+	Receipt    string           `json:"receipt"`
+	OptionID   string           `json:"option_id"`
+	Commitment string           `json:"commitment,omitempty"`
+	Encrypted  *EncryptedBallot `json:"encrypted,omitempty"`
 }
 
 type VoteRequest struct {
 	PollID   string `json:"poll_id"`
 	OptionID string `json:"option_id"`
 	VoterID  string `json:"voter_id"`
+
+	ReceiptID string `json:"receipt_id,omitempty"`
+	VoteID    string `json:"vote_id,omitempty"`
+
+	Encrypted *EncryptedBallot `json:"encrypted_ballot,omitempty"`
+}
+
+// Group elements and scalars below are hex-encoded big integers.
+
+type Ciphertext struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+type EncryptedChoice struct {
+	OptionID   string     `json:"option_id"`
+	Ciphertext Ciphertext `json:"ciphertext"`
+	Proof      []string   `json:"proof"`
+}
+
+type EncryptedBallot struct {
+	Choices  []EncryptedChoice `json:"choices"`
+	SumProof []string          `json:"sum_proof"`
+}
+
+type EncryptionConfig struct {
+	PublicKey        string   `json:"public_key"`
+	Threshold        int      `json:"threshold"`
+	VerificationKeys []string `json:"verification_keys"`
+}
+
+type DecryptionShare struct {
+	D     string   `json:"d"`
+	Proof []string `json:"proof"`
+}
+
+type PartialDecryption struct {
+	Trustee int                        `json:"trustee"`
+	Shares  map[string]DecryptionShare `json:"shares"`
+}
+
+type Decryption struct {
+	Totals   map[string]int      `json:"totals"`
+	Partials []PartialDecryption `json:"partials"`
+}
+
+type EncryptedPoll struct {
+	PollID     string                `json:"poll_id"`
+	IsOpen     bool                  `json:"is_open"`
+	Config     EncryptionConfig      `json:"config"`
+	Tally      map[string]Ciphertext `json:"tally"`
+	Ballots    int                   `json:"ballots"`
+	Decryption *Decryption           `json:"decryption,omitempty"`
+}
+
+// Certificate is the signed result document of a certified poll. Signature
+// is a base64 ed25519 signature over Document's exact bytes; PublicKey is
+// the signer's PEM public key.
+type Certificate struct {
+	PollID    string `json:"poll_id"`
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+	PublicKey string `json:"public_key"`
 }
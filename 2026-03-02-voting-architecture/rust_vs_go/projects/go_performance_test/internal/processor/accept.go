@@ -0,0 +1,162 @@
+package processor
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "net"
+    "strings"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/queue"
+)
+
+// acceptScript is Enqueue's Redis path. One script checks the idempotency
+// key, claims the voter, records the pending status and count, queues the
+// vote and stores the idempotent answer, so an accepted vote costs one
+// round trip instead of one per step. It writes the same keys as the
+// step-by-step path, which is still taken while Redis is degraded. The keys
+// all carry the queue's hash tag (see New), so they share a slot on Redis
+// Cluster.
+//
+// KEYS: idempotency key, voters set, status, status voter index, pending
+// hash, pending votes, queue; an unused key is ''. ARGV: idempotent answer
+// and its TTL (ms), voter and the voters set's TTL (ms), status and its TTL
+// (ms), vote ID, option ID, vote payload, stream field ('' for a list).
+var acceptScript = redis.NewScript(`
+if KEYS[1] ~= '' then
+    local prev = redis.call('GET', KEYS[1])
+    if prev then
+        return {2, prev}
+    end
+end
+if KEYS[2] ~= '' then
+    if redis.call('SADD', KEYS[2], ARGV[3]) == 0 then
+        return {1, ''}
+    end
+    redis.call('PEXPIRE', KEYS[2], ARGV[4])
+end
+redis.call('SET', KEYS[3], ARGV[5], 'PX', ARGV[6])
+redis.call('SET', KEYS[4], ARGV[7], 'PX', ARGV[6])
+if ARGV[8] ~= '' and redis.call('SADD', KEYS[6], ARGV[7]) == 1 then
+    redis.call('HINCRBY', KEYS[5], ARGV[8], 1)
+end
+if ARGV[10] == '' then
+    redis.call('RPUSH', KEYS[7], ARGV[9])
+else
+    redis.call('XADD', KEYS[7], '*', ARGV[10], ARGV[9])
+end
+if KEYS[1] ~= '' then
+    redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+return {0, ''}`)
+
+const (
+    acceptOK = iota
+    acceptVoted
+    acceptKeyTaken
+)
+
+// acceptRedis queues v, which already has its vote ID, through
+// acceptScript. With idemKey set, done is stored under it, and an entry
+// already there is returned as prev instead. handled is false when Redis
+// is not in use or degraded, or the script never reached Redis; the caller
+// then takes the step-by-step path. Any other failure may have come after
+// the script ran, so it is returned as is: falling back could queue the
+// vote twice, and the voter stays claimed.
+func (p *Processor) acceptRedis(v models.VoteRequest, idemKey string, done idemEntry) (prev *idemEntry, handled bool, err error) {
+    rs, ok := p.status.(*redisStatus)
+    if !ok || rs.down() {
+        return nil, false, nil
+    }
+    rp, ok := p.pending.(*redisPending)
+    if !ok {
+        return nil, false, nil
+    }
+    tq, ok := p.queue.(queue.Targeted)
+    if !ok {
+        return nil, false, nil
+    }
+    target, ok := tq.Target()
+    if !ok {
+        return nil, false, nil
+    }
+    keys := make([]string, 7)
+    args := make([]any, 10)
+    args[0], args[1], args[3] = "", 0, 0
+    if idemKey != "" {
+        ri, ok := p.idem.(*redisIdempotency)
+        if !ok {
+            return nil, false, nil
+        }
+        b, err := json.Marshal(done)
+        if err != nil {
+            return nil, false, nil
+        }
+        keys[0], args[0], args[1] = ri.key(idemKey), b, ri.ttl.Milliseconds()
+    }
+    var rv *redisVoters
+    if p.voters != nil {
+        if rv, ok = p.voters.(*redisVoters); !ok {
+            return nil, false, nil
+        }
+        keys[1], args[3] = rv.key(v.PollID), rv.ttl.Milliseconds()
+    }
+    st, err := json.Marshal(VoteStatus{VoteID: v.VoteID, PollID: v.PollID, VoterID: v.VoterID, Status: StatusPending, UpdatedAt: time.Now().UTC()})
+    if err != nil {
+        return nil, false, nil
+    }
+    payload, err := json.Marshal(v)
+    if err != nil {
+        return nil, false, nil
+    }
+    pk := rp.keys(v.PollID)
+    keys[2], keys[3], keys[4], keys[5], keys[6] = rs.key(v.VoteID), rs.voterKey(v.PollID, v.VoterID), pk[0], pk[1], target.Key
+    args[2], args[4], args[5], args[6], args[7], args[8], args[9] = v.VoterID, st, rs.ttl.Milliseconds(), v.VoteID, v.OptionID, payload, target.Field
+    if v.Encrypted != nil {
+        // Its option is secret, so it is not counted as pending.
+        args[7] = ""
+    }
+
+    ctx, cancel := context.WithTimeout(p.ctx, redisStatusTimeout)
+    defer cancel()
+    res, err := acceptScript.Run(ctx, p.rdb, keys, args...).Slice()
+    if err != nil && notSent(err) {
+        return nil, false, nil
+    }
+    if err != nil {
+        log.Printf("accept vote %s: %v", v.VoteID, err)
+        return nil, true, errors.New("vote may not have been queued")
+    }
+    if len(res) != 2 {
+        return nil, true, errors.New("unexpected reply from accept script")
+    }
+    code, _ := res[0].(int64)
+    switch code {
+    case acceptVoted:
+        return nil, true, errors.New("voter has already voted in this poll")
+    case acceptKeyTaken:
+        raw, _ := res[1].(string)
+        var e idemEntry
+        if err := json.Unmarshal([]byte(raw), &e); err != nil {
+            return nil, true, err
+        }
+        return &e, true, nil
+    }
+    return nil, true, nil
+}
+
+// notSent reports whether err shows a command never reached Redis: no
+// connection could be had, or the script was not loaded (Run retries
+// NOSCRIPT with EVAL, so this only follows a failed retry).
+func notSent(err error) bool {
+    if errors.Is(err, redis.ErrPoolTimeout) || errors.Is(err, redis.ErrClosed) || strings.HasPrefix(err.Error(), "NOSCRIPT") {
+        return true
+    }
+    var op *net.OpError
+    return errors.As(err, &op) && op.Op == "dial"
+}
@@ -0,0 +1,26 @@
+package processor
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    redis "github.com/redis/go-redis/v9"
+)
+
+// Only failures that show the script never reached Redis let Enqueue fall
+// back to the step-by-step path.
+func TestNotSent(t *testing.T) {
+    rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+    defer rdb.Close()
+    err := acceptScript.Run(context.Background(), rdb, []string{"a"}).Err()
+    if err == nil || !notSent(err) {
+        t.Fatalf("dial failure %v not seen as unsent", err)
+    }
+    if notSent(context.DeadlineExceeded) {
+        t.Fatal("timeout seen as unsent")
+    }
+    if notSent(errors.New("ERR Error running script")) {
+        t.Fatal("script error seen as unsent")
+    }
+}
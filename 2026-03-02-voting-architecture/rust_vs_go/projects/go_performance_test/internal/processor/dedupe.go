@@ -0,0 +1,173 @@
+package processor
+
+import (
+    "context"
+    "hash/fnv"
+    "strings"
+    "sync"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+)
+
+// voterSet remembers which voters have a vote accepted per poll, so a
+// repeated voter is turned away before it takes a queue slot. It is only a
+// filter: the store's uniqueness check still decides, and a voter whose
+// vote did not count is released so they can vote again.
+type voterSet interface {
+    // Claim marks the voter and reports whether they were not marked yet.
+    Claim(pollID, voterID string) bool
+    // Claimed reports whether the voter is marked.
+    Claimed(pollID, voterID string) bool
+    Release(pollID, voterID string)
+    ForgetPoll(pollID string)
+}
+
+const voterShards = 64
+
+// memoryVoters is an exact set split into shards to keep lock contention
+// low. A Bloom filter would be smaller, but its false positives would turn
+// away voters who never voted.
+type memoryVoters struct {
+    shards [voterShards]struct {
+        mu     sync.Mutex
+        voters map[string]struct{}
+    }
+}
+
+func newMemoryVoters() *memoryVoters {
+    m := &memoryVoters{}
+    for i := range m.shards {
+        m.shards[i].voters = make(map[string]struct{})
+    }
+    return m
+}
+
+func voterKey(pollID, voterID string) string { return pollID + "\x00" + voterID }
+
+func (m *memoryVoters) shard(key string) int {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return int(h.Sum32() % voterShards)
+}
+
+func (m *memoryVoters) Claim(pollID, voterID string) bool {
+    k := voterKey(pollID, voterID)
+    sh := &m.shards[m.shard(k)]
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    if _, ok := sh.voters[k]; ok {
+        return false
+    }
+    sh.voters[k] = struct{}{}
+    return true
+}
+
+func (m *memoryVoters) Claimed(pollID, voterID string) bool {
+    k := voterKey(pollID, voterID)
+    sh := &m.shards[m.shard(k)]
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    _, ok := sh.voters[k]
+    return ok
+}
+
+func (m *memoryVoters) Release(pollID, voterID string) {
+    k := voterKey(pollID, voterID)
+    sh := &m.shards[m.shard(k)]
+    sh.mu.Lock()
+    delete(sh.voters, k)
+    sh.mu.Unlock()
+}
+
+func (m *memoryVoters) ForgetPoll(pollID string) {
+    prefix := pollID + "\x00"
+    for i := range m.shards {
+        sh := &m.shards[i]
+        sh.mu.Lock()
+        for k := range sh.voters {
+            if strings.HasPrefix(k, prefix) {
+                delete(sh.voters, k)
+            }
+        }
+        sh.mu.Unlock()
+    }
+}
+
+// redisVoters keeps one Redis set per poll, shared by every instance;
+// SADD claims a voter in one round trip. Each claim extends the set's life
+// to ttl (VOTE_DEDUPE_TTL), so the sets of polls that stopped taking votes
+// expire; the store still turns away a repeat after that. While Redis is
+// unreachable it falls back to a local set, and a failed call lets the
+// vote through.
+type redisVoters struct {
+    rdb    *redis.Client
+    ctx    context.Context
+    prefix string
+    ttl    time.Duration
+    local  *memoryVoters
+    down   func() bool
+}
+
+func (r *redisVoters) key(pollID string) string { return r.prefix + pollID }
+
+func (r *redisVoters) Claim(pollID, voterID string) bool {
+    if r.down() {
+        return r.local.Claim(pollID, voterID)
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    pipe := r.rdb.Pipeline()
+    added := pipe.SAdd(ctx, r.key(pollID), voterID)
+    pipe.PExpire(ctx, r.key(pollID), r.ttl)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return r.local.Claim(pollID, voterID)
+    }
+    return added.Val() == 1
+}
+
+func (r *redisVoters) Claimed(pollID, voterID string) bool {
+    // Claims made while Redis was unreachable are only held locally.
+    if r.local.Claimed(pollID, voterID) {
+        return true
+    }
+    if r.down() {
+        return false
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    ok, err := r.rdb.SIsMember(ctx, r.key(pollID), voterID).Result()
+    return err == nil && ok
+}
+
+func (r *redisVoters) Release(pollID, voterID string) {
+    r.local.Release(pollID, voterID)
+    if r.down() {
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    _ = r.rdb.SRem(ctx, r.key(pollID), voterID).Err()
+}
+
+func (r *redisVoters) ForgetPoll(pollID string) {
+    r.local.ForgetPoll(pollID)
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    _ = r.rdb.Del(ctx, r.key(pollID)).Err()
+}
+
+// ForgetPoll drops the accept-time record of a poll's voters and its
+// pending counts, for when the poll is deleted and its ID may be reused.
+func (p *Processor) ForgetPoll(pollID string) {
+    if p.voters != nil {
+        p.voters.ForgetPoll(pollID)
+    }
+    p.pending.Forget(pollID)
+}
+
+func (p *Processor) releaseVoter(pollID, voterID string) {
+    if p.voters != nil {
+        p.voters.Release(pollID, voterID)
+    }
+}
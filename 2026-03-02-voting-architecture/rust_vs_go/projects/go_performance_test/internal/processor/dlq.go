@@ -0,0 +1,247 @@
+package processor
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "math/rand/v2"
+    "sort"
+    "sync"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/store"
+)
+
+// DeadLetter is a vote that could not be applied: it kept failing with
+// transient errors until retries ran out, or its payload did not decode.
+// Vote is nil in the latter case and Payload holds the raw message.
+type DeadLetter struct {
+    ID       string              `json:"id"`
+    Vote     *models.VoteRequest `json:"vote,omitempty"`
+    Payload  string              `json:"payload,omitempty"`
+    Error    string              `json:"error"`
+    Attempts int                 `json:"attempts"`
+    FailedAt time.Time           `json:"failed_at"`
+}
+
+// DeadLetters holds dead-lettered votes until an operator replays or
+// discards them.
+type DeadLetters interface {
+    Add(d DeadLetter) error
+    List() ([]DeadLetter, error)
+    Get(id string) (DeadLetter, bool)
+    Delete(id string) bool
+}
+
+// retryPolicy retries transient failures with capped exponential backoff
+// and full jitter.
+type retryPolicy struct {
+    attempts int
+    base     time.Duration
+    max      time.Duration
+}
+
+func (r retryPolicy) backoff(attempt int) time.Duration {
+    d := r.base << (attempt - 1)
+    if d <= 0 || d > r.max {
+        d = r.max
+    }
+    return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// applyWithRetry applies v, retrying transient errors. It returns the number
+// of attempts made, whether retries were exhausted (or cut short by ctx) on
+// a transient error, and the last error. While the store's circuit is open
+// it waits for the circuit without using up attempts, so an outage does not
+// dead-letter every vote in flight.
+func applyWithRetry(ctx context.Context, s store.Store, r retryPolicy, v models.VoteRequest) (int, bool, error) {
+    for attempt := 1; ; attempt++ {
+        err := s.ApplyVote(v)
+        if !store.IsTransient(err) {
+            return attempt, false, err
+        }
+        wait, open := store.IsUnavailable(err)
+        if open {
+            attempt--
+        } else if attempt >= r.attempts {
+            return attempt, true, err
+        } else {
+            wait = r.backoff(attempt)
+        }
+        t := time.NewTimer(wait)
+        select {
+        case <-t.C:
+        case <-ctx.Done():
+            t.Stop()
+            return attempt, true, err
+        }
+    }
+}
+
+type memoryDeadLetters struct {
+    mu    sync.Mutex
+    items map[string]DeadLetter
+}
+
+func newMemoryDeadLetters() *memoryDeadLetters {
+    return &memoryDeadLetters{items: make(map[string]DeadLetter)}
+}
+
+func (m *memoryDeadLetters) Add(d DeadLetter) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.items[d.ID] = d
+    return nil
+}
+
+func (m *memoryDeadLetters) List() ([]DeadLetter, error) {
+    m.mu.Lock()
+    out := make([]DeadLetter, 0, len(m.items))
+    for _, d := range m.items {
+        out = append(out, d)
+    }
+    m.mu.Unlock()
+    sortDeadLetters(out)
+    return out, nil
+}
+
+func (m *memoryDeadLetters) Get(id string) (DeadLetter, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    d, ok := m.items[id]
+    return d, ok
+}
+
+func (m *memoryDeadLetters) Delete(id string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.items[id]; !ok {
+        return false
+    }
+    delete(m.items, id)
+    return true
+}
+
+// redisDeadLetters keeps dead letters in one hash keyed by ID so every
+// instance sees the same set.
+type redisDeadLetters struct {
+    rdb *redis.Client
+    ctx context.Context
+    key string
+}
+
+func (r *redisDeadLetters) Add(d DeadLetter) error {
+    b, err := json.Marshal(d)
+    if err != nil {
+        return err
+    }
+    // The processor context may already be cancelled during shutdown; the
+    // dead letter must still be written.
+    return r.rdb.HSet(context.WithoutCancel(r.ctx), r.key, d.ID, b).Err()
+}
+
+func (r *redisDeadLetters) List() ([]DeadLetter, error) {
+    vals, err := r.rdb.HGetAll(r.ctx, r.key).Result()
+    if err != nil {
+        return nil, err
+    }
+    out := make([]DeadLetter, 0, len(vals))
+    for _, raw := range vals {
+        var d DeadLetter
+        if json.Unmarshal([]byte(raw), &d) == nil {
+            out = append(out, d)
+        }
+    }
+    sortDeadLetters(out)
+    return out, nil
+}
+
+func (r *redisDeadLetters) Get(id string) (DeadLetter, bool) {
+    raw, err := r.rdb.HGet(r.ctx, r.key, id).Bytes()
+    if err != nil {
+        return DeadLetter{}, false
+    }
+    var d DeadLetter
+    if json.Unmarshal(raw, &d) != nil {
+        return DeadLetter{}, false
+    }
+    return d, true
+}
+
+func (r *redisDeadLetters) Delete(id string) bool {
+    n, err := r.rdb.HDel(r.ctx, r.key, id).Result()
+    return err == nil && n > 0
+}
+
+func sortDeadLetters(ds []DeadLetter) {
+    sort.Slice(ds, func(i, j int) bool {
+        if ds[i].FailedAt.Equal(ds[j].FailedAt) {
+            return ds[i].ID < ds[j].ID
+        }
+        return ds[i].FailedAt.Before(ds[j].FailedAt)
+    })
+}
+
+// DeadLetters lists dead-lettered votes, oldest first.
+func (p *Processor) DeadLetters() ([]DeadLetter, error) {
+    return p.dead.List()
+}
+
+func (p *Processor) DeadLetter(id string) (DeadLetter, bool) {
+    return p.dead.Get(id)
+}
+
+// ReplayDeadLetter removes a dead letter and queues its vote again under
+// the same vote ID and receipt.
+func (p *Processor) ReplayDeadLetter(id string) error {
+    d, ok := p.dead.Get(id)
+    if !ok {
+        return errors.New("dead letter not found")
+    }
+    if d.Vote == nil {
+        return errors.New("dead letter has no decodable vote")
+    }
+    if !p.dead.Delete(id) {
+        return errors.New("dead letter not found")
+    }
+    if !p.enqueue(*d.Vote) {
+        _ = p.dead.Add(d)
+        return errors.New("queue is full")
+    }
+    return nil
+}
+
+func (p *Processor) DiscardDeadLetter(id string) error {
+    d, _ := p.dead.Get(id)
+    if !p.dead.Delete(id) {
+        return errors.New("dead letter not found")
+    }
+    if d.Vote != nil {
+        p.releaseVoter(d.Vote.PollID, d.Vote.VoterID)
+    }
+    return nil
+}
+
+// deadLetter stores a vote that cannot be applied, then marks it dead
+// lettered. If the dead-letter store fails the vote is not marked, and the
+// caller must not ack it.
+func (p *Processor) deadLetter(v *models.VoteRequest, payload string, err error, attempts int) error {
+    d := DeadLetter{Vote: v, Payload: payload, Error: err.Error(), Attempts: attempts, FailedAt: time.Now().UTC()}
+    if v != nil && v.VoteID != "" {
+        d.ID = v.VoteID
+    } else {
+        d.ID = newVoteID()
+    }
+    if err := p.dead.Add(d); err != nil {
+        log.Printf("dead letter %s could not be stored: %v", d.ID, err)
+        return err
+    }
+    if v != nil && v.VoteID != "" {
+        p.setStatus(VoteStatus{VoteID: v.VoteID, PollID: v.PollID, VoterID: v.VoterID, Status: StatusDeadLettered, Error: d.Error, UpdatedAt: d.FailedAt})
+    }
+    return nil
+}
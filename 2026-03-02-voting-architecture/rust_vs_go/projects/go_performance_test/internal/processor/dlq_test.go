@@ -0,0 +1,57 @@
+package processor
+
+import (
+    "errors"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/store"
+)
+
+// brokenDeadLetters fails every Add.
+type brokenDeadLetters struct{ DeadLetters }
+
+func (brokenDeadLetters) Add(DeadLetter) error { return errors.New("dead-letter store is down") }
+
+// failingStore fails every vote with a transient error.
+type failingStore struct{ store.Store }
+
+func (failingStore) ApplyVote(models.VoteRequest) error { return io.ErrUnexpectedEOF }
+
+// A vote that runs out of retries is only marked dead lettered, and only
+// counted as done, once the dead-letter store has it.
+func TestApplyKeepsVoteWhenDeadLetterFails(t *testing.T) {
+    p := &Processor{
+        store:   failingStore{store.New()},
+        retry:   retryPolicy{attempts: 1, base: time.Millisecond, max: time.Millisecond},
+        dead:    brokenDeadLetters{},
+        status:  newMemoryStatus(time.Minute, 10),
+        pending: newMemoryPending(),
+    }
+    v := models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1", VoteID: "id1"}
+    p.countPending(v)
+    p.status.Set(VoteStatus{VoteID: v.VoteID, PollID: v.PollID, VoterID: v.VoterID, Status: StatusPending})
+
+    if p.apply(t.Context(), v) {
+        t.Fatal("apply reported the vote handled")
+    }
+    if st, _ := p.status.Get(v.VoteID); st.Status != StatusPending {
+        t.Fatalf("status %s, want %s", st.Status, StatusPending)
+    }
+    if n := p.pending.Poll("p1")["a"]; n != 1 {
+        t.Fatalf("pending %d, want 1", n)
+    }
+
+    p.dead = newMemoryDeadLetters()
+    if !p.apply(t.Context(), v) {
+        t.Fatal("apply did not handle the vote")
+    }
+    if st, _ := p.status.Get(v.VoteID); st.Status != StatusDeadLettered {
+        t.Fatalf("status %s, want %s", st.Status, StatusDeadLettered)
+    }
+    if n := p.pending.Poll("p1")["a"]; n != 0 {
+        t.Fatalf("pending %d, want 0", n)
+    }
+}
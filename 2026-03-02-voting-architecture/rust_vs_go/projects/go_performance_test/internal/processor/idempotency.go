@@ -0,0 +1,264 @@
+package processor
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "sync"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// Accepted is what a client gets back for an accepted vote. It is kept per
+// idempotency key so a retried request can be answered with it again.
+type Accepted struct {
+    VoteID  string `json:"vote_id"`
+    Receipt string `json:"receipt"`
+}
+
+// idemEntry is the state of one idempotency key. Until the vote is queued
+// the entry is a reservation (Done false) that holds off concurrent
+// retries; it expires after idemPendingTTL in case the instance dies.
+type idemEntry struct {
+    Fingerprint string   `json:"fingerprint"`
+    Done        bool     `json:"done"`
+    Accepted    Accepted `json:"accepted"`
+}
+
+const idemPendingTTL = 30 * time.Second
+
+// idempotencyStore holds idempotency keys for a bounded time.
+type idempotencyStore interface {
+    Get(key string) (idemEntry, bool)
+    // Reserve stores e under key unless the key is taken, in which case it
+    // returns the existing entry and false.
+    Reserve(key string, e idemEntry) (idemEntry, bool)
+    Set(key string, e idemEntry)
+    Delete(key string)
+}
+
+// fingerprint identifies the ballot a request carries, so that a key reused
+// for a different vote is caught.
+func fingerprint(v models.VoteRequest) string {
+    v.VoteID, v.ReceiptID = "", ""
+    b, _ := json.Marshal(v)
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+// Replayed returns the response already given for key, if the vote it was
+// used for has been accepted within the retention window.
+func (p *Processor) Replayed(key string, v models.VoteRequest) (Accepted, bool, error) {
+    e, ok := p.idem.Get(key)
+    if !ok {
+        return Accepted{}, false, nil
+    }
+    if e.Fingerprint != fingerprint(v) {
+        return Accepted{}, false, errors.New("idempotency key was used for a different vote")
+    }
+    if !e.Done {
+        return Accepted{}, false, errors.New("idempotency key is in use by a request in progress")
+    }
+    return e.Accepted, true, nil
+}
+
+// EnqueueIdempotent queues v at most once per idempotency key. A retry
+// after the first request was accepted gets the same vote ID and receipt
+// back with replayed set. Failed attempts release the key.
+func (p *Processor) EnqueueIdempotent(key string, v models.VoteRequest) (Accepted, bool, error) {
+    fp := fingerprint(v)
+    v.VoteID = newVoteID()
+    acc := Accepted{VoteID: v.VoteID, Receipt: v.ReceiptID}
+    done := idemEntry{Fingerprint: fp, Done: true, Accepted: acc}
+    if prev, handled, err := p.acceptRedis(v, key, done); handled {
+        if err != nil {
+            return Accepted{}, false, err
+        }
+        if prev != nil {
+            return replay(*prev, fp)
+        }
+        return acc, false, nil
+    }
+    if prev, ok := p.idem.Reserve(key, idemEntry{Fingerprint: fp}); !ok {
+        return replay(prev, fp)
+    }
+    if err := p.enqueueSteps(v); err != nil {
+        p.idem.Delete(key)
+        return Accepted{}, false, err
+    }
+    p.idem.Set(key, done)
+    return acc, false, nil
+}
+
+// replay answers a request whose idempotency key is already taken.
+func replay(prev idemEntry, fp string) (Accepted, bool, error) {
+    switch {
+    case prev.Fingerprint != fp:
+        return Accepted{}, false, errors.New("idempotency key was used for a different vote")
+    case !prev.Done:
+        return Accepted{}, false, errors.New("idempotency key is in use by a request in progress")
+    }
+    return prev.Accepted, true, nil
+}
+
+type idemItem struct {
+    e       idemEntry
+    expires time.Time
+}
+
+// memoryIdempotency expires keys after ttl, and drops the oldest once more
+// than max are held.
+type memoryIdempotency struct {
+    mu    sync.Mutex
+    ttl   time.Duration
+    max   int
+    items map[string]idemItem
+    order []string
+    head  int
+}
+
+func newMemoryIdempotency(ttl time.Duration, max int) *memoryIdempotency {
+    return &memoryIdempotency{ttl: ttl, max: max, items: make(map[string]idemItem)}
+}
+
+func (m *memoryIdempotency) Get(key string) (idemEntry, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    it, ok := m.items[key]
+    if !ok || time.Now().After(it.expires) {
+        return idemEntry{}, false
+    }
+    return it.e, true
+}
+
+func (m *memoryIdempotency) Reserve(key string, e idemEntry) (idemEntry, bool) {
+    now := time.Now()
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if it, ok := m.items[key]; ok && now.Before(it.expires) {
+        return it.e, false
+    }
+    m.put(key, e, now)
+    return e, true
+}
+
+func (m *memoryIdempotency) Set(key string, e idemEntry) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.put(key, e, time.Now())
+}
+
+func (m *memoryIdempotency) put(key string, e idemEntry, now time.Time) {
+    ttl := m.ttl
+    if !e.Done {
+        ttl = idemPendingTTL
+    }
+    if _, ok := m.items[key]; !ok {
+        m.order = append(m.order, key)
+    }
+    m.items[key] = idemItem{e: e, expires: now.Add(ttl)}
+    for m.head < len(m.order) {
+        k := m.order[m.head]
+        it, ok := m.items[k]
+        if ok && len(m.items) <= m.max && now.Before(it.expires) {
+            break
+        }
+        if ok {
+            delete(m.items, k)
+        }
+        m.order[m.head] = ""
+        m.head++
+    }
+    if m.head > 1024 && m.head*2 > len(m.order) {
+        m.order = append([]string(nil), m.order[m.head:]...)
+        m.head = 0
+    }
+}
+
+func (m *memoryIdempotency) Delete(key string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.items, key)
+}
+
+// redisIdempotency shares keys between instances, reserving them with
+// SET NX. Like redisStatus it falls back to a local store while Redis is
+// unreachable.
+type redisIdempotency struct {
+    rdb    *redis.Client
+    ctx    context.Context
+    prefix string
+    ttl    time.Duration
+    local  *memoryIdempotency
+    down   func() bool
+}
+
+func (r *redisIdempotency) key(k string) string { return r.prefix + k }
+
+func (r *redisIdempotency) Get(key string) (idemEntry, bool) {
+    if !r.down() {
+        ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+        b, err := r.rdb.Get(ctx, r.key(key)).Bytes()
+        cancel()
+        var e idemEntry
+        if err == nil && json.Unmarshal(b, &e) == nil {
+            return e, true
+        }
+    }
+    return r.local.Get(key)
+}
+
+func (r *redisIdempotency) Reserve(key string, e idemEntry) (idemEntry, bool) {
+    if r.down() {
+        return r.local.Reserve(key, e)
+    }
+    b, err := json.Marshal(e)
+    if err != nil {
+        return r.local.Reserve(key, e)
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    ok, err := r.rdb.SetNX(ctx, r.key(key), b, idemPendingTTL).Result()
+    if err != nil {
+        return r.local.Reserve(key, e)
+    }
+    if ok {
+        return e, true
+    }
+    if prev, found := r.Get(key); found {
+        return prev, false
+    }
+    // The key expired between SET NX and GET; treat it as ours.
+    return e, true
+}
+
+func (r *redisIdempotency) Set(key string, e idemEntry) {
+    if r.down() {
+        r.local.Set(key, e)
+        return
+    }
+    b, err := json.Marshal(e)
+    if err != nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    if r.rdb.Set(ctx, r.key(key), b, r.ttl).Err() != nil {
+        r.local.Set(key, e)
+    }
+}
+
+func (r *redisIdempotency) Delete(key string) {
+    r.local.Delete(key)
+    if r.down() {
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    _ = r.rdb.Del(ctx, r.key(key)).Err()
+}
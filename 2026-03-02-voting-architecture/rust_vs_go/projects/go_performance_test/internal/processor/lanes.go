@@ -0,0 +1,255 @@
+package processor
+
+import (
+    "context"
+    "errors"
+    "hash/fnv"
+    "sync"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/queue"
+)
+
+// Partitioned mode: a dispatcher hashes each vote's PollID onto one of a
+// fixed set of lanes, and each lane has its own small group of workers, so
+// a poll's votes are applied by the same workers (in order, with one worker
+// per lane) instead of every worker contending for every poll. Within a
+// lane, polls are served round-robin, so a hot poll cannot starve the polls
+// that share its lane.
+//
+// Each lane holds at most VOTE_LANE_BUFFER/VOTE_LANES votes. Votes for a
+// full lane are parked behind it, in order, and the dispatcher goes on
+// feeding the other lanes; only when VOTE_LANE_PARKED votes are parked does
+// it stop taking from the queue, leaving the backlog in the transport. A
+// slow poll therefore holds back other lanes only once its backlog exceeds
+// the parking budget.
+//
+// Votes are still applied one at a time. Lanes keep a poll's votes together
+// so they could be applied in batches, but the store has no batch apply, so
+// per-poll batching is not done here.
+
+type lane struct {
+    mu    sync.Mutex
+    cond  *sync.Cond
+    polls map[string][]queue.Delivery
+    ring  []string
+    next  int
+    depth int
+    limit int
+    // parked holds votes that arrived while the lane was full, oldest
+    // first. They move into the lane as it drains.
+    parked []queue.Delivery
+    closed bool
+}
+
+// LaneDepth is the backlog of one lane.
+type LaneDepth struct {
+    Lane   int `json:"lane"`
+    Depth  int `json:"depth"`
+    Polls  int `json:"polls"`
+    Parked int `json:"parked"`
+}
+
+func newLane(limit int) *lane {
+    l := &lane{polls: make(map[string][]queue.Delivery), limit: limit}
+    l.cond = sync.NewCond(&l.mu)
+    return l
+}
+
+// push adds d to the lane, or parks it if the lane is full or already has
+// parked votes, which keeps the lane's order. It reports whether d was
+// parked.
+func (l *lane) push(d queue.Delivery) bool {
+    l.mu.Lock()
+    if l.depth >= l.limit || len(l.parked) > 0 {
+        l.parked = append(l.parked, d)
+        l.mu.Unlock()
+        return true
+    }
+    l.enqueue(d)
+    l.mu.Unlock()
+    l.cond.Signal()
+    return false
+}
+
+// enqueue appends d to its poll's queue. Caller holds l.mu.
+func (l *lane) enqueue(d queue.Delivery) {
+    id := d.Vote.PollID
+    if len(l.polls[id]) == 0 {
+        l.ring = append(l.ring, id)
+    }
+    l.polls[id] = append(l.polls[id], d)
+    l.depth++
+}
+
+// pop takes the next vote from the next poll in turn, and moves the oldest
+// parked vote into the room it leaves; unparked reports whether it did.
+// ok is false once the lane is closed and empty.
+func (l *lane) pop() (d queue.Delivery, unparked, ok bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for len(l.ring) == 0 {
+        if l.closed {
+            return queue.Delivery{}, false, false
+        }
+        l.cond.Wait()
+    }
+    if l.next >= len(l.ring) {
+        l.next = 0
+    }
+    id := l.ring[l.next]
+    fifo := l.polls[id]
+    d = fifo[0]
+    fifo[0] = queue.Delivery{}
+    if len(fifo) == 1 {
+        delete(l.polls, id)
+        l.ring = append(l.ring[:l.next], l.ring[l.next+1:]...)
+    } else {
+        l.polls[id] = fifo[1:]
+        l.next++
+    }
+    l.depth--
+    if len(l.parked) > 0 && l.depth < l.limit {
+        l.enqueue(l.parked[0])
+        l.parked[0] = queue.Delivery{}
+        l.parked = l.parked[1:]
+        unparked = true
+        l.cond.Signal()
+    }
+    return d, unparked, true
+}
+
+func (l *lane) close() {
+    l.mu.Lock()
+    l.closed = true
+    l.mu.Unlock()
+    l.cond.Broadcast()
+}
+
+func (l *lane) stats() (depth, polls, parked int) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.depth, len(l.ring), len(l.parked)
+}
+
+func laneOf(pollID string, n int) int {
+    h := fnv.New32a()
+    h.Write([]byte(pollID))
+    return int(h.Sum32() % uint32(n))
+}
+
+// startLanes starts the dispatchers and per-lane workers in place of the
+// shared worker pool. buffered is split evenly between the lanes.
+func (p *Processor) startLanes(lanes, perLane, dispatchers, buffered, parked int) {
+    p.lanes = make([]*lane, lanes)
+    for i := range p.lanes {
+        p.lanes[i] = newLane(max(1, buffered/lanes))
+    }
+    p.laneParkMax = int64(max(1, parked))
+    p.laneUnparked = make(chan struct{}, 1)
+    p.laneWorkers = lanes * perLane
+
+    var dispatching sync.WaitGroup
+    for i := 0; i < dispatchers; i++ {
+        done := make(chan struct{})
+        p.workerDone = append(p.workerDone, done)
+        dispatching.Add(1)
+        go func() {
+            defer close(done)
+            defer dispatching.Done()
+            p.dispatch()
+        }()
+    }
+    go func() {
+        dispatching.Wait()
+        for _, l := range p.lanes {
+            l.close()
+        }
+    }()
+    for _, l := range p.lanes {
+        for i := 0; i < perLane; i++ {
+            done := make(chan struct{})
+            p.workerDone = append(p.workerDone, done)
+            go p.laneWork(l, done)
+        }
+    }
+}
+
+func (p *Processor) dispatch() {
+    for {
+        for p.laneParked.Load() >= p.laneParkMax {
+            select {
+            case <-p.laneUnparked:
+            case <-p.workCtx.Done():
+                return
+            }
+        }
+        d, err := p.queue.Consume(p.workCtx)
+        if p.workCtx.Err() != nil {
+            if err == nil {
+                p.leave(d)
+            }
+            return
+        }
+        if errors.Is(err, queue.ErrClosed) {
+            return
+        }
+        if err != nil {
+            time.Sleep(100 * time.Millisecond)
+            continue
+        }
+        if p.lanes[laneOf(d.Vote.PollID, len(p.lanes))].push(d) {
+            p.laneParked.Add(1)
+        }
+    }
+}
+
+func (p *Processor) laneWork(l *lane, done chan struct{}) {
+    defer close(done)
+    for {
+        d, unparked, ok := l.pop()
+        if !ok {
+            return
+        }
+        if unparked {
+            p.laneParked.Add(-1)
+            select {
+            case p.laneUnparked <- struct{}{}:
+            default:
+            }
+        }
+        if p.workCtx.Err() != nil {
+            p.leave(d)
+        } else {
+            p.inflight.Add(1)
+            p.handle(d)
+            p.inflight.Add(-1)
+        }
+    }
+}
+
+// LaneDepths reports the backlog of each lane; it is nil unless the
+// processor runs partitioned.
+func (p *Processor) LaneDepths() []LaneDepth {
+    if p.lanes == nil {
+        return nil
+    }
+    out := make([]LaneDepth, len(p.lanes))
+    for i, l := range p.lanes {
+        depth, polls, parked := l.stats()
+        out[i] = LaneDepth{Lane: i, Depth: depth, Polls: polls, Parked: parked}
+    }
+    return out
+}
+
+// QueueDepth is the transport backlog plus what the lanes hold.
+type QueueDepth struct {
+    Transport string      `json:"transport"`
+    Queued    int64       `json:"queued"`
+    Lanes     []LaneDepth `json:"lanes,omitempty"`
+}
+
+func (p *Processor) QueueDepth(ctx context.Context) (QueueDepth, error) {
+    n, err := p.queue.Depth(ctx)
+    return QueueDepth{Transport: p.kind, Queued: n, Lanes: p.LaneDepths()}, err
+}
@@ -0,0 +1,79 @@
+package processor
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/queue"
+)
+
+func vote(poll string, n int) queue.Delivery {
+    return queue.Delivery{ID: fmt.Sprint(poll, n), Vote: models.VoteRequest{PollID: poll, VoterID: fmt.Sprint(n)}}
+}
+
+func TestLaneParksWhenFull(t *testing.T) {
+    l := newLane(2)
+    var parked int
+    for i := 0; i < 5; i++ {
+        if l.push(vote("hot", i)) {
+            parked++
+        }
+    }
+    if depth, _, p := l.stats(); depth != 2 || p != 3 || parked != 3 {
+        t.Fatalf("depth %d, parked %d (%d reported), want 2 and 3", depth, p, parked)
+    }
+    // Once votes are parked, later ones queue behind them even if there
+    // is room, so the lane keeps its order.
+    if _, unparked, _ := l.pop(); !unparked {
+        t.Fatal("pop did not move a parked vote in")
+    }
+    if !l.push(vote("cold", 0)) {
+        t.Fatal("vote jumped ahead of parked ones")
+    }
+
+    var got []string
+    for {
+        if depth, _, _ := l.stats(); depth == 0 {
+            break
+        }
+        d, _, _ := l.pop()
+        got = append(got, d.ID)
+    }
+    // Once cold0 is let in it takes turns with hot.
+    want := []string{"hot1", "hot2", "hot3", "cold0", "hot4"}
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("popped %v, want %v", got, want)
+    }
+}
+
+func TestLaneRoundRobin(t *testing.T) {
+    l := newLane(100)
+    for i := 0; i < 3; i++ {
+        l.push(vote("hot", i))
+    }
+    l.push(vote("cold", 0))
+    var got []string
+    for i := 0; i < 4; i++ {
+        d, _, _ := l.pop()
+        got = append(got, d.ID)
+    }
+    if want := []string{"hot0", "cold0", "hot1", "hot2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("popped %v, want %v", got, want)
+    }
+}
+
+func TestLaneCloseDrainsParked(t *testing.T) {
+    l := newLane(1)
+    l.push(vote("p", 0))
+    l.push(vote("p", 1))
+    l.close()
+    for i := 0; i < 2; i++ {
+        if _, _, ok := l.pop(); !ok {
+            t.Fatalf("pop %d: lane closed with votes left", i)
+        }
+    }
+    if _, _, ok := l.pop(); ok {
+        t.Fatal("pop returned a vote from an empty closed lane")
+    }
+}
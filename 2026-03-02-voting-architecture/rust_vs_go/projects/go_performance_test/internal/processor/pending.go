@@ -0,0 +1,229 @@
+package processor
+
+import (
+    "context"
+    "strconv"
+    "sync"
+
+    redis "github.com/redis/go-redis/v9"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// pendingCounts tracks accepted votes not yet applied, per poll and option,
+// so results can show them next to the confirmed counts. Each vote is
+// counted under its vote ID: Add registers it once and only the first Done
+// for it takes it off, so a vote delivered again (claimed from a dead
+// consumer, requeued from the DLQ or replayed from the spool) is not
+// subtracted twice, and a vote accepted before a restart is not subtracted
+// at all. Encrypted ballots are not counted, since their option is secret.
+type pendingCounts interface {
+    Add(pollID, optionID, voteID string)
+    Done(pollID, optionID, voteID string)
+    Poll(pollID string) map[string]int64
+    Forget(pollID string)
+}
+
+type memoryPending struct {
+    mu    sync.Mutex
+    polls map[string]map[string]int64
+    votes map[string]string // vote ID -> poll ID
+}
+
+func newMemoryPending() *memoryPending {
+    return &memoryPending{polls: make(map[string]map[string]int64), votes: make(map[string]string)}
+}
+
+func (m *memoryPending) Add(pollID, optionID, voteID string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.votes[voteID]; ok {
+        return
+    }
+    m.votes[voteID] = pollID
+    opts := m.polls[pollID]
+    if opts == nil {
+        opts = make(map[string]int64)
+        m.polls[pollID] = opts
+    }
+    opts[optionID]++
+}
+
+func (m *memoryPending) Done(pollID, optionID, voteID string) {
+    m.take(pollID, optionID, voteID)
+}
+
+// take takes voteID off and reports whether it was counted here.
+func (m *memoryPending) take(pollID, optionID, voteID string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.votes[voteID]; !ok {
+        return false
+    }
+    delete(m.votes, voteID)
+    opts := m.polls[pollID]
+    opts[optionID]--
+    if opts[optionID] <= 0 {
+        delete(opts, optionID)
+        if len(opts) == 0 {
+            delete(m.polls, pollID)
+        }
+    }
+    return true
+}
+
+func (m *memoryPending) Forget(pollID string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.polls, pollID)
+    for id, p := range m.votes {
+        if p == pollID {
+            delete(m.votes, id)
+        }
+    }
+}
+
+func (m *memoryPending) Poll(pollID string) map[string]int64 {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := make(map[string]int64, len(m.polls[pollID]))
+    for id, n := range m.polls[pollID] {
+        out[id] = n
+    }
+    return out
+}
+
+// The vote IDs counted in a poll's hash are kept in a set beside it, and
+// the set and the hash change together in one script.
+var (
+    pendingAdd = redis.NewScript(`
+if redis.call('SADD', KEYS[2], ARGV[2]) == 1 then
+    redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+end
+return 0`)
+    pendingDone = redis.NewScript(`
+if redis.call('SREM', KEYS[2], ARGV[2]) == 1 then
+    if redis.call('HINCRBY', KEYS[1], ARGV[1], -1) <= 0 then
+        redis.call('HDEL', KEYS[1], ARGV[1])
+    end
+end
+return 0`)
+)
+
+// redisPending keeps one hash per poll so that a vote accepted on one
+// instance and applied on another is counted once. It falls back to a
+// local count while Redis is unreachable. A vote counted in Redis that
+// finishes during an outage is remembered and taken off once Redis
+// answers again, up to pendingOwedMax of them.
+type redisPending struct {
+    rdb    *redis.Client
+    ctx    context.Context
+    prefix string
+    local  *memoryPending
+    down   func() bool
+
+    mu   sync.Mutex
+    owed []pendingVote
+}
+
+type pendingVote struct{ pollID, optionID, voteID string }
+
+const pendingOwedMax = 100_000
+
+func (r *redisPending) keys(pollID string) []string {
+    return []string{r.prefix + pollID, r.prefix + pollID + ":votes"}
+}
+
+func (r *redisPending) Add(pollID, optionID, voteID string) {
+    if r.down() {
+        r.local.Add(pollID, optionID, voteID)
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    if pendingAdd.Run(ctx, r.rdb, r.keys(pollID), optionID, voteID).Err() != nil {
+        r.local.Add(pollID, optionID, voteID)
+    }
+}
+
+func (r *redisPending) Done(pollID, optionID, voteID string) {
+    if r.local.take(pollID, optionID, voteID) {
+        return
+    }
+    votes := []pendingVote{{pollID, optionID, voteID}}
+    if r.down() {
+        r.owe(votes)
+        return
+    }
+    r.mu.Lock()
+    votes = append(votes, r.owed...)
+    r.owed = nil
+    r.mu.Unlock()
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    for i, v := range votes {
+        if pendingDone.Run(ctx, r.rdb, r.keys(v.pollID), v.optionID, v.voteID).Err() != nil {
+            r.owe(votes[i:])
+            return
+        }
+    }
+}
+
+func (r *redisPending) owe(votes []pendingVote) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.owed = append(r.owed, votes...)
+    if n := len(r.owed) - pendingOwedMax; n > 0 {
+        r.owed = r.owed[n:]
+    }
+}
+
+func (r *redisPending) Forget(pollID string) {
+    r.local.Forget(pollID)
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    _ = r.rdb.Del(ctx, r.keys(pollID)...).Err()
+}
+
+func (r *redisPending) Poll(pollID string) map[string]int64 {
+    out := r.local.Poll(pollID)
+    if r.down() {
+        return out
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    vals, err := r.rdb.HGetAll(ctx, r.prefix+pollID).Result()
+    if err != nil {
+        return out
+    }
+    for id, v := range vals {
+        if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+            out[id] += n
+        }
+    }
+    for id, n := range out {
+        if n <= 0 {
+            delete(out, id)
+        }
+    }
+    return out
+}
+
+// Pending returns the accepted but unapplied votes of a poll by option ID.
+// Options with none are left out.
+func (p *Processor) Pending(pollID string) map[string]int64 {
+    return p.pending.Poll(pollID)
+}
+
+func (p *Processor) countPending(v models.VoteRequest) {
+    if v.OptionID != "" && v.VoteID != "" {
+        p.pending.Add(v.PollID, v.OptionID, v.VoteID)
+    }
+}
+
+// pendingDone takes v off the pending counts, once per vote ID.
+func (p *Processor) pendingDone(v models.VoteRequest) {
+    if v.OptionID != "" && v.VoteID != "" {
+        p.pending.Done(v.PollID, v.OptionID, v.VoteID)
+    }
+}
@@ -0,0 +1,38 @@
+package processor
+
+import "testing"
+
+func TestPendingCountsEachVoteOnce(t *testing.T) {
+    m := newMemoryPending()
+    m.Add("p", "a", "v1")
+    m.Add("p", "a", "v1") // requeued under the same ID
+    m.Add("p", "a", "v2")
+    m.Add("p", "b", "v3")
+    if got := m.Poll("p"); got["a"] != 2 || got["b"] != 1 {
+        t.Fatalf("pending %v, want a=2 b=1", got)
+    }
+
+    // A redelivered vote finishes twice; a vote accepted before a restart
+    // finishes without having been counted.
+    m.Done("p", "a", "v1")
+    m.Done("p", "a", "v1")
+    m.Done("p", "a", "old")
+    if got := m.Poll("p"); got["a"] != 1 || got["b"] != 1 {
+        t.Fatalf("pending %v, want a=1 b=1", got)
+    }
+    m.Done("p", "a", "v2")
+    m.Done("p", "b", "v3")
+    if got := m.Poll("p"); len(got) != 0 {
+        t.Fatalf("pending %v, want none", got)
+    }
+    if len(m.polls) != 0 || len(m.votes) != 0 {
+        t.Fatalf("%d polls, %d votes left", len(m.polls), len(m.votes))
+    }
+
+    // Counting starts again once the vote is done, e.g. when a
+    // dead-lettered vote is requeued.
+    m.Add("p", "a", "v1")
+    if got := m.Poll("p"); got["a"] != 1 {
+        t.Fatalf("pending %v after requeue, want a=1", got)
+    }
+}
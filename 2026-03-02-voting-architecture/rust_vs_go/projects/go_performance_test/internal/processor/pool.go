@@ -0,0 +1,224 @@
+package processor
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/queue"
+)
+
+// The shared worker pool can be resized while running, by an operator
+// (Tune) or by the autoscaler. The autoscaler adds workers while votes
+// back up and ApplyVote stays under the target latency, and removes them
+// when the queue is empty and most workers are idle, or when latency is
+// well over target: more workers then only queue up on the store.
+
+type poolWorker struct {
+    retire chan struct{}
+}
+
+// resize starts or retires workers until n are running. A retired worker
+// is told through its retire channel, which it checks between votes, so it
+// is never cut off inside Consume: canceling a BLPOP can lose a vote Redis
+// has already popped. It exits before taking another vote, or after the
+// one its current Consume returns.
+func (p *Processor) resize(n int) {
+    p.poolMu.Lock()
+    defer p.poolMu.Unlock()
+    if p.poolClosed {
+        return
+    }
+    for len(p.pool) < n {
+        w := poolWorker{retire: make(chan struct{})}
+        p.pool = append(p.pool, w)
+        p.poolWG.Add(1)
+        go p.work(w.retire)
+    }
+    for len(p.pool) > n {
+        last := len(p.pool) - 1
+        close(p.pool[last].retire)
+        p.pool = p.pool[:last]
+    }
+}
+
+func (p *Processor) workers() int {
+    p.poolMu.Lock()
+    defer p.poolMu.Unlock()
+    return len(p.pool)
+}
+
+// closePool stops the autoscaler and freezes the pool for Shutdown.
+func (p *Processor) closePool() {
+    p.poolMu.Lock()
+    closed := p.poolClosed
+    p.poolClosed = true
+    p.poolMu.Unlock()
+    if !closed && p.scaleStop != nil {
+        close(p.scaleStop)
+        <-p.scaleDone
+    }
+}
+
+// observe records how long one vote took to apply.
+func (p *Processor) observe(d time.Duration) {
+    p.applyNanos.Add(int64(d))
+    p.applyCount.Add(1)
+}
+
+func (p *Processor) autoscale(every time.Duration) {
+    defer close(p.scaleDone)
+    t := time.NewTicker(every)
+    defer t.Stop()
+    for {
+        select {
+        case <-p.scaleStop:
+            return
+        case <-t.C:
+        }
+        if n := p.applyCount.Swap(0); n > 0 {
+            p.latency.Store(p.applyNanos.Swap(0) / n)
+        }
+        if !p.autoscaleOn.Load() {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), every)
+        depth, err := p.queue.Depth(ctx)
+        cancel()
+        if err != nil {
+            continue
+        }
+        p.poolMu.Lock()
+        lo, hi := p.minWorkers, p.maxWorkers
+        p.poolMu.Unlock()
+        cur := p.workers()
+        next := scaleStep(cur, depth, p.inflight.Load(), time.Duration(p.latency.Load()), p.targetLatency)
+        if next < lo {
+            next = lo
+        }
+        if next > hi {
+            next = hi
+        }
+        if next != cur {
+            p.resize(next)
+        }
+    }
+}
+
+// scaleStep picks the next pool size from the backlog, the busy workers and
+// the average ApplyVote latency over the last interval.
+func scaleStep(cur int, depth, inflight int64, latency, target time.Duration) int {
+    switch {
+    case latency > 2*target:
+        return cur - max(1, cur/10)
+    case depth > int64(cur) && latency <= target:
+        return cur + max(1, cur/4)
+    case depth == 0 && inflight < int64(cur/2):
+        return cur - max(1, cur/10)
+    }
+    return cur
+}
+
+// Tuning is the processor's runtime configuration and what it is seeing.
+// Batch and QueueLimit are zero when the transport has no such setting.
+// Batch is the file queue's fsync batch; on the Redis transports it is the
+// batch of the local spool used during outages (see queue.Failover), and
+// does not change how votes are taken from Redis.
+type Tuning struct {
+    Workers       int    `json:"workers"`
+    MinWorkers    int    `json:"min_workers"`
+    MaxWorkers    int    `json:"max_workers"`
+    Autoscale     bool   `json:"autoscale"`
+    TargetLatency string `json:"target_latency"`
+    Batch         int    `json:"batch,omitempty"`
+    QueueLimit    int    `json:"queue_limit,omitempty"`
+
+    Queued       int64  `json:"queued"`
+    Inflight     int64  `json:"inflight"`
+    ApplyLatency string `json:"apply_latency"`
+}
+
+// TuningUpdate changes the fields that are set. Workers sets the current
+// pool size; with autoscale on it moves from there within the bounds.
+type TuningUpdate struct {
+    Workers    *int  `json:"workers"`
+    MinWorkers *int  `json:"min_workers"`
+    MaxWorkers *int  `json:"max_workers"`
+    Autoscale  *bool `json:"autoscale"`
+    Batch      *int  `json:"batch"`
+    QueueLimit *int  `json:"queue_limit"`
+}
+
+func (p *Processor) Tuning(ctx context.Context) Tuning {
+    p.poolMu.Lock()
+    t := Tuning{
+        Workers:    len(p.pool),
+        MinWorkers: p.minWorkers,
+        MaxWorkers: p.maxWorkers,
+    }
+    p.poolMu.Unlock()
+    if p.lanes != nil {
+        t.Workers, t.MinWorkers, t.MaxWorkers = p.laneWorkers, p.laneWorkers, p.laneWorkers
+    }
+    t.Autoscale = p.autoscaleOn.Load()
+    t.TargetLatency = p.targetLatency.String()
+    if b, ok := p.queue.(queue.Batcher); ok {
+        t.Batch = b.Batch()
+    }
+    if l, ok := p.queue.(queue.Limiter); ok {
+        t.QueueLimit = l.Limit()
+    }
+    t.Queued, _ = p.queue.Depth(ctx)
+    t.Inflight = p.inflight.Load()
+    t.ApplyLatency = time.Duration(p.latency.Load()).String()
+    return t
+}
+
+// Tune applies u. Nothing is changed if any field is invalid.
+func (p *Processor) Tune(ctx context.Context, u TuningUpdate) (Tuning, error) {
+    if p.lanes != nil && (u.Workers != nil || u.MinWorkers != nil || u.MaxWorkers != nil || u.Autoscale != nil) {
+        return Tuning{}, errors.New("workers are fixed in partitioned mode")
+    }
+    batcher, canBatch := p.queue.(queue.Batcher)
+    if u.Batch != nil && (!canBatch || *u.Batch <= 0) {
+        return Tuning{}, errors.New("invalid batch: must be positive, on a transport that batches")
+    }
+    limiter, canLimit := p.queue.(queue.Limiter)
+    if u.QueueLimit != nil && (!canLimit || *u.QueueLimit <= 0) {
+        return Tuning{}, errors.New("invalid queue_limit: must be positive, on a bounded transport")
+    }
+
+    if p.lanes == nil {
+        p.poolMu.Lock()
+        lo, hi := p.minWorkers, p.maxWorkers
+        if u.MinWorkers != nil {
+            lo = *u.MinWorkers
+        }
+        if u.MaxWorkers != nil {
+            hi = *u.MaxWorkers
+        }
+        n := len(p.pool)
+        if u.Workers != nil {
+            n = *u.Workers
+        } else {
+            n = min(max(n, lo), hi)
+        }
+        if lo <= 0 || hi < lo || n < lo || n > hi {
+            p.poolMu.Unlock()
+            return Tuning{}, errors.New("invalid workers: need 0 < min_workers <= workers <= max_workers")
+        }
+        p.minWorkers, p.maxWorkers = lo, hi
+        p.poolMu.Unlock()
+        p.resize(n)
+    }
+    if u.Autoscale != nil {
+        p.autoscaleOn.Store(*u.Autoscale)
+    }
+    if u.Batch != nil {
+        batcher.SetBatch(*u.Batch)
+    }
+    if u.QueueLimit != nil {
+        limiter.SetLimit(*u.QueueLimit)
+    }
+    return p.Tuning(ctx), nil
+}
@@ -0,0 +1,55 @@
+package processor
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/store"
+)
+
+// Retired workers finish what they take, so shrinking the pool loses no
+// votes, and they do not hold up Shutdown.
+func TestResizeDownKeepsVotes(t *testing.T) {
+    t.Setenv("REDIS_URL", "")
+    t.Setenv("VOTE_QUEUE", "channel")
+    t.Setenv("VOTE_LANES", "")
+    mem := store.New()
+    if err := mem.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    if err := mem.AddOption("p1", "a", "A"); err != nil {
+        t.Fatal(err)
+    }
+    p := New(mem, 100, 8)
+    p.autoscaleOn.Store(false)
+    p.resize(1)
+    if n := p.workers(); n != 1 {
+        t.Fatalf("%d workers, want 1", n)
+    }
+    const votes = 50
+    for i := range votes {
+        if _, err := p.Enqueue(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: fmt.Sprint("v", i)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        snap, _ := mem.GetPollSnapshot("p1")
+        if snap.Options[0].Votes == votes {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d of %d votes applied", snap.Options[0].Votes, votes)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if rep := p.Shutdown(ctx); rep.TimedOut {
+        t.Fatalf("shutdown timed out: %+v", rep)
+    }
+}
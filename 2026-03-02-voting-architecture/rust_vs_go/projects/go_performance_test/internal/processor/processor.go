@@ -2,147 +2,477 @@ package processor
 
 import (
     "context"
-    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
     "os"
     "runtime"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     redis "github.com/redis/go-redis/v9"
 
     "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/queue"
     "github.com/thiagonasc/poll/internal/store"
 )
 
 type Processor struct {
     store      store.Store
-    queue      chan models.VoteRequest
+    queue      queue.Queue
+    kind       string
     workerDone []chan struct{}
+    workCtx    context.Context
+    stopWork   context.CancelFunc
+    handled    atomic.Int64
+    inflight   atomic.Int64
+    leftMu     sync.Mutex
+    left       []models.VoteRequest
+    leftClosed bool
+    lanes      []*lane
+    failover   *queue.Failover
+    status     StatusStore
+    dead       DeadLetters
+    idem       idempotencyStore
+    voters     voterSet
+    pending    pendingCounts
+    retry      retryPolicy
+    waitMu     sync.Mutex
+    waiters    map[string][]chan VoteStatus
 
-    redisEnabled bool
-    rdb          *redis.Client
-    redisQueue   string
-    ctx          context.Context
-    cancel       context.CancelFunc
+    // Worker pool; see pool.go.
+    poolMu        sync.Mutex
+    pool          []poolWorker
+    poolWG        sync.WaitGroup
+    poolClosed    bool
+    minWorkers    int
+    maxWorkers    int
+    laneWorkers   int
+    laneParked    atomic.Int64
+    laneParkMax   int64
+    laneUnparked  chan struct{}
+    autoscaleOn   atomic.Bool
+    targetLatency time.Duration
+    scaleStop     chan struct{}
+    scaleDone     chan struct{}
+    applyNanos    atomic.Int64
+    applyCount    atomic.Int64
+    latency       atomic.Int64
+
+    rdb    *redis.Client
+    ctx    context.Context
+    cancel context.CancelFunc
 }
 
+// Redis returns the client the processor uses, or nil without REDIS_URL.
+func (p *Processor) Redis() *redis.Client { return p.rdb }
+
 func New(s store.Store, buffer int, workers int) *Processor {
     if workers <= 0 {
         workers = runtime.NumCPU() * 32
     }
-    if workers < 128 {
-        workers = 128
-    }
-    if workers > 4096 {
-        workers = 4096
-    }
-    p := &Processor{store: s}
+    p := &Processor{store: s, ctx: context.Background(), waiters: make(map[string][]chan VoteStatus)}
 
     redisURL := strings.TrimSpace(os.Getenv("REDIS_URL"))
     queueName := strings.TrimSpace(os.Getenv("REDIS_QUEUE_NAME"))
     if queueName == "" {
         queueName = "votes"
     }
+    // Every key shares the queue's hash slot, so acceptScript can touch
+    // them together on Redis Cluster. The list is named queueName, which
+    // hashes like the {queueName} tag.
+    keyTag := "{" + queueName + "}"
     if redisURL != "" {
         opt, err := redis.ParseURL(redisURL)
         if err == nil {
-            rdb := redis.NewClient(opt)
-            ctx, cancel := context.WithCancel(context.Background())
-            if _, pingErr := rdb.Ping(ctx).Result(); pingErr == nil {
-                p.redisEnabled = true
-                p.rdb = rdb
-                p.redisQueue = queueName
-                p.ctx = ctx
-                p.cancel = cancel
-            } else {
-                cancel()
-                _ = rdb.Close()
+            // The client is kept even if Redis is down at boot: the queue
+            // spools locally until it comes up (see queue.Failover).
+            p.rdb = redis.NewClient(opt)
+            p.ctx, p.cancel = context.WithCancel(context.Background())
+            pctx, pcancel := context.WithTimeout(p.ctx, 2*time.Second)
+            if err := p.rdb.Ping(pctx).Err(); err != nil {
+                log.Printf("redis unreachable at startup: %v", err)
             }
+            pcancel()
         }
     }
 
-    if p.redisEnabled {
-        p.workerDone = make([]chan struct{}, workers)
-        for i := 0; i < workers; i++ {
-            done := make(chan struct{})
-            p.workerDone[i] = done
-            go func() {
-                defer close(done)
-                for {
-                    vals, err := p.rdb.BLPop(p.ctx, 5*time.Second, p.redisQueue).Result()
-                    if err != nil {
-                        if err == context.Canceled || err == context.DeadlineExceeded {
-                            if p.ctx.Err() != nil {
-                                return
-                            }
-                            continue
-                        }
-                        if p.ctx.Err() != nil {
-                            return
-                        }
-                        continue
-                    }
-                    if len(vals) == 2 {
-                        var v models.VoteRequest
-                        if json.Unmarshal([]byte(vals[1]), &v) == nil {
-                            _ = p.store.ApplyVote(v)
-                        }
-                    }
-                }
-            }()
+    statusTTL := durationEnv("VOTE_STATUS_TTL", 10*time.Minute)
+    statusMax := intEnv("VOTE_STATUS_MAX", 1_000_000)
+    idemTTL := durationEnv("IDEMPOTENCY_TTL", 24*time.Hour)
+    idemMax := intEnv("IDEMPOTENCY_MAX", 1_000_000)
+    if p.rdb != nil {
+        p.status = &redisStatus{
+            rdb:    p.rdb,
+            ctx:    p.ctx,
+            prefix: keyTag + ":status:",
+            ttl:    statusTTL,
+            local:  newMemoryStatus(statusTTL, statusMax),
+            down:   func() bool { return p.failover != nil && p.failover.Degraded() },
+        }
+        p.dead = &redisDeadLetters{rdb: p.rdb, ctx: p.ctx, key: keyTag + ":dead"}
+        p.voters = &redisVoters{
+            rdb:    p.rdb,
+            ctx:    p.ctx,
+            prefix: keyTag + ":voters:",
+            ttl:    durationEnv("VOTE_DEDUPE_TTL", 7*24*time.Hour),
+            local:  newMemoryVoters(),
+            down:   func() bool { return p.failover != nil && p.failover.Degraded() },
+        }
+        p.pending = &redisPending{
+            rdb:    p.rdb,
+            ctx:    p.ctx,
+            prefix: keyTag + ":pending:",
+            local:  newMemoryPending(),
+            down:   func() bool { return p.failover != nil && p.failover.Degraded() },
         }
+        p.idem = &redisIdempotency{
+            rdb:    p.rdb,
+            ctx:    p.ctx,
+            prefix: keyTag + ":idem:",
+            ttl:    idemTTL,
+            local:  newMemoryIdempotency(idemTTL, idemMax),
+            down:   func() bool { return p.failover != nil && p.failover.Degraded() },
+        }
+    } else {
+        p.status = newMemoryStatus(statusTTL, statusMax)
+        p.dead = newMemoryDeadLetters()
+        p.idem = newMemoryIdempotency(idemTTL, idemMax)
+        p.voters = newMemoryVoters()
+        p.pending = newMemoryPending()
+    }
+    switch v := strings.TrimSpace(os.Getenv("VOTE_DEDUPE")); v {
+    case "", "on", "true", "1":
+    case "off", "false", "0":
+        p.voters = nil
+    default:
+        log.Printf("invalid VOTE_DEDUPE=%q, using on", v)
+    }
+    p.retry = retryPolicy{
+        attempts: intEnv("VOTE_RETRY_ATTEMPTS", 5),
+        base:     durationEnv("VOTE_RETRY_BACKOFF", 100*time.Millisecond),
+        max:      durationEnv("VOTE_RETRY_MAX_BACKOFF", 5*time.Second),
+    }
+
+    p.queue, p.kind = p.openQueue(queueName, keyTag, buffer)
+    p.workCtx, p.stopWork = context.WithCancel(context.Background())
+    if lanes := intEnv("VOTE_LANES", 0); lanes > 0 {
+        p.startLanes(lanes, intEnv("VOTE_LANE_WORKERS", 1), intEnv("VOTE_LANE_DISPATCHERS", 1), intEnv("VOTE_LANE_BUFFER", 100_000), intEnv("VOTE_LANE_PARKED", 100_000))
         return p
     }
 
-    p.queue = make(chan models.VoteRequest, buffer)
-    p.workerDone = make([]chan struct{}, workers)
-    for i := 0; i < workers; i++ {
-        done := make(chan struct{})
-        p.workerDone[i] = done
-        go func() {
-            for v := range p.queue {
-                _ = p.store.ApplyVote(v)
-            }
-            close(done)
-        }()
+    p.minWorkers = intEnv("VOTE_WORKERS_MIN", 128)
+    p.maxWorkers = intEnv("VOTE_WORKERS_MAX", 4096)
+    if p.maxWorkers < p.minWorkers {
+        log.Printf("VOTE_WORKERS_MAX=%d is below VOTE_WORKERS_MIN=%d, using %d", p.maxWorkers, p.minWorkers, p.minWorkers)
+        p.maxWorkers = p.minWorkers
+    }
+    p.resize(min(max(workers, p.minWorkers), p.maxWorkers))
+
+    switch v := strings.TrimSpace(os.Getenv("VOTE_AUTOSCALE")); v {
+    case "", "on", "true", "1":
+        p.autoscaleOn.Store(true)
+    case "off", "false", "0":
+    default:
+        log.Printf("invalid VOTE_AUTOSCALE=%q, using on", v)
+        p.autoscaleOn.Store(true)
     }
+    p.targetLatency = durationEnv("VOTE_TARGET_LATENCY", 20*time.Millisecond)
+    p.scaleStop = make(chan struct{})
+    p.scaleDone = make(chan struct{})
+    go p.autoscale(durationEnv("VOTE_AUTOSCALE_INTERVAL", time.Second))
     return p
 }
 
-func (p *Processor) Enqueue(v models.VoteRequest) bool {
-    if p.redisEnabled {
-        b, err := json.Marshal(v)
+// openQueue picks the transport named by VOTE_QUEUE. Left empty, it is the
+// Redis list when REDIS_URL is set and the in-process channel otherwise.
+// Redis transports get a local spool for outages. A transport that cannot
+// be opened falls back to the channel.
+func (p *Processor) openQueue(name, keyTag string, buffer int) (queue.Queue, string) {
+    kind := strings.TrimSpace(os.Getenv("VOTE_QUEUE"))
+    if kind == "" && p.rdb != nil {
+        kind = "redis-list"
+    }
+    switch kind {
+    case "", "channel":
+    case "redis-list", "redis-streams":
+        if p.rdb == nil {
+            log.Printf("VOTE_QUEUE=%s needs REDIS_URL, using channel", kind)
+            break
+        }
+        var q queue.Queue
+        if kind == "redis-list" {
+            q = queue.NewRedisList(p.rdb, name)
+        } else {
+            group := strings.TrimSpace(os.Getenv("REDIS_CONSUMER_GROUP"))
+            if group == "" {
+                group = "poll"
+            }
+            consumer := strings.TrimSpace(os.Getenv("REDIS_CONSUMER_NAME"))
+            if consumer == "" {
+                host, _ := os.Hostname()
+                consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+            }
+            q = queue.NewRedisStreams(p.rdb, keyTag+":stream", group, consumer, durationEnv("REDIS_CLAIM_IDLE", 30*time.Second))
+        }
+        dir := strings.TrimSpace(os.Getenv("VOTE_SPOOL_DIR"))
+        if dir == "" {
+            dir = "data/spool"
+        }
+        spool, err := queue.OpenFile(dir, int64(intEnv("VOTE_QUEUE_SEGMENT_BYTES", 64<<20)), buffer)
         if err != nil {
-            return false
+            log.Printf("spool %s unavailable, Redis outages will reject votes: %v", dir, err)
+            return q, kind
         }
-        if err := p.rdb.RPush(p.ctx, p.redisQueue, b).Err(); err != nil {
-            return false
+        p.failover = queue.NewFailover(q, spool, func(ctx context.Context) error {
+            return p.rdb.Ping(ctx).Err()
+        }, durationEnv("REDIS_HEALTH_INTERVAL", time.Second))
+        return p.failover, kind
+    case "file":
+        dir := strings.TrimSpace(os.Getenv("VOTE_QUEUE_DIR"))
+        if dir == "" {
+            dir = "data/queue"
         }
-        return true
-    }
-    select {
-    case p.queue <- v:
-        return true
+        q, err := queue.OpenFile(dir, int64(intEnv("VOTE_QUEUE_SEGMENT_BYTES", 64<<20)), buffer)
+        if err == nil {
+            return q, kind
+        }
+        log.Printf("file queue %s unavailable, using channel: %v", dir, err)
     default:
-        return false
+        log.Printf("invalid VOTE_QUEUE=%q, using channel", kind)
     }
+    return queue.NewChannel(buffer), "channel"
 }
 
-func (p *Processor) Close() {
-    if p.redisEnabled {
-        if p.cancel != nil {
-            p.cancel()
+// work runs one pool worker until resize retires it or Shutdown cancels
+// workCtx.
+func (p *Processor) work(retire <-chan struct{}) {
+    defer p.poolWG.Done()
+    ctx := p.workCtx
+    for ctx.Err() == nil {
+        select {
+        case <-retire:
+            return
+        default:
+        }
+        d, err := p.queue.Consume(ctx)
+        if p.workCtx.Err() != nil {
+            if err == nil {
+                p.leave(d)
+            }
+            return
         }
-        for _, d := range p.workerDone {
-            <-d
+        if errors.Is(err, queue.ErrClosed) {
+            return
         }
-        if p.rdb != nil {
-            _ = p.rdb.Close()
+        if err != nil {
+            if ctx.Err() == nil {
+                time.Sleep(100 * time.Millisecond)
+            }
+            continue
         }
+        p.inflight.Add(1)
+        p.handle(d)
+        p.inflight.Add(-1)
+    }
+}
+
+func (p *Processor) handle(d queue.Delivery) {
+    if d.Err != nil {
+        if p.deadLetter(nil, string(d.Raw), d.Err, 1) != nil {
+            // Left unacked, so a durable transport delivers it again;
+            // an undecodable message cannot be spilled.
+            return
+        }
+    } else if !p.applyTimed(d.Vote) {
+        p.leave(d)
         return
     }
-    close(p.queue)
-    for _, d := range p.workerDone {
-        <-d
+    if err := p.queue.Ack(context.Background(), d); err != nil {
+        log.Printf("ack vote %s: %v", d.ID, err)
+    }
+    p.handled.Add(1)
+}
+
+// Enqueue assigns the vote an ID and queues it. The ID can be passed to
+// Status to learn the vote's final outcome. A voter who already has a vote
+// accepted in the poll is refused without queueing.
+func (p *Processor) Enqueue(v models.VoteRequest) (string, error) {
+    v.VoteID = newVoteID()
+    if _, handled, err := p.acceptRedis(v, "", idemEntry{}); handled {
+        return v.VoteID, err
+    }
+    return v.VoteID, p.enqueueSteps(v)
+}
+
+// enqueueSteps is Enqueue one store at a time, for when acceptRedis cannot
+// be used.
+func (p *Processor) enqueueSteps(v models.VoteRequest) error {
+    if p.voters != nil && !p.voters.Claim(v.PollID, v.VoterID) {
+        return errors.New("voter has already voted in this poll")
+    }
+    if !p.enqueue(v) {
+        p.releaseVoter(v.PollID, v.VoterID)
+        return errors.New("queue is full")
+    }
+    return nil
+}
+
+// enqueue queues v under its existing vote ID and marks it pending.
+func (p *Processor) enqueue(v models.VoteRequest) bool {
+    p.status.Set(VoteStatus{VoteID: v.VoteID, PollID: v.PollID, VoterID: v.VoterID, Status: StatusPending, UpdatedAt: time.Now().UTC()})
+    // Counted before publishing, so a worker can never apply it first.
+    p.countPending(v)
+    if err := p.queue.Publish(p.ctx, v); err != nil {
+        p.pendingDone(v)
+        p.status.Delete(v.VoteID)
+        return false
+    }
+    return true
+}
+
+func (p *Processor) applyTimed(v models.VoteRequest) bool {
+    start := time.Now()
+    ok := p.apply(p.workCtx, v)
+    p.observe(time.Since(start))
+    return ok
+}
+
+// apply applies v and records its outcome. It returns false if shutdown
+// cut its retries short, or the vote failed and could not be dead
+// lettered; the vote is then neither recorded nor acked.
+func (p *Processor) apply(ctx context.Context, v models.VoteRequest) bool {
+    attempts, exhausted, err := applyWithRetry(ctx, p.store, p.retry, v)
+    if exhausted && ctx.Err() != nil {
+        return false
+    }
+    if exhausted {
+        if p.deadLetter(&v, "", err, attempts) != nil {
+            return false
+        }
+        p.pendingDone(v)
+        return true
+    }
+    p.pendingDone(v)
+    state, msg := outcome(err)
+    if state == StatusClosed || state == StatusFailed {
+        // The vote did not count, so the voter may try again.
+        p.releaseVoter(v.PollID, v.VoterID)
+    }
+    if v.VoteID != "" {
+        p.setStatus(VoteStatus{VoteID: v.VoteID, PollID: v.PollID, VoterID: v.VoterID, Status: state, Error: msg, UpdatedAt: time.Now().UTC()})
+    }
+    return true
+}
+
+// Health describes the vote transport. Degraded is set while Redis is
+// unreachable and votes are being spooled locally.
+type Health struct {
+    Transport string               `json:"transport"`
+    Degraded  bool                 `json:"degraded"`
+    Failover  *queue.FailoverState `json:"failover,omitempty"`
+}
+
+func (p *Processor) Health() Health {
+    h := Health{Transport: p.kind}
+    if p.failover != nil {
+        st := p.failover.State()
+        h.Failover = &st
+        h.Degraded = st.Degraded
+    }
+    return h
+}
+
+// Status returns the recorded outcome of a vote, if it is still retained.
+func (p *Processor) Status(voteID string) (VoteStatus, bool) {
+    return p.status.Get(voteID)
+}
+
+const (
+    VoterNotVoted = "not_voted"
+    VoterPending  = "pending"
+    VoterCounted  = "counted"
+    VoterRejected = "rejected"
+)
+
+// VoterState answers "have I voted?" for one voter, covering votes still in
+// the queue as well as those the store has counted.
+type VoterState struct {
+    PollID  string `json:"poll_id"`
+    VoterID string `json:"voter_id"`
+    State   string `json:"state"`
+    VoteID  string `json:"vote_id,omitempty"`
+    Reason  string `json:"reason,omitempty"`
+}
+
+// VoterStatus combines the store, which is the authority on counted votes,
+// with the outcome of the voter's latest vote through this processor. A
+// dead-lettered vote counts as pending, since it may still be replayed.
+// Statuses expire after VOTE_STATUS_TTL, which a long backlog can outlast;
+// a voter with no status who is still marked by the accept-time dedupe
+// (see voterSet) has a vote in flight and is pending too.
+func (p *Processor) VoterStatus(pollID, voterID string) (VoterState, error) {
+    vs := VoterState{PollID: pollID, VoterID: voterID, State: VoterNotVoted}
+    st, known := p.status.ForVoter(pollID, voterID)
+    if known {
+        vs.VoteID = st.VoteID
+    }
+    voted, err := p.store.HasVoted(pollID, voterID)
+    if err != nil {
+        return VoterState{}, err
+    }
+    if voted {
+        vs.State = VoterCounted
+        return vs, nil
+    }
+    if !known {
+        if p.voters != nil && p.voters.Claimed(pollID, voterID) {
+            vs.State = VoterPending
+        }
+        return vs, nil
+    }
+    switch st.Status {
+    case StatusPending, StatusDeadLettered:
+        vs.State = VoterPending
+    case StatusApplied:
+        vs.State = VoterCounted
+    default:
+        vs.State = VoterRejected
+        vs.Reason = st.Error
+    }
+    return vs, nil
+}
+
+// Close drains the processor with no deadline.
+func (p *Processor) Close() {
+    p.Shutdown(context.Background())
+}
+
+func durationEnv(name string, def time.Duration) time.Duration {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil || d <= 0 {
+        log.Printf("invalid %s=%q, using default %s", name, v, def)
+        return def
+    }
+    return d
+}
+
+func intEnv(name string, def int) int {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 {
+        log.Printf("invalid %s=%q, using default %d", name, v, def)
+        return def
     }
+    return n
 }
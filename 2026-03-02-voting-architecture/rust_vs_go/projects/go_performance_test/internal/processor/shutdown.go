@@ -0,0 +1,189 @@
+package processor
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/queue"
+)
+
+// DrainReport describes what happened to queued votes during Shutdown.
+type DrainReport struct {
+    Transport string `json:"transport"`
+    // Drained votes were applied (or dead-lettered) during shutdown.
+    Drained int64 `json:"drained"`
+    // Persisted votes were left in a durable queue, or written to SpillFile
+    // for `poll replay`, and will still be counted.
+    Persisted int64  `json:"persisted"`
+    SpillFile string `json:"spill_file,omitempty"`
+    // Lost votes were accepted but could not be drained or persisted. It
+    // includes votes behind a worker still inside a store call at the
+    // deadline; if that call returns before the process exits, they are
+    // applied or spilled after all.
+    Lost     int64 `json:"lost"`
+    TimedOut bool  `json:"timed_out"`
+    // Backlog is what a shared Redis queue still holds for every instance,
+    // this one's persisted votes included. It is not counted above.
+    Backlog int64 `json:"backlog,omitempty"`
+}
+
+// durable reports whether the transport keeps an unacked vote for
+// redelivery. The others lose a vote once a worker has taken it.
+func (p *Processor) durable() bool {
+    return p.kind == "file" || p.kind == "redis-streams"
+}
+
+// leave records a vote a worker had taken but did not finish because of
+// shutdown, or that failed and could not be dead lettered. Durable
+// transports redeliver it; the rest are spilled at shutdown. A
+// worker abandoned at the deadline may hand votes back after Shutdown has
+// collected the rest; those are spilled at once.
+func (p *Processor) leave(d queue.Delivery) {
+    if p.durable() || d.Err != nil {
+        return
+    }
+    p.leftMu.Lock()
+    defer p.leftMu.Unlock()
+    if !p.leftClosed {
+        p.left = append(p.left, d.Vote)
+        return
+    }
+    path, _, err := spill([]models.VoteRequest{d.Vote})
+    if err != nil {
+        log.Printf("spill to %s: %v", path, err)
+        return
+    }
+    log.Printf("vote %s was handed back after shutdown; spilled to %s", d.Vote.VoteID, path)
+}
+
+// Shutdown stops accepting votes and lets the workers drain the queue until
+// ctx expires. Local transports are drained; Redis transports leave queued
+// votes in Redis for other instances. Whatever the in-process channel still
+// holds at the deadline is spilled to VOTE_SPILL_FILE. Workers are stopped
+// from taking more votes before the channel is emptied, so only one stuck
+// in a store call can still hand a vote back (see leave).
+func (p *Processor) Shutdown(ctx context.Context) DrainReport {
+    rep := DrainReport{Transport: p.kind}
+    start := p.handled.Load()
+    _ = p.queue.Close()
+    p.closePool()
+
+    all := make(chan struct{})
+    go func() {
+        for _, d := range p.workerDone {
+            <-d
+        }
+        p.poolWG.Wait()
+        close(all)
+    }()
+    select {
+    case <-all:
+    case <-ctx.Done():
+        rep.TimedOut = true
+        p.stopWork()
+        // Give workers a moment to notice; one stuck inside a store call is
+        // abandoned.
+        select {
+        case <-all:
+        case <-time.After(time.Second):
+        }
+    }
+    p.stopWork()
+    rep.Drained = p.handled.Load() - start
+    stuck := p.inflight.Load()
+    for _, l := range p.lanes {
+        depth, _, parked := l.stats()
+        stuck += int64(depth + parked)
+    }
+
+    p.leftMu.Lock()
+    left := p.left
+    p.left = nil
+    p.leftClosed = true
+    p.leftMu.Unlock()
+    if p.kind == "channel" {
+        for {
+            d, err := p.queue.Consume(context.Background())
+            if err != nil {
+                break
+            }
+            left = append(left, d.Vote)
+        }
+    }
+    if !p.durable() {
+        rep.Lost += stuck
+    }
+
+    dctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    // A transport that cannot be reached still reports what it can count,
+    // such as a failover spool. A shared queue's depth is every instance's
+    // backlog, so only what this instance holds counts as its own.
+    if h, ok := p.queue.(queue.Holder); ok {
+        n, err := h.Held(dctx)
+        if err != nil {
+            log.Printf("votes held at shutdown: %v", err)
+        }
+        rep.Persisted += n
+        rep.Backlog, _ = p.queue.Depth(dctx)
+    } else {
+        n, err := p.queue.Depth(dctx)
+        if err != nil {
+            log.Printf("queue depth at shutdown: %v", err)
+        }
+        rep.Persisted += n
+    }
+    cancel()
+    if len(left) > 0 {
+        path, n, err := spill(left)
+        rep.SpillFile = path
+        rep.Persisted += n
+        rep.Lost += int64(len(left)) - n
+        if err != nil {
+            log.Printf("spill to %s: %v", path, err)
+        }
+    }
+
+    if p.rdb != nil {
+        p.cancel()
+        _ = p.rdb.Close()
+    }
+    return rep
+}
+
+// spill appends votes as NDJSON to VOTE_SPILL_FILE and fsyncs it. It
+// returns how many were written.
+func spill(votes []models.VoteRequest) (string, int64, error) {
+    path := strings.TrimSpace(os.Getenv("VOTE_SPILL_FILE"))
+    if path == "" {
+        path = "data/unprocessed-votes.ndjson"
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return path, 0, err
+    }
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return path, 0, err
+    }
+    defer f.Close()
+    w := bufio.NewWriter(f)
+    enc := json.NewEncoder(w)
+    for _, v := range votes {
+        if err := enc.Encode(v); err != nil {
+            return path, 0, err
+        }
+    }
+    if err := w.Flush(); err != nil {
+        return path, 0, err
+    }
+    if err := f.Sync(); err != nil {
+        return path, 0, err
+    }
+    return path, int64(len(votes)), nil
+}
@@ -0,0 +1,89 @@
+package processor
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/store"
+)
+
+// stuckStore blocks ApplyVote until release is closed, then fails it with
+// a transient error.
+type stuckStore struct {
+    store.Store
+    entered chan struct{}
+    release chan struct{}
+}
+
+func (s *stuckStore) ApplyVote(v models.VoteRequest) error {
+    s.entered <- struct{}{}
+    <-s.release
+    return io.ErrUnexpectedEOF
+}
+
+// A worker stuck in a store call past the deadline is reported, and the
+// vote it hands back once the call returns is spilled rather than dropped.
+func TestShutdownSpillsVotesOfAbandonedWorkers(t *testing.T) {
+    spillFile := filepath.Join(t.TempDir(), "spill.ndjson")
+    t.Setenv("VOTE_SPILL_FILE", spillFile)
+    t.Setenv("REDIS_URL", "")
+    t.Setenv("VOTE_QUEUE", "channel")
+    t.Setenv("VOTE_LANES", "")
+    st := &stuckStore{Store: store.New(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+    p := New(st, 10, 1)
+    if _, err := p.Enqueue(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1"}); err != nil {
+        t.Fatal(err)
+    }
+    <-st.entered
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    rep := p.Shutdown(ctx)
+    if !rep.TimedOut || rep.Lost != 1 || rep.Persisted != 0 {
+        t.Fatalf("report %+v, want timed out with the stuck vote lost", rep)
+    }
+
+    close(st.release)
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        if votes := readSpill(t, spillFile); len(votes) == 1 {
+            if votes[0].VoterID != "v1" {
+                t.Fatalf("spilled %+v", votes[0])
+            }
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("vote handed back after shutdown was not spilled")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func readSpill(t *testing.T, path string) []models.VoteRequest {
+    t.Helper()
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    var out []models.VoteRequest
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        var v models.VoteRequest
+        if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+            t.Fatal(err)
+        }
+        out = append(out, v)
+    }
+    return out
+}
@@ -0,0 +1,236 @@
+package processor
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "sync"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+)
+
+const (
+    StatusPending   = "pending"
+    StatusApplied   = "applied"
+    StatusDuplicate = "duplicate"
+    StatusClosed    = "closed"
+    StatusFailed    = "failed"
+    // StatusDeadLettered means retries ran out; see Processor.DeadLetters.
+    StatusDeadLettered = "dead_lettered"
+)
+
+// VoteStatus is the outcome of one accepted vote.
+type VoteStatus struct {
+    VoteID    string    `json:"vote_id"`
+    PollID    string    `json:"poll_id"`
+    // VoterID indexes the status by voter (see StatusStore.ForVoter). It
+    // is not shown with the status.
+    VoterID   string    `json:"-"`
+    Status    string    `json:"status"`
+    Error     string    `json:"error,omitempty"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StatusStore keeps vote outcomes for a bounded retention window. Each
+// outcome is also findable by poll and voter, as the voter's latest vote.
+type StatusStore interface {
+    Set(st VoteStatus)
+    Get(id string) (VoteStatus, bool)
+    ForVoter(pollID, voterID string) (VoteStatus, bool)
+    Delete(id string)
+}
+
+func voterIndex(pollID, voterID string) string { return pollID + "/" + voterID }
+
+func newVoteID() string {
+    var b [16]byte
+    _, _ = rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
+// outcome maps an ApplyVote result onto a vote status.
+func outcome(err error) (string, string) {
+    if err == nil {
+        return StatusApplied, ""
+    }
+    switch err.Error() {
+    case "voter has already voted in this poll":
+        return StatusDuplicate, err.Error()
+    case "poll is closed":
+        return StatusClosed, err.Error()
+    default:
+        return StatusFailed, err.Error()
+    }
+}
+
+type statusEntry struct {
+    st      VoteStatus
+    expires time.Time
+}
+
+// memoryStatus evicts entries older than ttl, and the oldest entries once
+// more than max are held.
+type memoryStatus struct {
+    mu     sync.Mutex
+    ttl    time.Duration
+    max    int
+    items  map[string]statusEntry
+    voters map[string]string
+    order  []string
+    head   int
+}
+
+func newMemoryStatus(ttl time.Duration, max int) *memoryStatus {
+    return &memoryStatus{ttl: ttl, max: max, items: make(map[string]statusEntry), voters: make(map[string]string)}
+}
+
+func (m *memoryStatus) Set(st VoteStatus) {
+    now := time.Now()
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.items[st.VoteID]; !ok {
+        m.order = append(m.order, st.VoteID)
+    }
+    m.items[st.VoteID] = statusEntry{st: st, expires: now.Add(m.ttl)}
+    if st.VoterID != "" {
+        m.voters[voterIndex(st.PollID, st.VoterID)] = st.VoteID
+    }
+    m.prune(now)
+}
+
+func (m *memoryStatus) prune(now time.Time) {
+    for m.head < len(m.order) {
+        id := m.order[m.head]
+        e, ok := m.items[id]
+        if ok && len(m.items) <= m.max && now.Before(e.expires) {
+            break
+        }
+        if ok {
+            m.drop(id, e.st)
+        }
+        m.order[m.head] = ""
+        m.head++
+    }
+    if m.head > 1024 && m.head*2 > len(m.order) {
+        m.order = append([]string(nil), m.order[m.head:]...)
+        m.head = 0
+    }
+}
+
+func (m *memoryStatus) Get(id string) (VoteStatus, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    e, ok := m.items[id]
+    if !ok || time.Now().After(e.expires) {
+        return VoteStatus{}, false
+    }
+    return e.st, true
+}
+
+func (m *memoryStatus) ForVoter(pollID, voterID string) (VoteStatus, bool) {
+    m.mu.Lock()
+    id, ok := m.voters[voterIndex(pollID, voterID)]
+    m.mu.Unlock()
+    if !ok {
+        return VoteStatus{}, false
+    }
+    return m.Get(id)
+}
+
+func (m *memoryStatus) Delete(id string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if e, ok := m.items[id]; ok {
+        m.drop(id, e.st)
+    }
+}
+
+// drop removes a status, and the voter's index entry if it still points
+// at it.
+func (m *memoryStatus) drop(id string, st VoteStatus) {
+    delete(m.items, id)
+    k := voterIndex(st.PollID, st.VoterID)
+    if m.voters[k] == id {
+        delete(m.voters, k)
+    }
+}
+
+// redisStatus shares outcomes between instances; Redis expires the keys.
+// While Redis is unreachable (down reports true, or a call fails) outcomes
+// go to a local store instead, and lookups fall back to it.
+type redisStatus struct {
+    rdb    *redis.Client
+    ctx    context.Context
+    prefix string
+    ttl    time.Duration
+    local  *memoryStatus
+    down   func() bool
+}
+
+const redisStatusTimeout = 500 * time.Millisecond
+
+func (r *redisStatus) key(id string) string { return r.prefix + id }
+
+func (r *redisStatus) Set(st VoteStatus) {
+    if r.down() {
+        r.local.Set(st)
+        return
+    }
+    b, err := json.Marshal(st)
+    if err != nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    pipe := r.rdb.Pipeline()
+    pipe.Set(ctx, r.key(st.VoteID), b, r.ttl)
+    if st.VoterID != "" {
+        pipe.Set(ctx, r.voterKey(st.PollID, st.VoterID), st.VoteID, r.ttl)
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        r.local.Set(st)
+    }
+}
+
+func (r *redisStatus) voterKey(pollID, voterID string) string {
+    return r.prefix + "voter:" + voterIndex(pollID, voterID)
+}
+
+func (r *redisStatus) ForVoter(pollID, voterID string) (VoteStatus, bool) {
+    if !r.down() {
+        ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+        id, err := r.rdb.Get(ctx, r.voterKey(pollID, voterID)).Result()
+        cancel()
+        if err == nil {
+            if st, ok := r.Get(id); ok {
+                return st, true
+            }
+        }
+    }
+    return r.local.ForVoter(pollID, voterID)
+}
+
+func (r *redisStatus) Get(id string) (VoteStatus, bool) {
+    if !r.down() {
+        ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+        b, err := r.rdb.Get(ctx, r.key(id)).Bytes()
+        cancel()
+        var st VoteStatus
+        if err == nil && json.Unmarshal(b, &st) == nil {
+            return st, true
+        }
+    }
+    return r.local.Get(id)
+}
+
+func (r *redisStatus) Delete(id string) {
+    r.local.Delete(id)
+    if r.down() {
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.ctx, redisStatusTimeout)
+    defer cancel()
+    _ = r.rdb.Del(ctx, r.key(id)).Err()
+}
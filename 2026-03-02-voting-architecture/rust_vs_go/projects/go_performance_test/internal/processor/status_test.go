@@ -0,0 +1,57 @@
+package processor
+
+import (
+    "testing"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+    "github.com/thiagonasc/poll/internal/store"
+)
+
+// A vote whose status expires while it waits in the queue still reads as
+// pending, not as never cast.
+func TestVoterStatusOutlivesStatusTTL(t *testing.T) {
+    mem := store.New()
+    if err := mem.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    if err := mem.AddOption("p1", "a", "A"); err != nil {
+        t.Fatal(err)
+    }
+    p := &Processor{store: mem, status: newMemoryStatus(time.Millisecond, 10), voters: newMemoryVoters()}
+    state := func() string {
+        t.Helper()
+        vs, err := p.VoterStatus("p1", "v1")
+        if err != nil {
+            t.Fatal(err)
+        }
+        return vs.State
+    }
+
+    if got := state(); got != VoterNotVoted {
+        t.Fatalf("state %s before voting, want %s", got, VoterNotVoted)
+    }
+    p.voters.Claim("p1", "v1")
+    p.status.Set(VoteStatus{VoteID: "id1", PollID: "p1", VoterID: "v1", Status: StatusPending})
+    time.Sleep(5 * time.Millisecond)
+    if _, ok := p.status.ForVoter("p1", "v1"); ok {
+        t.Fatal("status did not expire")
+    }
+    if got := state(); got != VoterPending {
+        t.Fatalf("state %s with the status expired, want %s", got, VoterPending)
+    }
+
+    if err := mem.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1"}); err != nil {
+        t.Fatal(err)
+    }
+    if got := state(); got != VoterCounted {
+        t.Fatalf("state %s once applied, want %s", got, VoterCounted)
+    }
+
+    // A rejected vote releases the voter.
+    p.voters.Claim("p1", "v2")
+    p.releaseVoter("p1", "v2")
+    if vs, _ := p.VoterStatus("p1", "v2"); vs.State != VoterNotVoted {
+        t.Fatalf("released voter reads %s", vs.State)
+    }
+}
@@ -0,0 +1,73 @@
+package processor
+
+import (
+    "context"
+    "time"
+)
+
+// waitPoll is how often Wait rereads the status store, which catches votes
+// applied by another instance sharing the Redis queue.
+const waitPoll = 100 * time.Millisecond
+
+// setStatus records a final outcome and wakes anyone waiting on it.
+func (p *Processor) setStatus(st VoteStatus) {
+    p.status.Set(st)
+    p.waitMu.Lock()
+    ws := p.waiters[st.VoteID]
+    delete(p.waiters, st.VoteID)
+    p.waitMu.Unlock()
+    for _, w := range ws {
+        w <- st
+    }
+}
+
+// Wait blocks until the vote has an outcome other than pending, and returns
+// false if ctx ends first.
+func (p *Processor) Wait(ctx context.Context, voteID string) (VoteStatus, bool) {
+    ch := make(chan VoteStatus, 1)
+    p.waitMu.Lock()
+    p.waiters[voteID] = append(p.waiters[voteID], ch)
+    p.waitMu.Unlock()
+    defer p.unwait(voteID, ch)
+
+    // Registered first, so an outcome set from here on is either seen by
+    // this read or delivered on ch.
+    if st, ok := p.status.Get(voteID); ok && st.Status != StatusPending {
+        return st, true
+    }
+    var tick <-chan time.Time
+    if p.rdb != nil {
+        t := time.NewTicker(waitPoll)
+        defer t.Stop()
+        tick = t.C
+    }
+    for {
+        select {
+        case st := <-ch:
+            return st, true
+        case <-tick:
+            if st, ok := p.status.Get(voteID); ok && st.Status != StatusPending {
+                return st, true
+            }
+        case <-ctx.Done():
+            return VoteStatus{}, false
+        }
+    }
+}
+
+func (p *Processor) unwait(voteID string, ch chan VoteStatus) {
+    p.waitMu.Lock()
+    defer p.waitMu.Unlock()
+    ws := p.waiters[voteID]
+    for i, w := range ws {
+        if w == ch {
+            ws = append(ws[:i], ws[i+1:]...)
+            break
+        }
+    }
+    if len(ws) == 0 {
+        delete(p.waiters, voteID)
+    } else {
+        p.waiters[voteID] = ws
+    }
+}
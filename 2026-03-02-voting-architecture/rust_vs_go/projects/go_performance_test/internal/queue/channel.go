@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// Channel is an in-process bounded queue. Nothing survives a restart. The
+// bound can be changed while running (see Limiter).
+type Channel struct {
+	mu     sync.Mutex
+	items  []models.VoteRequest
+	limit  int
+	closed bool
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func NewChannel(buffer int) *Channel {
+	return &Channel{
+		limit:  buffer,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *Channel) Publish(ctx context.Context, v models.VoteRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if len(c.items) >= c.limit {
+		return ErrFull
+	}
+	c.items = append(c.items, v)
+	c.wake()
+	return nil
+}
+
+func (c *Channel) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Consume keeps returning queued votes after Close until the buffer is empty.
+func (c *Channel) Consume(ctx context.Context) (Delivery, error) {
+	for {
+		c.mu.Lock()
+		if len(c.items) > 0 {
+			v := c.items[0]
+			c.items[0] = models.VoteRequest{}
+			c.items = c.items[1:]
+			if len(c.items) > 0 {
+				c.wake()
+			}
+			c.mu.Unlock()
+			return Delivery{ID: v.VoteID, Vote: v}, nil
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return Delivery{}, ErrClosed
+		}
+		select {
+		case <-c.notify:
+		case <-c.done:
+		case <-ctx.Done():
+			return Delivery{}, ctx.Err()
+		}
+	}
+}
+
+func (c *Channel) Ack(ctx context.Context, d Delivery) error { return nil }
+
+func (c *Channel) Depth(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(len(c.items)), nil
+}
+
+func (c *Channel) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// SetLimit changes the bound. Votes already queued above a lowered bound
+// stay queued; publishes fail until the backlog drops below it.
+func (c *Channel) SetLimit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = n
+}
+
+func (c *Channel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
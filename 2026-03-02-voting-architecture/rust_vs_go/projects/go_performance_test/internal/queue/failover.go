@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// Failover puts a local spool in front of a Redis transport. While Redis is
+// unreachable, Publish writes votes to the spool (a File queue) instead of
+// failing, and every vote keeps going to the spool until it has been
+// replayed to Redis in order, so votes reach Redis in the order they were
+// accepted. Consume always reads from Redis: spooled votes are applied once
+// Redis is back.
+type Failover struct {
+	primary Queue
+	spool   *File
+	ping    func(context.Context) error
+	every   time.Duration
+
+	// mu is held for reading around each spooled publish and for writing
+	// when switching back to Redis, so no vote can slip past the spool.
+	mu       sync.RWMutex
+	degraded atomic.Bool
+	since    atomic.Int64
+	spooled  atomic.Int64
+	replayed atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewFailover(primary Queue, spool *File, ping func(context.Context) error, every time.Duration) *Failover {
+	f := &Failover{primary: primary, spool: spool, ping: ping, every: every, stop: make(chan struct{}), done: make(chan struct{})}
+	if n, _ := spool.Depth(context.Background()); n > 0 {
+		// Votes spooled before a restart still have to reach Redis first.
+		f.degrade("spool not empty at start")
+	} else if err := f.pingOnce(); err != nil {
+		f.degrade(err.Error())
+	}
+	go f.monitor()
+	return f
+}
+
+// Degraded reports whether votes are currently being spooled.
+func (f *Failover) Degraded() bool { return f.degraded.Load() }
+
+func (f *Failover) pingOnce() error {
+	ctx, cancel := context.WithTimeout(context.Background(), f.every)
+	defer cancel()
+	return f.ping(ctx)
+}
+
+// publishPrimary bounds a Redis publish, so an outage costs a vote one
+// health interval rather than the client's full dial backoff.
+func (f *Failover) publishPrimary(ctx context.Context, v models.VoteRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, f.every)
+	defer cancel()
+	return f.primary.Publish(ctx, v)
+}
+
+func (f *Failover) degrade(reason string) {
+	if f.degraded.CompareAndSwap(false, true) {
+		f.since.Store(time.Now().Unix())
+		log.Printf("vote queue degraded, spooling locally: %s", reason)
+	}
+}
+
+func (f *Failover) Publish(ctx context.Context, v models.VoteRequest) error {
+	if !f.degraded.Load() {
+		err := f.publishPrimary(ctx, v)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		f.degrade(err.Error())
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.degraded.Load() {
+		return f.publishPrimary(ctx, v)
+	}
+	if err := f.spool.Publish(ctx, v); err != nil {
+		return err
+	}
+	f.spooled.Add(1)
+	return nil
+}
+
+// monitor pings Redis, degrades when it stops answering, and replays the
+// spool once it answers again.
+func (f *Failover) monitor() {
+	defer close(f.done)
+	t := time.NewTicker(f.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-t.C:
+		}
+		if err := f.pingOnce(); err != nil {
+			f.degrade(err.Error())
+			continue
+		}
+		if f.degraded.Load() {
+			f.replay()
+		}
+	}
+}
+
+// replay moves spooled votes to Redis oldest first, then switches back. A
+// vote Redis refuses is retried until it goes through, so order is kept.
+func (f *Failover) replay() {
+	for {
+		n, _ := f.spool.Depth(context.Background())
+		if n == 0 {
+			f.mu.Lock()
+			n, _ = f.spool.Depth(context.Background())
+			if n == 0 {
+				f.degraded.Store(false)
+				log.Printf("vote queue recovered; %d spooled votes replayed", f.replayed.Load())
+			}
+			f.mu.Unlock()
+			if n == 0 {
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), f.every)
+		d, err := f.spool.Consume(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+		for {
+			select {
+			case <-f.stop:
+				// Left unacked, so it is replayed again after a restart.
+				return
+			default:
+			}
+			err := f.publishPrimary(context.Background(), d.Vote)
+			if err == nil {
+				break
+			}
+			time.Sleep(f.every)
+		}
+		_ = f.spool.Ack(context.Background(), d)
+		f.replayed.Add(1)
+	}
+}
+
+func (f *Failover) Consume(ctx context.Context) (Delivery, error) {
+	return f.primary.Consume(ctx)
+}
+
+func (f *Failover) Ack(ctx context.Context, d Delivery) error {
+	return f.primary.Ack(ctx, d)
+}
+
+// Depth adds spooled votes to what Redis holds. While Redis is down the
+// error is returned along with the spool depth.
+func (f *Failover) Depth(ctx context.Context) (int64, error) {
+	s, _ := f.spool.Depth(ctx)
+	n, err := f.primary.Depth(ctx)
+	return n + s, err
+}
+
+// Target is the primary's, unless votes are being spooled.
+func (f *Failover) Target() (RedisTarget, bool) {
+	t, ok := f.primary.(Targeted)
+	if !ok || f.degraded.Load() {
+		return RedisTarget{}, false
+	}
+	return t.Target()
+}
+
+// Held adds spooled votes to what this process holds in Redis. While Redis
+// is down the error is returned along with the spool depth.
+func (f *Failover) Held(ctx context.Context) (int64, error) {
+	s, _ := f.spool.Depth(ctx)
+	h, ok := f.primary.(Holder)
+	if !ok {
+		return s, nil
+	}
+	n, err := h.Held(ctx)
+	return n + s, err
+}
+
+// FailoverState is reported by health checks and metrics.
+type FailoverState struct {
+	Degraded      bool       `json:"degraded"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+	Spooled       int64      `json:"spooled"`
+	SpoolDepth    int64      `json:"spool_depth"`
+	Replayed      int64      `json:"replayed"`
+}
+
+func (f *Failover) State() FailoverState {
+	st := FailoverState{
+		Degraded: f.degraded.Load(),
+		Spooled:  f.spooled.Load(),
+		Replayed: f.replayed.Load(),
+	}
+	st.SpoolDepth, _ = f.spool.Depth(context.Background())
+	if st.Degraded {
+		since := time.Unix(f.since.Load(), 0).UTC()
+		st.DegradedSince = &since
+	}
+	return st
+}
+
+// Close stops the monitor. Votes still spooled stay on disk and are
+// replayed by the next process.
+func (f *Failover) Close() error {
+	close(f.stop)
+	<-f.done
+	_ = f.spool.Close()
+	return f.primary.Close()
+}
+
+// Batch and SetBatch tune the spool's group commit.
+func (f *Failover) Batch() int { return f.spool.Batch() }
+
+func (f *Failover) SetBatch(n int) { f.spool.SetBatch(n) }
@@ -0,0 +1,488 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// File is a durable local queue made of segment files. Votes are appended
+// to the active segment by a single writer that fsyncs once per batch
+// (group commit), and Publish returns only after its batch is on disk.
+// Acked sequence numbers go to a sidecar .ack file per segment; they are
+// not fsynced, since losing one only means the vote is redelivered, which
+// stores tolerate. A sealed segment whose votes are all acked is deleted.
+// On open, every vote without an ack is queued again.
+//
+// Votes not yet acked are also held in memory for Consume, so the backlog
+// is bounded like the channel's: Publish fails with ErrFull once limit
+// votes are waiting (see Limiter).
+type File struct {
+	dir          string
+	segmentBytes int64
+
+	limit atomic.Int64
+	// held counts votes not yet acked plus publishes not yet written, so
+	// the limit covers both.
+	held atomic.Int64
+
+	// closeMu guards closed and the send side of reqs. It is separate from
+	// mu so a publisher blocked on a full reqs never holds up the writer.
+	closeMu sync.RWMutex
+	closed  bool
+	reqs    chan fileReq
+	flushed chan struct{}
+
+	batch atomic.Int64
+
+	mu       sync.RWMutex
+	seq      uint64
+	segments []*segment
+	ready    []Delivery
+	unacked  int64
+	notify   chan struct{}
+}
+
+type fileReq struct {
+	ctx  context.Context
+	v    models.VoteRequest
+	raw  []byte
+	done chan error
+}
+
+type fileRecord struct {
+	Seq  uint64          `json:"seq"`
+	Vote json.RawMessage `json:"vote"`
+}
+
+type segment struct {
+	first   uint64
+	data    *os.File
+	acks    *os.File
+	size    int64
+	unacked int
+	sealed  bool
+}
+
+const (
+	segmentExt = ".seg"
+	ackExt     = ".ack"
+	// defaultBatch is also the request buffer, so a larger batch is only
+	// reached when publishers outrun an fsync.
+	defaultBatch = 4096
+)
+
+// OpenFile opens the queue in dir, replaying what it holds. Publish fails
+// once limit votes are waiting; limit <= 0 means no bound. Replayed votes
+// count against the limit but are always kept.
+func OpenFile(dir string, segmentBytes int64, limit int) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := &File{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		reqs:         make(chan fileReq, defaultBatch),
+		flushed:      make(chan struct{}),
+		notify:       make(chan struct{}, 1),
+	}
+	q.batch.Store(defaultBatch)
+	q.limit.Store(int64(limit))
+	if err := q.replay(); err != nil {
+		q.closeSegments()
+		return nil, err
+	}
+	q.held.Store(q.unacked)
+	if err := q.rotate(); err != nil {
+		q.closeSegments()
+		return nil, err
+	}
+	go q.writer()
+	return q, nil
+}
+
+func (q *File) replay() error {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := q.openSegment(first)
+		if err != nil {
+			return err
+		}
+		seg.sealed = true
+		q.segments = append(q.segments, seg)
+		acked := map[uint64]struct{}{}
+		err = readLines(seg.acks, func(line []byte) {
+			if n, err := strconv.ParseUint(string(bytes.TrimSpace(line)), 10, 64); err == nil {
+				acked[n] = struct{}{}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		err = readLines(seg.data, func(line []byte) {
+			seg.size += int64(len(line))
+			var rec fileRecord
+			if json.Unmarshal(line, &rec) != nil {
+				return
+			}
+			if rec.Seq > q.seq {
+				q.seq = rec.Seq
+			}
+			if _, ok := acked[rec.Seq]; ok {
+				return
+			}
+			seg.unacked++
+			q.unacked++
+			q.ready = append(q.ready, decode(strconv.FormatUint(rec.Seq, 10), rec.Vote))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, seg := range append([]*segment(nil), q.segments...) {
+		q.dropIfDone(seg)
+	}
+	return nil
+}
+
+// readLines calls fn for every complete line of f and leaves f positioned
+// at its end. A torn final line from a crash mid-write is cut off: in a
+// segment its Publish never returned, so the vote was never accepted, and
+// a torn ack only causes a redelivery.
+func readLines(f *os.File, fn func(line []byte)) error {
+	r := bufio.NewReader(f)
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err := f.Truncate(off); err != nil {
+					return err
+				}
+			}
+			_, err = f.Seek(off, io.SeekStart)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		off += int64(len(line))
+		fn(line)
+	}
+}
+
+func (q *File) segmentPath(first uint64, ext string) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", first, ext))
+}
+
+func (q *File) openSegment(first uint64) (*segment, error) {
+	data, err := os.OpenFile(q.segmentPath(first, segmentExt), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	acks, err := os.OpenFile(q.segmentPath(first, ackExt), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &segment{first: first, data: data, acks: acks}, nil
+}
+
+// rotate seals the active segment and starts a new one at the next sequence
+// number. Callers hold mu, or run before the writer starts.
+func (q *File) rotate() error {
+	seg, err := q.openSegment(q.seq + 1)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		seg.data.Close()
+		seg.acks.Close()
+		return err
+	}
+	if n := len(q.segments); n > 0 && !q.segments[n-1].sealed {
+		prev := q.segments[n-1]
+		prev.sealed = true
+		defer q.dropIfDone(prev)
+	}
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// dropIfDone deletes a sealed segment once every vote in it is acked.
+func (q *File) dropIfDone(seg *segment) {
+	if !seg.sealed || seg.unacked > 0 {
+		return
+	}
+	seg.data.Close()
+	seg.acks.Close()
+	os.Remove(q.segmentPath(seg.first, segmentExt))
+	os.Remove(q.segmentPath(seg.first, ackExt))
+	for i, s := range q.segments {
+		if s == seg {
+			q.segments = append(q.segments[:i], q.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+func (q *File) active() *segment { return q.segments[len(q.segments)-1] }
+
+// Publish blocks until v has been fsynced as part of a batch. If ctx ends
+// first it returns ctx.Err(), and the writer drops v unless it has already
+// started writing it; a vote caught in that write is kept, as with any
+// write whose acknowledgement is lost.
+func (q *File) Publish(ctx context.Context, v models.VoteRequest) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if limit := q.limit.Load(); q.held.Add(1) > limit && limit > 0 {
+		q.held.Add(-1)
+		return ErrFull
+	}
+	done := make(chan error, 1)
+	q.closeMu.RLock()
+	if q.closed {
+		q.closeMu.RUnlock()
+		q.held.Add(-1)
+		return ErrClosed
+	}
+	select {
+	case q.reqs <- fileReq{ctx: ctx, v: v, raw: raw, done: done}:
+	case <-ctx.Done():
+		q.closeMu.RUnlock()
+		q.held.Add(-1)
+		return ctx.Err()
+	}
+	q.closeMu.RUnlock()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writer is the only goroutine appending to segments. It takes whatever
+// publishes are waiting, writes them, and fsyncs once for all of them.
+func (q *File) writer() {
+	defer close(q.flushed)
+	batch := make([]fileReq, 0, defaultBatch)
+	var buf bytes.Buffer
+	add := func(r fileReq) {
+		// A publisher that gave up gets its answer here; nothing is written.
+		if err := r.ctx.Err(); err != nil {
+			q.held.Add(-1)
+			r.done <- err
+			return
+		}
+		batch = append(batch, r)
+	}
+	for r := range q.reqs {
+		batch = batch[:0]
+		add(r)
+		limit := int(q.batch.Load())
+	collect:
+		for len(batch) < limit {
+			select {
+			case r, ok := <-q.reqs:
+				if !ok {
+					break collect
+				}
+				add(r)
+			default:
+				break collect
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		err := q.flush(batch, &buf)
+		if err != nil {
+			q.held.Add(-int64(len(batch)))
+		}
+		for _, r := range batch {
+			r.done <- err
+		}
+	}
+}
+
+// flush appends a batch to the active segment. Only the writer touches
+// seq, rotation and segment sizes, so mu is held just to publish the
+// result, not across the fsync.
+func (q *File) flush(batch []fileReq, buf *bytes.Buffer) error {
+	q.mu.Lock()
+	if q.active().size >= q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	seg := q.active()
+	q.mu.Unlock()
+
+	buf.Reset()
+	for i, r := range batch {
+		b, err := json.Marshal(fileRecord{Seq: q.seq + uint64(i) + 1, Vote: r.raw})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	_, err := seg.data.WriteAt(buf.Bytes(), seg.size)
+	if err == nil {
+		err = seg.data.Sync()
+	}
+	if err != nil {
+		// Whatever reached the file is cut off again: those publishes fail,
+		// so their votes must not be replayed later.
+		_ = seg.data.Truncate(seg.size)
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seg.size += int64(buf.Len())
+	for _, r := range batch {
+		q.seq++
+		seg.unacked++
+		q.unacked++
+		q.ready = append(q.ready, Delivery{ID: strconv.FormatUint(q.seq, 10), Vote: r.v, Raw: r.raw})
+	}
+	q.wake()
+	return nil
+}
+
+// Batch is the most publishes fsynced together.
+func (q *File) Batch() int { return int(q.batch.Load()) }
+
+func (q *File) SetBatch(n int) { q.batch.Store(int64(n)) }
+
+func (q *File) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Consume keeps returning queued votes after Close until none are left.
+func (q *File) Consume(ctx context.Context) (Delivery, error) {
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			d := q.ready[0]
+			q.ready[0] = Delivery{}
+			q.ready = q.ready[1:]
+			if len(q.ready) > 0 {
+				q.wake()
+			}
+			q.mu.Unlock()
+			return d, nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.flushed:
+			// The writer is gone, so nothing more will become ready.
+			q.mu.Lock()
+			empty := len(q.ready) == 0
+			q.mu.Unlock()
+			if empty {
+				return Delivery{}, ErrClosed
+			}
+		case <-q.notify:
+		case <-ctx.Done():
+			return Delivery{}, ctx.Err()
+		}
+	}
+}
+
+func (q *File) Ack(ctx context.Context, d Delivery) error {
+	seq, err := strconv.ParseUint(d.ID, 10, 64)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i].first > seq }) - 1
+	if i < 0 {
+		return nil
+	}
+	seg := q.segments[i]
+	if seg.unacked == 0 {
+		return nil
+	}
+	seg.unacked--
+	q.unacked--
+	q.held.Add(-1)
+	if seg.sealed && seg.unacked == 0 {
+		q.dropIfDone(seg)
+		return nil
+	}
+	_, err = seg.acks.WriteString(strconv.FormatUint(seq, 10) + "\n")
+	return err
+}
+
+// Limit is the most votes that can wait in the queue.
+func (q *File) Limit() int { return int(q.limit.Load()) }
+
+// SetLimit changes the bound. Votes already queued above a lowered bound
+// stay queued; publishes fail until the backlog drops below it.
+func (q *File) SetLimit(n int) { q.limit.Store(int64(n)) }
+
+// Depth counts votes on disk that have not been acked.
+func (q *File) Depth(ctx context.Context) (int64, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.unacked, nil
+}
+
+// Close stops new publishes. Votes already written can still be consumed
+// and acked; the segment files stay open until the process exits.
+func (q *File) Close() error {
+	q.closeMu.Lock()
+	defer q.closeMu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.reqs)
+	return nil
+}
+
+func (q *File) closeSegments() {
+	for _, seg := range q.segments {
+		seg.data.Close()
+		seg.acks.Close()
+	}
+}
@@ -0,0 +1,306 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// Small segments so a run seals, acks and deletes several of them.
+const testSegmentBytes = 4 << 10
+
+// drain consumes everything the queue holds, without acking.
+func drain(t *testing.T, q *File) []Delivery {
+	t.Helper()
+	var out []Delivery
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		d, err := q.Consume(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, d)
+	}
+}
+
+func publish(t *testing.T, q *File, voters ...string) {
+	t.Helper()
+	for _, v := range voters {
+		if err := q.Publish(context.Background(), models.VoteRequest{PollID: "p", OptionID: "o", VoterID: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileReopenReplaysUnacked(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenFile(dir, testSegmentBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var voters []string
+	for i := 0; i < 200; i++ {
+		voters = append(voters, fmt.Sprint("v", i))
+	}
+	publish(t, q, voters...)
+	for i, d := range drain(t, q) {
+		if i%2 == 0 {
+			if err := q.Ack(context.Background(), d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	q.Close()
+	q.closeSegments()
+
+	q, err = OpenFile(dir, testSegmentBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drain(t, q)
+	if len(got) != 100 {
+		t.Fatalf("replayed %d votes, want 100", len(got))
+	}
+	for i, d := range got {
+		if want := voters[2*i+1]; d.Vote.VoterID != want {
+			t.Fatalf("vote %d is %s, want %s", i, d.Vote.VoterID, want)
+		}
+		if err := q.Ack(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(t, q, "after")
+	if n, _ := q.Depth(context.Background()); n != 1 {
+		t.Fatalf("depth %d after acking the replay, want 1", n)
+	}
+	q.Close()
+	q.closeSegments()
+}
+
+func TestFileTornTail(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenFile(dir, testSegmentBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, q, "a", "b")
+	path := q.segmentPath(q.active().first, segmentExt)
+	q.Close()
+	q.closeSegments()
+
+	// A crash in the middle of a write leaves half a record behind.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"vote":{"poll_id":"p","vot`)
+	f.Close()
+
+	q, err = OpenFile(dir, testSegmentBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, q, "c")
+	var got []string
+	for _, d := range drain(t, q) {
+		if d.Err != nil {
+			t.Fatalf("delivery %s: %v", d.ID, d.Err)
+		}
+		got = append(got, d.Vote.VoterID)
+	}
+	if strings.Join(got, ",") != "a,b,c" {
+		t.Fatalf("got %v, want a, b, c", got)
+	}
+	q.Close()
+	q.closeSegments()
+}
+
+func TestFileLimit(t *testing.T) {
+	q, err := OpenFile(t.TempDir(), testSegmentBytes, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.closeSegments()
+	publish(t, q, "a", "b")
+	if err := q.Publish(context.Background(), models.VoteRequest{VoterID: "c"}); !errors.Is(err, ErrFull) {
+		t.Fatalf("publish over the limit: %v", err)
+	}
+	d, err := q.Consume(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, q, "c")
+	q.SetLimit(0)
+	publish(t, q, "d", "e")
+	q.Close()
+}
+
+func TestFilePublishHonoursContext(t *testing.T) {
+	q, err := OpenFile(t.TempDir(), testSegmentBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.closeSegments()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Publish(ctx, models.VoteRequest{VoterID: "a"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("publish with a cancelled context: %v", err)
+	}
+	publish(t, q, "b")
+	got := drain(t, q)
+	if len(got) != 1 || got[0].Vote.VoterID != "b" {
+		t.Fatalf("got %v, want only b", got)
+	}
+	q.Close()
+}
+
+// TestFileCrashRecovery kills a process that is publishing and acking
+// votes, then reopens its queue. Every vote whose Publish returned must be
+// replayed exactly once unless it was acked, and no acked vote may return.
+func TestFileCrashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a subprocess")
+	}
+	dir := t.TempDir()
+	for round := 0; round < 3; round++ {
+		published, acked := runAndKill(t, dir, round)
+		if len(published) == 0 {
+			t.Fatalf("round %d: child published nothing before it was killed", round)
+		}
+
+		q, err := OpenFile(dir, testSegmentBytes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]int{}
+		for _, d := range drain(t, q) {
+			if d.Err != nil {
+				t.Fatalf("round %d: delivery %s does not decode: %v", round, d.ID, d.Err)
+			}
+			seen[d.Vote.VoterID]++
+		}
+		for v, n := range seen {
+			if n > 1 {
+				t.Fatalf("round %d: %s replayed %d times", round, v, n)
+			}
+			if acked[v] {
+				t.Fatalf("round %d: acked vote %s replayed", round, v)
+			}
+		}
+		lost := 0
+		for v := range published {
+			if !acked[v] && seen[v] == 0 {
+				lost++
+			}
+		}
+		if lost > 0 {
+			t.Fatalf("round %d: %d of %d published votes lost", round, lost, len(published))
+		}
+		t.Logf("round %d: %d published, %d acked, %d replayed", round, len(published), len(acked), len(seen))
+
+		// Leave the replayed votes for the next round's child, which sees
+		// them again and acks some.
+		q.Close()
+		q.closeSegments()
+	}
+}
+
+// runAndKill starts the helper process on dir and SIGKILLs it once it has
+// published a few hundred votes. It returns the votes it reported
+// published and acked.
+func runAndKill(t *testing.T, dir string, round int) (published, acked map[string]bool) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFileCrashHelper$")
+	cmd.Env = append(os.Environ(), "FILE_QUEUE_CRASH_DIR="+dir, fmt.Sprint("FILE_QUEUE_CRASH_ROUND=", round))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	published, acked = map[string]bool{}, map[string]bool{}
+	sc := bufio.NewScanner(out)
+	killed := false
+	for sc.Scan() {
+		verb, voter, _ := strings.Cut(sc.Text(), " ")
+		switch verb {
+		case "published":
+			published[voter] = true
+		case "acked":
+			acked[voter] = true
+		}
+		if !killed && len(published) >= 300 {
+			// Lines already in the pipe are still read after the kill.
+			_ = cmd.Process.Kill()
+			killed = true
+		}
+	}
+	_ = cmd.Wait()
+	if !killed {
+		t.Fatalf("round %d: child exited before it was killed", round)
+	}
+	return published, acked
+}
+
+// TestFileCrashHelper is the process killed by TestFileCrashRecovery. It
+// publishes from several goroutines, consumes and acks every third vote,
+// and reports each Publish and Ack only after it returned.
+func TestFileCrashHelper(t *testing.T) {
+	dir := os.Getenv("FILE_QUEUE_CRASH_DIR")
+	if dir == "" {
+		t.Skip("run by TestFileCrashRecovery")
+	}
+	round := os.Getenv("FILE_QUEUE_CRASH_ROUND")
+	q, err := OpenFile(filepath.Clean(dir), testSegmentBytes, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var mu sync.Mutex
+	report := func(verb, voter string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintln(os.Stdout, verb, voter)
+	}
+	go func() {
+		for n := 0; ; n++ {
+			d, err := q.Consume(context.Background())
+			if err != nil {
+				return
+			}
+			if n%3 == 0 && q.Ack(context.Background(), d) == nil {
+				report("acked", d.Vote.VoterID)
+			}
+		}
+	}()
+	for w := 0; w < 8; w++ {
+		go func() {
+			for i := 0; ; i++ {
+				v := fmt.Sprintf("r%s-w%d-%d", round, w, i)
+				if q.Publish(context.Background(), models.VoteRequest{PollID: "p", OptionID: "o", VoterID: v}) == nil {
+					report("published", v)
+				}
+			}
+		}()
+	}
+	select {}
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// ReadJournal calls fn for every vote in the segments of a File queue
+// directory, oldest first, acked or not. Segments whose votes were all acked
+// have been deleted, so this is the backlog plus the acked votes that share
+// a segment with it, not the full history. It only reads: the queue must
+// not be open in another process if the result is to be complete. A line
+// that does not decode, such as a torn tail, is passed on with Err set.
+func ReadJournal(dir string, fn func(Delivery) error) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := readSegment(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(name string, fn func(Delivery) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var rec fileRecord
+		d := Delivery{Raw: append([]byte(nil), sc.Bytes()...)}
+		if d.Err = json.Unmarshal(d.Raw, &rec); d.Err == nil {
+			d = decode(strconv.FormatUint(rec.Seq, 10), rec.Vote)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// ReadStream calls fn for every vote still in a Redis stream, oldest
+// first, without touching consumer groups. Acked votes have been deleted
+// from the stream and are not seen.
+func ReadStream(ctx context.Context, rdb *redis.Client, stream string, fn func(Delivery) error) error {
+	start := "-"
+	for {
+		msgs, err := rdb.XRangeN(ctx, stream, start, "+", 1000).Result()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			raw, _ := msg.Values[streamField].(string)
+			if err := fn(decode(msg.ID, []byte(raw))); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < 1000 {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+var (
+	// ErrClosed is returned by Consume once the queue is closed and, for
+	// local transports, drained.
+	ErrClosed = errors.New("queue is closed")
+	// ErrFull is returned by Publish when a bounded queue has no room.
+	ErrFull = errors.New("queue is full")
+)
+
+// Delivery is one vote handed to a consumer. If the payload did not decode,
+// Err is set and Raw holds the payload so it can be dead-lettered; the
+// delivery must still be acked.
+type Delivery struct {
+	ID   string
+	Vote models.VoteRequest
+	Raw  []byte
+	Err  error
+}
+
+// Queue carries accepted votes from the API to the processor's workers.
+// Consume blocks until a vote is available. Transports that can redeliver
+// keep a delivery until it is acked.
+type Queue interface {
+	Publish(ctx context.Context, v models.VoteRequest) error
+	Consume(ctx context.Context) (Delivery, error)
+	Ack(ctx context.Context, d Delivery) error
+	Depth(ctx context.Context) (int64, error)
+	Close() error
+}
+
+// Limiter is implemented by transports with a bounded backlog whose bound
+// can change at runtime.
+type Limiter interface {
+	Limit() int
+	SetLimit(n int)
+}
+
+// Holder is implemented by transports shared between instances, whose
+// Depth is every instance's backlog. Held counts only the votes this
+// process answers for: spooled locally, or taken and not yet acked.
+type Holder interface {
+	Held(ctx context.Context) (int64, error)
+}
+
+// RedisTarget says where a Redis transport keeps votes, so a caller can
+// append one from its own Lua script in the same round trip as its other
+// writes: RPUSH to Key for a list, or XADD to Key under Field for a
+// stream. The payload is the vote's JSON encoding.
+type RedisTarget struct {
+	Key   string
+	Field string
+}
+
+// Targeted is implemented by Redis transports. ok is false while votes
+// must not go straight to Redis, such as while a Failover is spooling.
+type Targeted interface {
+	Target() (t RedisTarget, ok bool)
+}
+
+// Batcher is implemented by transports that write publishes in batches
+// whose maximum size can change at runtime.
+type Batcher interface {
+	Batch() int
+	SetBatch(n int)
+}
+
+func decode(id string, raw []byte) Delivery {
+	d := Delivery{ID: id, Raw: raw}
+	d.Err = json.Unmarshal(raw, &d.Vote)
+	return d
+}
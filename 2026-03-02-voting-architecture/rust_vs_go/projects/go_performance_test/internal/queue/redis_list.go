@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// RedisList pushes votes with RPUSH and pops them with BLPOP. A popped
+// vote is gone from Redis, so one in flight during a crash is lost; use
+// RedisStreams where that matters.
+type RedisList struct {
+	rdb    *redis.Client
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRedisList(rdb *redis.Client, key string) *RedisList {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisList{rdb: rdb, key: key, ctx: ctx, cancel: cancel}
+}
+
+func (q *RedisList) Publish(ctx context.Context, v models.VoteRequest) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return q.rdb.RPush(ctx, q.key, b).Err()
+}
+
+// Consume returns ErrClosed as soon as the queue is closed; votes still in
+// Redis are left for the next consumer.
+func (q *RedisList) Consume(ctx context.Context) (Delivery, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer context.AfterFunc(q.ctx, stop)()
+	for {
+		vals, err := q.rdb.BLPop(ctx, 5*time.Second, q.key).Result()
+		if q.ctx.Err() != nil {
+			return Delivery{}, ErrClosed
+		}
+		if ctx.Err() != nil {
+			return Delivery{}, ctx.Err()
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return Delivery{}, err
+		}
+		if len(vals) == 2 {
+			return decode("", []byte(vals[1])), nil
+		}
+	}
+}
+
+func (q *RedisList) Ack(ctx context.Context, d Delivery) error { return nil }
+
+func (q *RedisList) Depth(ctx context.Context) (int64, error) {
+	return q.rdb.LLen(ctx, q.key).Result()
+}
+
+func (q *RedisList) Target() (RedisTarget, bool) { return RedisTarget{Key: q.key}, true }
+
+// Held is zero: a popped vote leaves Redis at once, and one this process
+// does not finish is its to persist.
+func (q *RedisList) Held(ctx context.Context) (int64, error) { return 0, nil }
+
+func (q *RedisList) Close() error {
+	q.cancel()
+	return nil
+}
@@ -0,0 +1,212 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+
+	"github.com/thiagonasc/poll/internal/models"
+)
+
+// RedisStreams appends votes with XADD and reads them through a consumer
+// group, so a vote stays pending in Redis until it is acked. Votes left
+// pending by a consumer that died are taken over with XAUTOCLAIM once they
+// have been idle for claimIdle. Redelivery is safe because stores skip vote
+// IDs they already applied.
+type RedisStreams struct {
+	rdb       *redis.Client
+	stream    string
+	group     string
+	consumer  string
+	claimIdle time.Duration
+	claimed   chan redis.XMessage
+	ready     atomic.Bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+const streamField = "vote"
+
+// NewRedisStreams creates the consumer group if needed. If Redis is down,
+// that is retried by Consume, so the queue can be opened during an outage.
+func NewRedisStreams(rdb *redis.Client, stream, group, consumer string, claimIdle time.Duration) *RedisStreams {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &RedisStreams{
+		rdb:       rdb,
+		stream:    stream,
+		group:     group,
+		consumer:  consumer,
+		claimIdle: claimIdle,
+		claimed:   make(chan redis.XMessage, 100),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	_ = q.ensureGroup(ctx)
+	go q.claimLoop()
+	return q
+}
+
+func (q *RedisStreams) ensureGroup(ctx context.Context) error {
+	if q.ready.Load() {
+		return nil
+	}
+	err := q.rdb.XGroupCreateMkStream(ctx, q.stream, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	q.ready.Store(true)
+	return nil
+}
+
+func (q *RedisStreams) Publish(ctx context.Context, v models.VoteRequest) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return q.rdb.XAdd(ctx, &redis.XAddArgs{Stream: q.stream, Values: map[string]any{streamField: b}}).Err()
+}
+
+// Consume prefers reclaimed messages, then new ones for the group. It
+// returns ErrClosed as soon as the queue is closed; unacked votes stay
+// pending for another consumer.
+func (q *RedisStreams) Consume(ctx context.Context) (Delivery, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer context.AfterFunc(q.ctx, stop)()
+	for {
+		select {
+		case msg := <-q.claimed:
+			return q.delivery(msg), nil
+		default:
+		}
+		if err := q.ensureGroup(ctx); err != nil {
+			if q.ctx.Err() != nil {
+				return Delivery{}, ErrClosed
+			}
+			return Delivery{}, err
+		}
+		res, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    q.group,
+			Consumer: q.consumer,
+			Streams:  []string{q.stream, ">"},
+			Count:    1,
+			Block:    2 * time.Second,
+		}).Result()
+		if q.ctx.Err() != nil {
+			return Delivery{}, ErrClosed
+		}
+		if ctx.Err() != nil {
+			return Delivery{}, ctx.Err()
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return Delivery{}, err
+		}
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				return q.delivery(msg), nil
+			}
+		}
+	}
+}
+
+func (q *RedisStreams) delivery(msg redis.XMessage) Delivery {
+	raw, _ := msg.Values[streamField].(string)
+	return decode(msg.ID, []byte(raw))
+}
+
+// Ack acknowledges and deletes a handled message. It goes through even
+// while closing, or the vote would be delivered again.
+func (q *RedisStreams) Ack(ctx context.Context, d Delivery) error {
+	ctx = context.WithoutCancel(ctx)
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, q.stream, q.group, d.ID)
+		pipe.XDel(ctx, q.stream, d.ID)
+		return nil
+	})
+	return err
+}
+
+// Depth counts votes not yet acked, read or not.
+func (q *RedisStreams) Depth(ctx context.Context) (int64, error) {
+	return q.rdb.XLen(ctx, q.stream).Result()
+}
+
+func (q *RedisStreams) Target() (RedisTarget, bool) {
+	return RedisTarget{Key: q.stream, Field: streamField}, true
+}
+
+// Held counts the votes delivered to this consumer and not acked. They
+// stay pending in the group until another consumer claims them.
+func (q *RedisStreams) Held(ctx context.Context) (int64, error) {
+	p, err := q.rdb.XPending(ctx, q.stream, q.group).Result()
+	if err != nil {
+		return 0, err
+	}
+	return p.Consumers[q.consumer], nil
+}
+
+func (q *RedisStreams) Close() error {
+	q.cancel()
+	<-q.done
+	return nil
+}
+
+func (q *RedisStreams) claimLoop() {
+	defer close(q.done)
+	t := time.NewTicker(q.claimIdle / 2)
+	defer t.Stop()
+	for {
+		q.claimStale()
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// claimStale takes over messages other consumers left pending too long.
+func (q *RedisStreams) claimStale() {
+	if !q.ready.Load() {
+		return
+	}
+	start := "0-0"
+	for q.ctx.Err() == nil {
+		msgs, next, err := q.rdb.XAutoClaim(q.ctx, &redis.XAutoClaimArgs{
+			Stream:   q.stream,
+			Group:    q.group,
+			Consumer: q.consumer,
+			MinIdle:  q.claimIdle,
+			Start:    start,
+			Count:    int64(cap(q.claimed)),
+		}).Result()
+		if err != nil {
+			if q.ctx.Err() == nil {
+				log.Printf("xautoclaim %s: %v", q.stream, err)
+			}
+			return
+		}
+		for _, msg := range msgs {
+			select {
+			case q.claimed <- msg:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
@@ -0,0 +1,206 @@
+package rla
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/thiagonasc/poll/internal/ledger"
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+// Ballot-polling audit using the BRAVO sequential test (Lindeman, Stark and
+// Yates, 2012). Ballots are drawn with replacement from the stored ballots;
+// draw i picks sha256("<seed>,<i>") mod N, so anyone with the seed and the
+// ballot list can reproduce the sample.
+
+const (
+	StatusInProgress = "in_progress"
+	StatusConfirmed  = "confirmed"
+	StatusEscalate   = "full_recount"
+)
+
+type Sample struct {
+	Draw     int                `json:"draw"`
+	Index    int                `json:"index"`
+	Receipt  string             `json:"receipt"`
+	OptionID string             `json:"option_id"`
+	T        map[string]float64 `json:"t"`
+}
+
+type State struct {
+	PollID     string             `json:"poll_id"`
+	RiskLimit  float64            `json:"risk_limit"`
+	Seed       string             `json:"seed"`
+	MaxSamples int                `json:"max_samples"`
+	Ballots    int                `json:"ballots"`
+	Root       string             `json:"root"`
+	Reported   map[string]int     `json:"reported"`
+	Winner     string             `json:"winner"`
+	T          map[string]float64 `json:"t"`
+	Samples    []Sample           `json:"samples"`
+	Status     string             `json:"status"`
+	Reason     string             `json:"reason,omitempty"`
+}
+
+// Audit couples persisted state with the ballots it samples from.
+type Audit struct {
+	State   State
+	ballots []models.Ballot
+}
+
+// Start begins a new audit of pollID against the reported counts in s.
+func Start(s store.Store, pollID string, riskLimit float64, seed string, maxSamples int) (*Audit, error) {
+	if riskLimit <= 0 || riskLimit >= 1 {
+		return nil, errors.New("risk limit must be between 0 and 1")
+	}
+	if seed == "" {
+		return nil, errors.New("seed is required")
+	}
+	snap, ok := s.GetPollSnapshot(pollID)
+	if !ok {
+		return nil, errors.New("poll not found")
+	}
+	if _, enc := s.GetEncryptedPoll(pollID); enc {
+		return nil, errors.New("encrypted ballots cannot be sampled")
+	}
+	ballots, err := s.ListBallots(pollID)
+	if err != nil {
+		return nil, err
+	}
+	if maxSamples <= 0 || maxSamples > len(ballots) {
+		maxSamples = len(ballots)
+	}
+	st := State{
+		PollID:     pollID,
+		RiskLimit:  riskLimit,
+		Seed:       seed,
+		MaxSamples: maxSamples,
+		Ballots:    len(ballots),
+		Root:       ledger.RootOf(ballots).String(),
+		Reported:   map[string]int{},
+		T:          map[string]float64{},
+		Samples:    []Sample{},
+		Status:     StatusInProgress,
+	}
+	opts := append([]models.OptionItem(nil), snap.Options...)
+	sort.Slice(opts, func(i, j int) bool {
+		if opts[i].Votes == opts[j].Votes {
+			return opts[i].ID < opts[j].ID
+		}
+		return opts[i].Votes > opts[j].Votes
+	})
+	for _, o := range opts {
+		st.Reported[o.ID] = o.Votes
+	}
+	a := &Audit{State: st, ballots: ballots}
+	switch {
+	case len(opts) < 2 || len(ballots) == 0:
+		a.finish(StatusEscalate, "nothing to audit: fewer than two options or no ballots")
+	case opts[0].Votes == opts[1].Votes:
+		a.finish(StatusEscalate, "reported result is a tie")
+	default:
+		a.State.Winner = opts[0].ID
+		for _, o := range opts[1:] {
+			a.State.T[o.ID] = 1
+		}
+	}
+	return a, nil
+}
+
+// Resume reloads an audit and checks that the stored ballots have not
+// changed since it started.
+func Resume(s store.Store, st State) (*Audit, error) {
+	ballots, err := s.ListBallots(st.PollID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ballots) != st.Ballots || ledger.RootOf(ballots).String() != st.Root {
+		return nil, errors.New("stored ballots changed since the audit started")
+	}
+	return &Audit{State: st, ballots: ballots}, nil
+}
+
+func (a *Audit) Done() bool { return a.State.Status != StatusInProgress }
+
+// Step draws one ballot and updates the test statistic for every loser.
+func (a *Audit) Step() (Sample, error) {
+	if a.Done() {
+		return Sample{}, errors.New("audit is finished")
+	}
+	st := &a.State
+	draw := len(st.Samples) + 1
+	idx := drawIndex(st.Seed, draw, len(a.ballots))
+	b := a.ballots[idx]
+	pw := float64(st.Reported[st.Winner])
+	for loser, t := range st.T {
+		pl := float64(st.Reported[loser])
+		share := pw / (pw + pl)
+		switch b.OptionID {
+		case st.Winner:
+			t *= share / 0.5
+		case loser:
+			t *= (1 - share) / 0.5
+		}
+		st.T[loser] = t
+	}
+	smp := Sample{Draw: draw, Index: idx, Receipt: b.Receipt, OptionID: b.OptionID, T: map[string]float64{}}
+	for k, v := range st.T {
+		smp.T[k] = v
+	}
+	st.Samples = append(st.Samples, smp)
+
+	confirmed := true
+	for _, t := range st.T {
+		if t < 1/st.RiskLimit {
+			confirmed = false
+			break
+		}
+	}
+	if confirmed {
+		a.finish(StatusConfirmed, fmt.Sprintf("every margin met 1/alpha=%g after %d draws", 1/st.RiskLimit, draw))
+	} else if draw >= st.MaxSamples {
+		a.finish(StatusEscalate, fmt.Sprintf("risk limit not met after %d draws", draw))
+	}
+	return smp, nil
+}
+
+func (a *Audit) finish(status, reason string) {
+	a.State.Status = status
+	a.State.Reason = reason
+}
+
+func drawIndex(seed string, draw, n int) int {
+	sum := sha256.Sum256([]byte(seed + "," + strconv.Itoa(draw)))
+	v := new(big.Int).SetBytes(sum[:])
+	return int(v.Mod(v, big.NewInt(int64(n))).Int64())
+}
+
+func Load(path string) (State, error) {
+	var st State
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+// Save writes the state atomically so an interrupted run can resume.
+func Save(path string, st State) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
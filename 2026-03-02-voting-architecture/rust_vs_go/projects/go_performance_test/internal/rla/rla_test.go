@@ -0,0 +1,233 @@
+package rla
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/thiagonasc/poll/internal/models"
+	"github.com/thiagonasc/poll/internal/store"
+)
+
+// poll stores an open poll with the given votes per option.
+func poll(t *testing.T, votes map[string]int) *store.MemoryStore {
+	t.Helper()
+	s := store.New()
+	if err := s.CreatePoll("p1", "q?", true); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, o := range []string{"a", "b", "c"} {
+		if _, ok := votes[o]; !ok {
+			continue
+		}
+		if err := s.AddOption("p1", o, o); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < votes[o]; i++ {
+			if err := s.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: o, VoterID: fmt.Sprint("v", n)}); err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+	return s
+}
+
+func run(t *testing.T, a *Audit) {
+	t.Helper()
+	for !a.Done() {
+		if _, err := a.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The draws are part of the audit's public record, so their derivation
+// must not change.
+func TestDrawIndexKnownAnswer(t *testing.T) {
+	for draw, want := range map[int]int{1: 70, 2: 40, 3: 26} {
+		if got := drawIndex("audit-2026", draw, 100); got != want {
+			t.Fatalf("draw %d = %d, want %d", draw, got, want)
+		}
+	}
+}
+
+// BRAVO multiplies T by 2s for a ballot for the winner and by 2(1-s) for
+// one for the loser, where s is the winner's reported share of the pair.
+func TestBravoStatistic(t *testing.T) {
+	s := poll(t, map[string]int{"a": 70, "b": 30})
+	a, err := Start(s, "p1", 0.05, "audit-2026", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.State.Winner != "a" || a.State.Reported["b"] != 30 {
+		t.Fatalf("winner %s, reported %v", a.State.Winner, a.State.Reported)
+	}
+	run(t, a)
+	if a.State.Status != StatusConfirmed {
+		t.Fatalf("status %s (%s), want confirmed", a.State.Status, a.State.Reason)
+	}
+	want := 1.0
+	for _, smp := range a.State.Samples {
+		switch smp.OptionID {
+		case "a":
+			want *= 2 * 0.7
+		case "b":
+			want *= 2 * 0.3
+		}
+		if math.Abs(smp.T["b"]-want) > 1e-9*want {
+			t.Fatalf("draw %d: T = %g, want %g", smp.Draw, smp.T["b"], want)
+		}
+	}
+	if want < 20 {
+		t.Fatalf("confirmed with T = %g below 1/alpha", want)
+	}
+	// The audit stops at the first draw that meets the risk limit.
+	if n := len(a.State.Samples); n > 1 && a.State.Samples[n-2].T["b"] >= 20 {
+		t.Fatal("audit kept drawing after the risk limit was met")
+	}
+	if _, err := a.Step(); err == nil {
+		t.Fatal("stepped a finished audit")
+	}
+}
+
+// Every loser must be beaten: a close second candidate keeps the audit
+// going after a distant third is confirmed.
+func TestBravoEveryLoser(t *testing.T) {
+	s := poll(t, map[string]int{"a": 50, "b": 45, "c": 5})
+	a, err := Start(s, "p1", 0.1, "audit-2026", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, a)
+	if len(a.State.T) != 2 {
+		t.Fatalf("tracked losers %v, want b and c", a.State.T)
+	}
+	kept := false
+	for _, smp := range a.State.Samples[:len(a.State.Samples)-1] {
+		if smp.T["c"] >= 10 && smp.T["b"] < 10 {
+			kept = true
+		}
+	}
+	if !kept {
+		t.Fatal("no draw had c met and b still open; pick another seed")
+	}
+	if a.State.Status == StatusConfirmed && a.State.T["b"] < 10 {
+		t.Fatalf("confirmed with T[b] = %g", a.State.T["b"])
+	}
+}
+
+// misreported swaps the reported counts of a and b, so the stored ballots
+// contradict the reported winner.
+type misreported struct{ *store.MemoryStore }
+
+func (m misreported) GetPollSnapshot(id string) (store.PollSnapshot, bool) {
+	snap, ok := m.MemoryStore.GetPollSnapshot(id)
+	opts := append([]models.OptionItem(nil), snap.Options...)
+	for i := range opts {
+		switch opts[i].ID {
+		case "a":
+			opts[i].Votes = 70
+		case "b":
+			opts[i].Votes = 30
+		}
+	}
+	snap.Options = opts
+	return snap, ok
+}
+
+func TestWrongOutcomeEscalates(t *testing.T) {
+	s := poll(t, map[string]int{"a": 30, "b": 70})
+	a, err := Start(misreported{s}, "p1", 0.05, "audit-2026", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.State.Winner != "a" {
+		t.Fatalf("winner %s, want the misreported a", a.State.Winner)
+	}
+	run(t, a)
+	if a.State.Status != StatusEscalate || len(a.State.Samples) != 60 {
+		t.Fatalf("status %s after %d draws, want a full recount after 60", a.State.Status, len(a.State.Samples))
+	}
+}
+
+func TestStartEscalates(t *testing.T) {
+	for name, votes := range map[string]map[string]int{
+		"tie":        {"a": 10, "b": 10},
+		"one option": {"a": 10},
+		"no ballots": {"a": 0, "b": 0},
+	} {
+		a, err := Start(poll(t, votes), "p1", 0.05, "seed", 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if a.State.Status != StatusEscalate {
+			t.Fatalf("%s: status %s, want a full recount", name, a.State.Status)
+		}
+	}
+	s := poll(t, map[string]int{"a": 2, "b": 1})
+	for _, alpha := range []float64{0, 1, -0.5} {
+		if _, err := Start(s, "p1", alpha, "seed", 0); err == nil {
+			t.Fatalf("started with risk limit %g", alpha)
+		}
+	}
+	if _, err := Start(s, "p1", 0.05, "", 0); err == nil {
+		t.Fatal("started without a seed")
+	}
+	if _, err := Start(s, "nope", 0.05, "seed", 0); err == nil {
+		t.Fatal("started on a missing poll")
+	}
+}
+
+// An audit saved part way and resumed draws the same ballots and ends
+// where an uninterrupted one does.
+func TestResume(t *testing.T) {
+	s := poll(t, map[string]int{"a": 60, "b": 40})
+	whole, err := Start(s, "p1", 0.05, "audit-2026", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, whole)
+
+	a, err := Start(s, "p1", 0.05, "audit-2026", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.json")
+	for i := 0; i < 5 && !a.Done(); i++ {
+		if _, err := a.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Save(path, a.State); err != nil {
+		t.Fatal(err)
+	}
+	st, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = Resume(s, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, a)
+	if a.State.Status != whole.State.Status || len(a.State.Samples) != len(whole.State.Samples) {
+		t.Fatalf("resumed audit ended %s after %d draws, uninterrupted %s after %d",
+			a.State.Status, len(a.State.Samples), whole.State.Status, len(whole.State.Samples))
+	}
+	for i, smp := range a.State.Samples {
+		if w := whole.State.Samples[i]; smp.Index != w.Index || smp.Receipt != w.Receipt {
+			t.Fatalf("draw %d picked %d, uninterrupted run picked %d", smp.Draw, smp.Index, w.Index)
+		}
+	}
+
+	// A ballot added after the start changes the ledger root.
+	if err := s.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: "b", VoterID: "late"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resume(s, st); err == nil {
+		t.Fatal("resumed over changed ballots")
+	}
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+    "context"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    redis "github.com/redis/go-redis/v9"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// CheckCache answers CheckPollAndOption from memory for up to ttl. Poll and
+// option changes made through it drop the poll's entries at once, and are
+// announced on a Redis channel (see Broadcast) so other instances drop
+// theirs. If an announcement is lost, instances are stale for at most ttl;
+// ApplyVote checks again, so a vote let through for a poll that has just
+// closed is rejected by the worker.
+//
+// Answers for unknown IDs are cached too, so the map is capped at max
+// entries: when it is full, expired entries are swept out (at most once
+// per ttl), and if it is still full the answer is not cached.
+type CheckCache struct {
+    Store
+
+    ttl time.Duration
+    max int
+
+    mu sync.Mutex
+    // gen is bumped by every invalidation. A lookup started before one is
+    // not cached, so a slow read cannot put back what was just dropped.
+    gen     uint64
+    polls   map[string]map[string]checkEntry
+    options map[string]string // option ID -> poll ID, for DeleteOption
+    entries int
+    swept   time.Time
+
+    rdb     *redis.Client
+    channel string
+}
+
+type checkEntry struct {
+    err     error
+    expires time.Time
+}
+
+// NewCheckCache wraps s with a cache of STORE_CHECK_CACHE_TTL (1s) holding
+// at most STORE_CHECK_CACHE_MAX (100000) checks.
+func NewCheckCache(s Store) *CheckCache {
+    return &CheckCache{
+        Store:   s,
+        ttl:     durationEnv("STORE_CHECK_CACHE_TTL", time.Second),
+        max:     intEnv("STORE_CHECK_CACHE_MAX", 100000),
+        polls:   make(map[string]map[string]checkEntry),
+        options: make(map[string]string),
+    }
+}
+
+func (c *CheckCache) CheckPollAndOption(pollID, optionID string) error {
+    now := time.Now()
+    c.mu.Lock()
+    if e, ok := c.polls[pollID][optionID]; ok && now.Before(e.expires) {
+        c.mu.Unlock()
+        return e.err
+    }
+    gen := c.gen
+    c.mu.Unlock()
+
+    err := c.Store.CheckPollAndOption(pollID, optionID)
+    if IsTransient(err) {
+        return err
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.gen != gen {
+        return err
+    }
+    opts := c.polls[pollID]
+    if _, ok := opts[optionID]; !ok {
+        if c.entries >= c.max && now.Sub(c.swept) >= c.ttl {
+            c.sweep(now)
+            opts = c.polls[pollID]
+        }
+        if c.entries >= c.max {
+            return err
+        }
+        c.entries++
+    }
+    if opts == nil {
+        opts = make(map[string]checkEntry)
+        c.polls[pollID] = opts
+    }
+    opts[optionID] = checkEntry{err: err, expires: now.Add(c.ttl)}
+    if err == nil {
+        c.options[optionID] = pollID
+    }
+    return err
+}
+
+// sweep drops expired entries. Callers hold mu.
+func (c *CheckCache) sweep(now time.Time) {
+    c.swept = now
+    for pollID, opts := range c.polls {
+        for optionID, e := range opts {
+            if now.Before(e.expires) {
+                continue
+            }
+            delete(opts, optionID)
+            c.entries--
+            if c.options[optionID] == pollID {
+                delete(c.options, optionID)
+            }
+        }
+        if len(opts) == 0 {
+            delete(c.polls, pollID)
+        }
+    }
+}
+
+// Unwrap returns the wrapped store.
+func (c *CheckCache) Unwrap() Store { return c.Store }
+
+// Invalidate drops the cached checks of a poll on this instance only.
+func (c *CheckCache) Invalidate(pollID string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.gen++
+    for optionID := range c.polls[pollID] {
+        if c.options[optionID] == pollID {
+            delete(c.options, optionID)
+        }
+    }
+    c.entries -= len(c.polls[pollID])
+    delete(c.polls, pollID)
+}
+
+// invalidateOption drops the checks of the poll optionID was cached as
+// valid for. Other entries for it already say "option not found in poll".
+func (c *CheckCache) invalidateOption(optionID string) {
+    c.mu.Lock()
+    pollID, ok := c.options[optionID]
+    c.mu.Unlock()
+    if ok {
+        c.Invalidate(pollID)
+    }
+}
+
+// Messages on the broadcast channel are "poll:<id>" or "option:<id>".
+func (c *CheckCache) apply(msg string) {
+    if id, ok := strings.CutPrefix(msg, "option:"); ok {
+        c.invalidateOption(id)
+    } else if id, ok := strings.CutPrefix(msg, "poll:"); ok {
+        c.Invalidate(id)
+    }
+}
+
+// changed invalidates here and on the other instances.
+func (c *CheckCache) changed(msg string) {
+    c.apply(msg)
+    if c.rdb == nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+    defer cancel()
+    if err := c.rdb.Publish(ctx, c.channel, msg).Err(); err != nil {
+        log.Printf("check cache: broadcast of %s failed: %v", msg, err)
+    }
+}
+
+// Broadcast announces invalidations on channel and applies those of other
+// instances until ctx is done. Call it before the cache is used. go-redis
+// resubscribes after a lost connection; announcements sent meanwhile are
+// covered by the TTL.
+func (c *CheckCache) Broadcast(ctx context.Context, rdb *redis.Client, channel string) {
+    c.rdb, c.channel = rdb, channel
+    sub := rdb.Subscribe(ctx, channel)
+    go func() {
+        defer sub.Close()
+        ch := sub.Channel()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case msg, ok := <-ch:
+                if !ok {
+                    return
+                }
+                c.apply(msg.Payload)
+            }
+        }
+    }()
+}
+
+func (c *CheckCache) CreatePoll(id, question string, isOpen bool) error {
+    err := c.Store.CreatePoll(id, question, isOpen)
+    if err == nil {
+        c.changed("poll:" + id)
+    }
+    return err
+}
+
+func (c *CheckCache) UpdatePoll(id, question string, isOpen bool) error {
+    err := c.Store.UpdatePoll(id, question, isOpen)
+    if err == nil {
+        c.changed("poll:" + id)
+    }
+    return err
+}
+
+func (c *CheckCache) DeletePoll(id string) error {
+    err := c.Store.DeletePoll(id)
+    if err == nil {
+        c.changed("poll:" + id)
+    }
+    return err
+}
+
+func (c *CheckCache) AddOption(pollID, optionID, label string) error {
+    err := c.Store.AddOption(pollID, optionID, label)
+    if err == nil {
+        c.changed("poll:" + pollID)
+    }
+    return err
+}
+
+func (c *CheckCache) DeleteOption(optionID string) error {
+    err := c.Store.DeleteOption(optionID)
+    if err == nil {
+        c.changed("option:" + optionID)
+    }
+    return err
+}
+
+func (c *CheckCache) SetPollEncryption(pollID string, cfg models.EncryptionConfig) error {
+    err := c.Store.SetPollEncryption(pollID, cfg)
+    if err == nil {
+        c.changed("poll:" + pollID)
+    }
+    return err
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+// counting counts the checks that reach the wrapped store.
+type counting struct {
+    Store
+    checks int
+}
+
+func (c *counting) CheckPollAndOption(pollID, optionID string) error {
+    c.checks++
+    return c.Store.CheckPollAndOption(pollID, optionID)
+}
+
+func TestCheckCacheIsBounded(t *testing.T) {
+    mem := New()
+    if err := mem.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    if err := mem.AddOption("p1", "a", "A"); err != nil {
+        t.Fatal(err)
+    }
+    back := &counting{Store: mem}
+    c := &CheckCache{
+        Store:   back,
+        ttl:     50 * time.Millisecond,
+        max:     10,
+        polls:   make(map[string]map[string]checkEntry),
+        options: make(map[string]string),
+    }
+
+    if err := c.CheckPollAndOption("p1", "a"); err != nil {
+        t.Fatal(err)
+    }
+    // Random IDs fill the cache up to its cap and no further.
+    for i := 0; i < 100; i++ {
+        if err := c.CheckPollAndOption(fmt.Sprint("random", i), "x"); err == nil {
+            t.Fatal("unknown poll passed the check")
+        }
+    }
+    if c.entries != 10 || len(c.polls) != 10 {
+        t.Fatalf("%d entries in %d polls, want the cap of 10", c.entries, len(c.polls))
+    }
+    // Entries cached before the cap was hit still answer.
+    before := back.checks
+    if err := c.CheckPollAndOption("p1", "a"); err != nil || back.checks != before {
+        t.Fatalf("cached check went to the store (err %v)", err)
+    }
+
+    // Once they expire, the next new entry sweeps them out.
+    time.Sleep(60 * time.Millisecond)
+    if err := c.CheckPollAndOption("random", "x"); err == nil {
+        t.Fatal("unknown poll passed the check")
+    }
+    if c.entries != 1 || len(c.polls) != 1 || len(c.options) != 0 {
+        t.Fatalf("%d entries, %d polls, %d options after the sweep, want 1, 1 and 0", c.entries, len(c.polls), len(c.options))
+    }
+    if err := c.CheckPollAndOption("p1", "a"); err != nil {
+        t.Fatal(err)
+    }
+
+    c.Invalidate("p1")
+    if c.entries != 1 || len(c.polls) != 1 || len(c.options) != 0 {
+        t.Fatalf("%d entries, %d options left after invalidating p1, want 1 and 0", c.entries, len(c.options))
+    }
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+    "database/sql"
+    "log"
+    "math/rand/v2"
+    "os"
+    "strings"
+    "time"
+)
+
+// Counter strategies for plaintext votes in Postgres. With "row", the
+// default, every vote increments poll_options.votes, so votes for a popular
+// option queue on one row lock. The others are opt-in: "sharded" increments
+// one of STORE_COUNTER_SHARDS rows of poll_option_counts picked at random.
+// "rollup" only inserts the ballot;
+// a background job folds uncounted ballots into poll_options.votes every
+// STORE_ROLLUP_INTERVAL. Reads always add all three sources, so the
+// strategy can be changed between restarts without losing counts.
+const (
+    CounterRow     = "row"
+    CounterSharded = "sharded"
+    CounterRollup  = "rollup"
+)
+
+// optionVotes is the vote count of poll_options row o.
+const optionVotes = `(o.votes
+    + coalesce((select sum(c.votes) from poll_option_counts c where c.option_id = o.id), 0)
+    + (select count(*) from poll_ballots b where b.option_id = o.id and not b.counted))::bigint`
+
+func counterFromEnv() (string, int, time.Duration) {
+    mode := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_COUNTER")))
+    switch mode {
+    case "":
+        mode = CounterRow
+    case CounterRow, CounterSharded, CounterRollup:
+    default:
+        log.Printf("invalid STORE_COUNTER=%q, using %s", mode, CounterRow)
+        mode = CounterRow
+    }
+    return mode, intEnv("STORE_COUNTER_SHARDS", 16), durationEnv("STORE_ROLLUP_INTERVAL", time.Second)
+}
+
+// count records a plaintext vote for optionID inside tx.
+func (p *PostgresStore) count(tx *sql.Tx, pollID, optionID string) error {
+    var err error
+    switch p.counter {
+    case CounterSharded:
+        _, err = tx.Exec(`insert into poll_option_counts(option_id, poll_id, slot, votes) values($1,$2,$3,1)
+            on conflict (option_id, slot) do update set votes = poll_option_counts.votes + 1`, optionID, pollID, rand.IntN(p.shards))
+    case CounterRollup:
+        // The ballot is inserted uncounted; see rollup.
+    default:
+        _, err = tx.Exec(`update poll_options set votes = votes + 1 where id=$1`, optionID)
+    }
+    return err
+}
+
+// runRollup calls rollup every interval until stop is closed, then once
+// more.
+func (p *PostgresStore) runRollup(every time.Duration, stop, done chan struct{}) {
+    defer close(done)
+    t := time.NewTicker(every)
+    defer t.Stop()
+    for {
+        select {
+        case <-t.C:
+        case <-stop:
+            if err := p.rollup(); err != nil {
+                log.Printf("vote rollup: %v", err)
+            }
+            return
+        }
+        if err := p.rollup(); err != nil {
+            log.Printf("vote rollup: %v", err)
+        }
+    }
+}
+
+// rollup folds uncounted ballots into poll_options.votes and marks them
+// counted, in one statement. Ballots committed meanwhile are not visible
+// to it and are left for the next run. Frozen polls are skipped: their rows
+// cannot change, and reads still add their uncounted ballots.
+func (p *PostgresStore) rollup() error {
+    _, err := p.db.Exec(`with b as (
+            update poll_ballots set counted = true
+            where not counted and option_id <> ''
+              and poll_id not in (select id from polls where frozen)
+            returning option_id
+        )
+        update poll_options o set votes = o.votes + c.n
+        from (select option_id, count(*) as n from b group by option_id) c
+        where o.id = c.option_id`)
+    return err
+}
@@ -0,0 +1,19 @@
+package store
+
+import "testing"
+
+// The row counter stays the default; the others must be asked for.
+func TestCounterFromEnv(t *testing.T) {
+    for env, want := range map[string]string{
+        "":        CounterRow,
+        "bogus":   CounterRow,
+        "row":     CounterRow,
+        "Sharded": CounterSharded,
+        "rollup":  CounterRollup,
+    } {
+        t.Setenv("STORE_COUNTER", env)
+        if got, _, _ := counterFromEnv(); got != want {
+            t.Errorf("STORE_COUNTER=%q gives %s, want %s", env, got, want)
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+    "errors"
+
+    "github.com/thiagonasc/poll/internal/elgamal"
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// errEncryptedOptions is returned for option changes on an encrypted poll:
+// ballots hold one ciphertext per option, so ballots already cast would no
+// longer match the poll.
+var errEncryptedOptions = errors.New("poll is encrypted; its options cannot change")
+
+// applyEncrypted folds an encrypted ballot into the poll's per-option
+// aggregate. The proofs are checked here and not only when the vote is
+// accepted, so ballots that come back from a journal, stream or replay file
+// are held to the same rule. Caller holds s.mu.
+func (s *MemoryStore) applyEncrypted(p *models.Poll, v models.VoteRequest) error {
+    if v.Encrypted == nil {
+        return errors.New("poll requires encrypted ballots")
+    }
+    if _, voted := p.Voters[v.VoterID]; voted {
+        return errors.New("voter has already voted in this poll")
+    }
+    options := make([]string, 0, len(p.Options))
+    for id := range p.Options {
+        options = append(options, id)
+    }
+    if err := elgamal.VerifyBallot(*p.Encryption, p.ID, v.VoterID, options, *v.Encrypted); err != nil {
+        return err
+    }
+    next := make(map[string]models.Ciphertext, len(v.Encrypted.Choices))
+    for _, ch := range v.Encrypted.Choices {
+        cur, ok := p.Tally[ch.OptionID]
+        if !ok {
+            cur = elgamal.Identity()
+        }
+        sum, err := elgamal.Add(cur, ch.Ciphertext)
+        if err != nil {
+            return err
+        }
+        next[ch.OptionID] = sum
+    }
+    for id, c := range next {
+        p.Tally[id] = c
+    }
+    receipt := v.ReceiptID
+    if receipt == "" {
+        receipt = NewReceipt()
+    }
+    p.Voters[v.VoterID] = struct{}{}
+    p.Ballots = append(p.Ballots, models.Ballot{Receipt: receipt, Commitment: elgamal.Commitment(*v.Encrypted), Encrypted: v.Encrypted})
+    return nil
+}
+
+func (s *MemoryStore) SetPollEncryption(pollID string, cfg models.EncryptionConfig) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    p, ok := s.polls[pollID]
+    if !ok {
+        return errors.New("poll not found")
+    }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
+    if len(p.Ballots) > 0 || len(p.Voters) > 0 {
+        return errors.New("poll already has votes")
+    }
+    c := cfg
+    p.Encryption = &c
+    p.Tally = map[string]models.Ciphertext{}
+    p.Decryption = nil
+    return nil
+}
+
+func (s *MemoryStore) GetEncryptedPoll(pollID string) (models.EncryptedPoll, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    p, ok := s.polls[pollID]
+    if !ok || p.Encryption == nil {
+        return models.EncryptedPoll{}, false
+    }
+    out := models.EncryptedPoll{
+        PollID:     p.ID,
+        IsOpen:     p.IsOpen,
+        Config:     *p.Encryption,
+        Tally:      make(map[string]models.Ciphertext, len(p.Options)),
+        Ballots:    len(p.Ballots),
+        Decryption: p.Decryption,
+    }
+    for id := range p.Options {
+        c, ok := p.Tally[id]
+        if !ok {
+            c = elgamal.Identity()
+        }
+        out.Tally[id] = c
+    }
+    return out, true
+}
+
+// SetPollDecryption records the verified decryption of a closed poll and
+// copies the totals into the option counters.
+func (s *MemoryStore) SetPollDecryption(pollID string, d models.Decryption) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    p, ok := s.polls[pollID]
+    if !ok || p.Encryption == nil {
+        return errors.New("poll not found")
+    }
+    if p.IsOpen {
+        return errors.New("poll is still open")
+    }
+    if p.Decryption != nil || p.Frozen {
+        return errors.New("poll already decrypted")
+    }
+    for id, n := range d.Totals {
+        if opt, ok := p.Options[id]; ok {
+            opt.Votes = n
+        }
+    }
+    p.Decryption = &d
+    return nil
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/elgamal"
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+func encryptedPoll(t *testing.T) (*MemoryStore, models.EncryptionConfig) {
+    t.Helper()
+    s := New()
+    if err := s.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    for _, o := range []string{"a", "b"} {
+        if err := s.AddOption("p1", o, "option "+o); err != nil {
+            t.Fatal(err)
+        }
+    }
+    cfg, _, err := elgamal.GenerateKey(1, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetPollEncryption("p1", cfg); err != nil {
+        t.Fatal(err)
+    }
+    return s, cfg
+}
+
+// Ballots reach the store from the journal, DLQ and replay files without
+// passing the HTTP check, so the store must verify them itself.
+func TestApplyEncryptedVerifiesProofs(t *testing.T) {
+    s, cfg := encryptedPoll(t)
+    b, err := elgamal.EncryptBallot(cfg, "p1", "v1", []string{"a", "b"}, "a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.ApplyVote(models.VoteRequest{PollID: "p1", VoterID: "v2", Encrypted: &b}); err == nil {
+        t.Fatal("applied a ballot made for another voter")
+    }
+    forged := b
+    forged.Choices = append([]models.EncryptedChoice(nil), b.Choices...)
+    forged.Choices[0].Ciphertext, _ = elgamal.Add(b.Choices[0].Ciphertext, b.Choices[0].Ciphertext)
+    if err := s.ApplyVote(models.VoteRequest{PollID: "p1", VoterID: "v1", Encrypted: &forged}); err == nil {
+        t.Fatal("applied a ballot with a forged ciphertext")
+    }
+    if ep, _ := s.GetEncryptedPoll("p1"); ep.Ballots != 0 {
+        t.Fatalf("rejected ballots were recorded: %d", ep.Ballots)
+    }
+    if err := s.ApplyVote(models.VoteRequest{PollID: "p1", VoterID: "v1", Encrypted: &b}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestEncryptedPollOptionsAreFixed(t *testing.T) {
+    s, _ := encryptedPoll(t)
+    if err := s.AddOption("p1", "c", "option c"); err == nil || !strings.Contains(err.Error(), "encrypted") {
+        t.Fatalf("AddOption: %v", err)
+    }
+    if err := s.DeleteOption("a"); err == nil || !strings.Contains(err.Error(), "encrypted") {
+        t.Fatalf("DeleteOption: %v", err)
+    }
+    if _, ok := s.GetOption("a"); !ok {
+        t.Fatal("option was deleted")
+    }
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// Journal appends each vote the store applies to an NDJSON file
+// (STORE_JOURNAL_FILE), one line per vote once ApplyVote has succeeded.
+// The vote queues drop votes when they are acked, so this file is the only
+// record of applied votes that `poll replay -from ndjson -rebuild` can
+// rebuild a store from.
+//
+// Lines are written as votes are applied and synced on Close, so a crash
+// can lose the last few. A redelivered vote is written again; replay
+// applies it once, since stores skip vote IDs they already applied.
+type Journal struct {
+    Store
+
+    mu     sync.Mutex
+    f      *os.File
+    failed bool
+}
+
+// NewJournal wraps s, appending to the file at path.
+func NewJournal(s Store, path string) (*Journal, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return nil, err
+    }
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    return &Journal{Store: s, f: f}, nil
+}
+
+// Unwrap returns the wrapped store.
+func (j *Journal) Unwrap() Store { return j.Store }
+
+// Close syncs and closes the file.
+func (j *Journal) Close() error {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if err := j.f.Sync(); err != nil {
+        j.f.Close()
+        return err
+    }
+    return j.f.Close()
+}
+
+func (j *Journal) ApplyVote(v models.VoteRequest) error {
+    if err := j.Store.ApplyVote(v); err != nil {
+        return err
+    }
+    b, err := json.Marshal(v)
+    if err != nil {
+        return nil
+    }
+    b = append(b, '\n')
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    // The vote is counted whether or not the line is written, so a write
+    // error is only logged, once until writes succeed again.
+    if _, err := j.f.Write(b); err != nil {
+        if !j.failed {
+            log.Printf("journal: %v; applied votes are not being recorded", err)
+        }
+        j.failed = true
+    } else if j.failed {
+        log.Printf("journal: writing again")
+        j.failed = false
+    }
+    return nil
+}
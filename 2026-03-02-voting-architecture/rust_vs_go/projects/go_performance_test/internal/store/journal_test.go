@@ -0,0 +1,57 @@
+package store
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// Applied votes are journaled in order; rejected ones are not.
+func TestJournalRecordsAppliedVotes(t *testing.T) {
+    mem := New()
+    if err := mem.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    if err := mem.AddOption("p1", "a", "A"); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "journal", "applied.ndjson")
+    j, err := NewJournal(mem, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    votes := []models.VoteRequest{
+        {PollID: "p1", OptionID: "a", VoterID: "v1", VoteID: "id1"},
+        {PollID: "p1", OptionID: "a", VoterID: "v1", VoteID: "id2"}, // repeat voter
+        {PollID: "p1", OptionID: "b", VoterID: "v2", VoteID: "id3"}, // no such option
+        {PollID: "p1", OptionID: "a", VoterID: "v3", VoteID: "id4"},
+    }
+    for _, v := range votes {
+        _ = j.ApplyVote(v)
+    }
+    if err := j.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    var got []string
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        var v models.VoteRequest
+        if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+            t.Fatal(err)
+        }
+        got = append(got, v.VoteID)
+    }
+    if len(got) != 2 || got[0] != "id1" || got[1] != "id4" {
+        t.Fatalf("journaled %v, want [id1 id4]", got)
+    }
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+    "log"
+    "os"
+    "strings"
+)
+
+// Open picks a backend from STORE_BACKEND and DB_URL. It falls back to an
+// empty MemoryStore when Postgres is not configured or cannot be reached.
+// Postgres is wrapped in Resilient; the memory store cannot fail that way.
+func Open() (Store, func()) {
+    dsn := strings.TrimSpace(os.Getenv("DB_URL"))
+    backend := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_BACKEND")))
+
+    switch backend {
+    case "postgres", "pg", "postgresql":
+        if dsn != "" {
+            if pg, c, err := NewPostgres(dsn); err == nil {
+                return NewResilient(pg), c
+            } else {
+                log.Printf("failed to init postgres store: %v, falling back to memory", err)
+            }
+        } else {
+            log.Printf("STORE_BACKEND=postgres but DB_URL is empty; falling back to memory store")
+        }
+    case "memory", "mem", "inmemory", "in-memory":
+    default:
+        if dsn != "" {
+            if pg, c, err := NewPostgres(dsn); err == nil {
+                return NewResilient(pg), c
+            } else {
+                log.Printf("failed to init postgres store: %v, falling back to memory", err)
+            }
+        }
+    }
+    return New(), func() {}
+}
@@ -2,17 +2,26 @@ package store
 
 import (
     "database/sql"
+    "encoding/json"
     "errors"
     "fmt"
     "sort"
     "strings"
+    "time"
 
     _ "github.com/lib/pq"
+    "github.com/thiagonasc/poll/internal/elgamal"
     "github.com/thiagonasc/poll/internal/models"
 )
 
 type PostgresStore struct {
-    db *sql.DB
+    db       *sql.DB
+    counter  string
+    shards   int
+    votePath string
+    // Prepared after migrate; see votepath.go.
+    checkStmt *sql.Stmt
+    voteStmt  *sql.Stmt
 }
 
 func NewPostgres(dsn string) (Store, func(), error) {
@@ -24,12 +33,28 @@ func NewPostgres(dsn string) (Store, func(), error) {
         _ = db.Close()
         return nil, nil, err
     }
-    p := &PostgresStore{db: db}
+    tunePool(db)
+    p := &PostgresStore{db: db, votePath: votePathFromEnv()}
+    var every time.Duration
+    p.counter, p.shards, every = counterFromEnv()
     if err := p.migrate(); err != nil {
         _ = db.Close()
         return nil, nil, err
     }
+    if err := p.prepare(); err != nil {
+        _ = db.Close()
+        return nil, nil, err
+    }
     closer := func() { _ = db.Close() }
+    if p.counter == CounterRollup {
+        stop, done := make(chan struct{}), make(chan struct{})
+        go p.runRollup(every, stop, done)
+        closer = func() {
+            close(stop)
+            <-done
+            _ = db.Close()
+        }
+    }
     return p, closer, nil
 }
 
@@ -54,8 +79,94 @@ func (p *PostgresStore) migrate() error {
             voted_at timestamptz not null default now(),
             primary key (poll_id, voter_id)
         )`,
+        `create table if not exists poll_ballots (
+            seq       bigserial primary key,
+            poll_id   text not null references polls(id) on delete cascade,
+            receipt   text not null unique,
+            option_id text not null
+        )`,
+        `alter table poll_ballots add column if not exists commitment text`,
+        `alter table poll_ballots add column if not exists encrypted jsonb`,
+        `create table if not exists poll_encryption (
+            poll_id    text primary key references polls(id) on delete cascade,
+            config     jsonb not null,
+            ballots    integer not null default 0,
+            decryption jsonb
+        )`,
+        `create table if not exists poll_option_tally (
+            option_id text primary key references poll_options(id) on delete cascade,
+            poll_id   text not null references polls(id) on delete cascade,
+            a         text not null,
+            b         text not null
+        )`,
+        `alter table poll_voters add column if not exists vote_id text`,
+        `create unique index if not exists idx_poll_voters_vote on poll_voters(vote_id)`,
+        `alter table polls add column if not exists frozen boolean not null default false`,
+        `create table if not exists poll_certificates (
+            poll_id    text primary key references polls(id),
+            document   text not null,
+            signature  text not null,
+            public_key text not null,
+            created_at timestamptz not null default now()
+        )`,
+        // Certified polls are frozen in the database itself, so the counts
+        // cannot drift from the certificate even through manual SQL.
+        `create or replace function poll_reject_frozen() returns trigger language plpgsql as $$
+        declare pid text;
+        begin
+            if tg_table_name = 'polls' then
+                pid := old.id;
+            elsif tg_op = 'INSERT' then
+                pid := new.poll_id;
+            else
+                pid := old.poll_id;
+            end if;
+            if exists(select 1 from polls where id = pid and frozen) then
+                raise exception 'poll is frozen';
+            end if;
+            if tg_op = 'DELETE' then
+                return old;
+            end if;
+            return new;
+        end $$`,
+        `create or replace function poll_certificate_immutable() returns trigger language plpgsql as $$
+        begin
+            raise exception 'poll certificate is immutable';
+        end $$`,
+        `drop trigger if exists polls_frozen on polls`,
+        `create trigger polls_frozen before update or delete on polls for each row execute function poll_reject_frozen()`,
+        `drop trigger if exists poll_options_frozen on poll_options`,
+        `create trigger poll_options_frozen before insert or update or delete on poll_options for each row execute function poll_reject_frozen()`,
+        `drop trigger if exists poll_voters_frozen on poll_voters`,
+        `create trigger poll_voters_frozen before insert or update or delete on poll_voters for each row execute function poll_reject_frozen()`,
+        `drop trigger if exists poll_ballots_frozen on poll_ballots`,
+        `create trigger poll_ballots_frozen before insert or update or delete on poll_ballots for each row execute function poll_reject_frozen()`,
+        `drop trigger if exists poll_certificates_immutable on poll_certificates`,
+        `create trigger poll_certificates_immutable before update or delete on poll_certificates for each row execute function poll_certificate_immutable()`,
         `create index if not exists idx_poll_options_poll on poll_options(poll_id)`,
+        `create index if not exists idx_poll_ballots_poll on poll_ballots(poll_id, seq)`,
         `create index if not exists idx_poll_voters_poll on poll_voters(poll_id)`,
+        // Counter slots and rollup state; see counters.go. Existing ballots
+        // were counted by the row strategy.
+        `create table if not exists poll_option_counts (
+            option_id text not null references poll_options(id) on delete cascade,
+            poll_id   text not null references polls(id) on delete cascade,
+            slot      integer not null,
+            votes     bigint not null default 0,
+            primary key (option_id, slot)
+        )`,
+        `alter table poll_ballots add column if not exists counted boolean not null default true`,
+        `create index if not exists idx_poll_ballots_uncounted on poll_ballots(option_id) where not counted`,
+        // Ledger positions; see SequenceBallots.
+        `alter table poll_ballots add column if not exists position bigint`,
+        `create unique index if not exists idx_poll_ballots_position on poll_ballots(poll_id, position)`,
+        `create index if not exists idx_poll_ballots_unplaced on poll_ballots(seq) where position is null`,
+        `create table if not exists poll_ledger (
+            poll_id text primary key references polls(id) on delete cascade,
+            size    bigint not null default 0
+        )`,
+        `drop trigger if exists poll_option_counts_frozen on poll_option_counts`,
+        `create trigger poll_option_counts_frozen before insert or update or delete on poll_option_counts for each row execute function poll_reject_frozen()`,
     }
     for _, s := range stmts {
         if _, err := p.db.Exec(s); err != nil {
@@ -66,9 +177,8 @@ func (p *PostgresStore) migrate() error {
 }
 
 func (p *PostgresStore) CheckPollAndOption(pollID, optionID string) error {
-    var isOpen bool
-    var exists bool
-    err := p.db.QueryRow(`select is_open from polls where id=$1`, pollID).Scan(&isOpen)
+    var isOpen, encrypted, exists bool
+    err := p.checkStmt.QueryRow(pollID, optionID).Scan(&isOpen, &encrypted, &exists)
     if err == sql.ErrNoRows {
         return errors.New("poll not found")
     }
@@ -78,9 +188,8 @@ func (p *PostgresStore) CheckPollAndOption(pollID, optionID string) error {
     if !isOpen {
         return errors.New("poll is closed")
     }
-    err = p.db.QueryRow(`select exists(select 1 from poll_options where id=$1 and poll_id=$2)`, optionID, pollID).Scan(&exists)
-    if err != nil {
-        return err
+    if encrypted {
+        return errors.New("poll requires encrypted ballots")
     }
     if !exists {
         return errors.New("option not found in poll")
@@ -89,22 +198,50 @@ func (p *PostgresStore) CheckPollAndOption(pollID, optionID string) error {
 }
 
 func (p *PostgresStore) ApplyVote(v models.VoteRequest) error {
+    if p.votePath == VotePathCTE && v.Encrypted == nil {
+        return p.applyVoteCTE(v)
+    }
+    return p.applyVoteTx(v)
+}
+
+func (p *PostgresStore) applyVoteTx(v models.VoteRequest) error {
     tx, err := p.db.Begin()
     if err != nil {
         return err
     }
     defer func() { _ = tx.Rollback() }()
 
-    var isOpen bool
-    if err := tx.QueryRow(`select is_open from polls where id=$1`, v.PollID).Scan(&isOpen); err != nil {
+    var isOpen, encrypted bool
+    if err := tx.QueryRow(`select p.is_open, e.poll_id is not null from polls p left join poll_encryption e on e.poll_id = p.id where p.id=$1`, v.PollID).Scan(&isOpen, &encrypted); err != nil {
         if err == sql.ErrNoRows {
             return errors.New("poll not found")
         }
         return err
     }
     if !isOpen {
+        // A redelivery of a vote counted before the poll closed.
+        var applied bool
+        if v.VoteID != "" {
+            if err := tx.QueryRow(`select exists(select 1 from poll_voters where vote_id=$1)`, v.VoteID).Scan(&applied); err != nil {
+                return err
+            }
+        }
+        if applied {
+            return nil
+        }
         return errors.New("poll is closed")
     }
+    if encrypted {
+        if err := p.applyEncrypted(tx, v); errors.Is(err, errVoteApplied) {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        return tx.Commit()
+    }
+    if v.Encrypted != nil {
+        return errors.New("poll does not accept encrypted ballots")
+    }
     var optExists bool
     if err := tx.QueryRow(`select exists(select 1 from poll_options where id=$1 and poll_id=$2)`, v.OptionID, v.PollID).Scan(&optExists); err != nil {
         return err
@@ -112,13 +249,19 @@ func (p *PostgresStore) ApplyVote(v models.VoteRequest) error {
     if !optExists {
         return errors.New("option not found in poll")
     }
-    if _, err := tx.Exec(`insert into poll_voters(poll_id, voter_id) values($1,$2)`, v.PollID, v.VoterID); err != nil {
-        if strings.Contains(err.Error(), "duplicate key") || strings.Contains(strings.ToLower(err.Error()), "unique") {
-            return errors.New("voter has already voted in this poll")
-        }
+    if err := insertVoter(tx, v); errors.Is(err, errVoteApplied) {
+        return nil
+    } else if err != nil {
         return err
     }
-    if _, err := tx.Exec(`update poll_options set votes = votes + 1 where id=$1`, v.OptionID); err != nil {
+    if err := p.count(tx, v.PollID, v.OptionID); err != nil {
+        return err
+    }
+    receipt := v.ReceiptID
+    if receipt == "" {
+        receipt = NewReceipt()
+    }
+    if _, err := tx.Exec(`insert into poll_ballots(poll_id, receipt, option_id, counted) values($1,$2,$3,$4)`, v.PollID, receipt, v.OptionID, p.counter != CounterRollup); err != nil {
         return err
     }
     if err := tx.Commit(); err != nil {
@@ -127,9 +270,37 @@ func (p *PostgresStore) ApplyVote(v models.VoteRequest) error {
     return nil
 }
 
+// voteApplied reports whether a vote with this ID was already recorded, so
+// a redelivered vote is acknowledged instead of counted again.
+func (p *PostgresStore) voteApplied(voteID string) bool {
+    var ok bool
+    err := p.db.QueryRow(`select exists(select 1 from poll_voters where vote_id=$1)`, voteID).Scan(&ok)
+    return err == nil && ok
+}
+
+// errVoteApplied is returned by insertVoter for a vote already recorded.
+var errVoteApplied = errors.New("vote already applied")
+
+// insertVoter records v's voter inside tx. A vote ID that is already there
+// (a redelivery, or a concurrent delivery that committed first) is skipped
+// by ON CONFLICT in the same statement and reported as errVoteApplied; the
+// caller then returns without counting the vote again.
+func insertVoter(tx *sql.Tx, v models.VoteRequest) error {
+    var inserted bool
+    err := tx.QueryRow(`insert into poll_voters(poll_id, voter_id, vote_id) values($1,$2,nullif($3,''))
+        on conflict (vote_id) do nothing returning true`, v.PollID, v.VoterID, v.VoteID).Scan(&inserted)
+    switch {
+    case err == sql.ErrNoRows:
+        return errVoteApplied
+    case err != nil && (strings.Contains(err.Error(), "duplicate key") || strings.Contains(strings.ToLower(err.Error()), "unique")):
+        return errors.New("voter has already voted in this poll")
+    }
+    return err
+}
+
 func (p *PostgresStore) GetOption(id string) (*models.OptionItem, bool) {
     var opt models.OptionItem
-    err := p.db.QueryRow(`select id, label, votes from poll_options where id=$1`, id).Scan(&opt.ID, &opt.Label, &opt.Votes)
+    err := p.db.QueryRow(`select o.id, o.label, `+optionVotes+` from poll_options o where o.id=$1`, id).Scan(&opt.ID, &opt.Label, &opt.Votes)
     if err == sql.ErrNoRows {
         return nil, false
     }
@@ -148,7 +319,7 @@ func (p *PostgresStore) GetPollSnapshot(id string) (PollSnapshot, bool) {
     if err != nil {
         return PollSnapshot{}, false
     }
-    rows, err := p.db.Query(`select id, label, votes from poll_options where poll_id=$1`, id)
+    rows, err := p.db.Query(`select o.id, o.label, `+optionVotes+` from poll_options o where o.poll_id=$1`, id)
     if err == nil {
         defer rows.Close()
         for rows.Next() {
@@ -171,18 +342,22 @@ func (p *PostgresStore) GetPollSnapshot(id string) (PollSnapshot, bool) {
     return snap, true
 }
 
-func (p *PostgresStore) ListPollSnapshots() []PollSnapshot {
+func (p *PostgresStore) ListPollSnapshots() ([]PollSnapshot, error) {
     rows, err := p.db.Query(`select id from polls`)
     if err != nil {
-        return nil
+        return nil, err
     }
     defer rows.Close()
     ids := []string{}
     for rows.Next() {
         var id string
-        if err := rows.Scan(&id); err == nil {
-            ids = append(ids, id)
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
         }
+        ids = append(ids, id)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
     }
     snaps := make([]PollSnapshot, 0, len(ids))
     for _, id := range ids {
@@ -196,16 +371,16 @@ func (p *PostgresStore) ListPollSnapshots() []PollSnapshot {
         }
         return snaps[i].Question < snaps[j].Question
     })
-    return snaps
+    return snaps, nil
 }
 
 func (p *PostgresStore) ListOptions(pollID string) []models.OptionItem {
     var rows *sql.Rows
     var err error
     if strings.TrimSpace(pollID) == "" {
-        rows, err = p.db.Query(`select id, label, votes from poll_options`)
+        rows, err = p.db.Query(`select o.id, o.label, `+optionVotes+` from poll_options o`)
     } else {
-        rows, err = p.db.Query(`select id, label, votes from poll_options where poll_id=$1`, pollID)
+        rows, err = p.db.Query(`select o.id, o.label, `+optionVotes+` from poll_options o where o.poll_id=$1`, pollID)
     }
     if err != nil {
         return nil
@@ -227,6 +402,102 @@ func (p *PostgresStore) ListOptions(pollID string) []models.OptionItem {
     return out
 }
 
+func (p *PostgresStore) ListBallots(pollID string) ([]models.Ballot, error) {
+    return scanBallots(p.db, `select receipt, option_id, coalesce(commitment, ''), encrypted from poll_ballots
+        where poll_id=$1 order by position nulls last, seq`, pollID)
+}
+
+func (p *PostgresStore) ListBallotsFrom(pollID string, from int) ([]models.Ballot, error) {
+    return scanBallots(p.db, `select receipt, option_id, coalesce(commitment, ''), encrypted from poll_ballots
+        where poll_id=$1 and position >= $2 order by position`, pollID, from)
+}
+
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+    Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func scanBallots(q queryer, query string, args ...any) ([]models.Ballot, error) {
+    rows, err := q.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    out := []models.Ballot{}
+    for rows.Next() {
+        var b models.Ballot
+        var enc []byte
+        if err := rows.Scan(&b.Receipt, &b.OptionID, &b.Commitment, &enc); err != nil {
+            return nil, err
+        }
+        if enc != nil {
+            var eb models.EncryptedBallot
+            if err := json.Unmarshal(enc, &eb); err != nil {
+                return nil, fmt.Errorf("ballot %s: %w", b.Receipt, err)
+            }
+            b.Encrypted = &eb
+        }
+        out = append(out, b)
+    }
+    return out, rows.Err()
+}
+
+// sequenceSQL gives committed, unplaced ballots the next positions of their
+// poll in seq order, for one poll or, with $1 empty, all of them. Ballots
+// still in flight are invisible to it and get later positions, so seq
+// values committing out of order cannot reorder a published tree. Callers
+// hold ledgerLock. Frozen polls cannot change; CertifyPoll places its
+// poll's ballots before freezing it.
+const sequenceSQL = `with fresh as (
+        select b.seq, coalesce(l.size, 0) - 1 + row_number() over (partition by b.poll_id order by b.seq) as pos
+        from poll_ballots b
+        left join poll_ledger l on l.poll_id = b.poll_id
+        where b.position is null and ($1 = '' or b.poll_id = $1)
+          and b.poll_id not in (select id from polls where frozen)
+    ), placed as (
+        update poll_ballots b set position = f.pos from fresh f where b.seq = f.seq
+        returning b.poll_id
+    )
+    insert into poll_ledger(poll_id, size)
+    select poll_id, count(*) from placed group by poll_id
+    on conflict (poll_id) do update set size = poll_ledger.size + excluded.size`
+
+// ledgerLock serializes sequencing across instances.
+const ledgerLock = `select pg_advisory_xact_lock(6962)`
+
+func (p *PostgresStore) SequenceBallots() (map[string]int, error) {
+    tx, err := p.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer func() { _ = tx.Rollback() }()
+    if _, err := tx.Exec(ledgerLock); err != nil {
+        return nil, err
+    }
+    if _, err := tx.Exec(sequenceSQL, ""); err != nil {
+        return nil, err
+    }
+    rows, err := tx.Query(`select p.id, coalesce(l.size, 0) from polls p left join poll_ledger l on l.poll_id = p.id`)
+    if err != nil {
+        return nil, err
+    }
+    out := map[string]int{}
+    for rows.Next() {
+        var id string
+        var n int
+        if err := rows.Scan(&id, &n); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        out[id] = n
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return out, tx.Commit()
+}
+
 func (p *PostgresStore) CreatePoll(id, question string, isOpen bool) error {
     _, err := p.db.Exec(`insert into polls(id, question, is_open) values($1,$2,$3)`, id, question, isOpen)
     if err != nil {
@@ -241,7 +512,7 @@ func (p *PostgresStore) CreatePoll(id, question string, isOpen bool) error {
 func (p *PostgresStore) UpdatePoll(id, question string, isOpen bool) error {
     res, err := p.db.Exec(`update polls set question=$1, is_open=$2 where id=$3`, question, isOpen, id)
     if err != nil {
-        return err
+        return frozenErr(err)
     }
     n, _ := res.RowsAffected()
     if n == 0 {
@@ -253,7 +524,7 @@ func (p *PostgresStore) UpdatePoll(id, question string, isOpen bool) error {
 func (p *PostgresStore) DeletePoll(id string) error {
     res, err := p.db.Exec(`delete from polls where id=$1`, id)
     if err != nil {
-        return err
+        return frozenErr(err)
     }
     n, _ := res.RowsAffected()
     if n == 0 {
@@ -263,14 +534,24 @@ func (p *PostgresStore) DeletePoll(id string) error {
 }
 
 func (p *PostgresStore) AddOption(pollID, optionID, label string) error {
-    var tmp string
-    if err := p.db.QueryRow(`select id from polls where id=$1`, pollID).Scan(&tmp); err != nil {
+    tx, err := p.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer func() { _ = tx.Rollback() }()
+    // The share lock keeps SetPollEncryption, which locks the poll for
+    // update, from turning encryption on meanwhile.
+    var encrypted bool
+    if err := tx.QueryRow(`select e.poll_id is not null from polls p left join poll_encryption e on e.poll_id = p.id where p.id=$1 for share of p`, pollID).Scan(&encrypted); err != nil {
         if err == sql.ErrNoRows {
             return errors.New("poll not found")
         }
         return err
     }
-    _, err := p.db.Exec(`insert into poll_options(id, poll_id, label) values($1,$2,$3)`, optionID, pollID, label)
+    if encrypted {
+        return errEncryptedOptions
+    }
+    _, err = tx.Exec(`insert into poll_options(id, poll_id, label) values($1,$2,$3)`, optionID, pollID, label)
     if err != nil {
         if strings.Contains(err.Error(), "duplicate key") {
             return errors.New("option already exists")
@@ -278,15 +559,15 @@ func (p *PostgresStore) AddOption(pollID, optionID, label string) error {
         if strings.Contains(strings.ToLower(err.Error()), "unique") {
             return errors.New("option already exists")
         }
-        return err
+        return frozenErr(err)
     }
-    return nil
+    return tx.Commit()
 }
 
 func (p *PostgresStore) UpdateOption(optionID, label string) error {
     res, err := p.db.Exec(`update poll_options set label=$1 where id=$2`, label, optionID)
     if err != nil {
-        return err
+        return frozenErr(err)
     }
     n, _ := res.RowsAffected()
     if n == 0 {
@@ -296,15 +577,30 @@ func (p *PostgresStore) UpdateOption(optionID, label string) error {
 }
 
 func (p *PostgresStore) DeleteOption(optionID string) error {
-    res, err := p.db.Exec(`delete from poll_options where id=$1`, optionID)
+    tx, err := p.db.Begin()
     if err != nil {
         return err
     }
+    defer func() { _ = tx.Rollback() }()
+    var encrypted bool
+    if err := tx.QueryRow(`select e.poll_id is not null from poll_options o join polls p on p.id = o.poll_id left join poll_encryption e on e.poll_id = p.id where o.id=$1 for share of p`, optionID).Scan(&encrypted); err != nil {
+        if err == sql.ErrNoRows {
+            return errors.New("option not found")
+        }
+        return err
+    }
+    if encrypted {
+        return errEncryptedOptions
+    }
+    res, err := tx.Exec(`delete from poll_options where id=$1`, optionID)
+    if err != nil {
+        return frozenErr(err)
+    }
     n, _ := res.RowsAffected()
     if n == 0 {
         return errors.New("option not found")
     }
-    return nil
+    return tx.Commit()
 }
 
 func (p *PostgresStore) AddVoter(pollID, voterID string) error {
@@ -320,7 +616,7 @@ func (p *PostgresStore) AddVoter(pollID, voterID string) error {
         if strings.Contains(strings.ToLower(err.Error()), "duplicate key") || strings.Contains(strings.ToLower(err.Error()), "unique") {
             return errors.New("voter already exists")
         }
-        return err
+        return frozenErr(err)
     }
     return nil
 }
@@ -328,7 +624,7 @@ func (p *PostgresStore) AddVoter(pollID, voterID string) error {
 func (p *PostgresStore) DeleteVoter(pollID, voterID string) error {
     res, err := p.db.Exec(`delete from poll_voters where poll_id=$1 and voter_id=$2`, pollID, voterID)
     if err != nil {
-        return err
+        return frozenErr(err)
     }
     n, _ := res.RowsAffected()
     if n == 0 {
@@ -337,4 +633,277 @@ func (p *PostgresStore) DeleteVoter(pollID, voterID string) error {
     return nil
 }
 
+func (p *PostgresStore) HasVoted(pollID, voterID string) (bool, error) {
+    var poll, voted bool
+    err := p.db.QueryRow(`select exists(select 1 from polls where id=$1),
+        exists(select 1 from poll_voters where poll_id=$1 and voter_id=$2)`, pollID, voterID).Scan(&poll, &voted)
+    if err != nil {
+        return false, err
+    }
+    if !poll {
+        return false, errors.New("poll not found")
+    }
+    return voted, nil
+}
+
+// applyEncrypted folds an encrypted ballot into poll_option_tally. Tally rows
+// are locked in option order so concurrent ballots cannot deadlock.
+func (p *PostgresStore) applyEncrypted(tx *sql.Tx, v models.VoteRequest) error {
+    if v.Encrypted == nil {
+        return errors.New("poll requires encrypted ballots")
+    }
+    var raw []byte
+    if err := tx.QueryRow(`select config from poll_encryption where poll_id=$1`, v.PollID).Scan(&raw); err != nil {
+        return err
+    }
+    var cfg models.EncryptionConfig
+    if err := json.Unmarshal(raw, &cfg); err != nil {
+        return err
+    }
+    rows, err := tx.Query(`select id from poll_options where poll_id=$1`, v.PollID)
+    if err != nil {
+        return err
+    }
+    var options []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        options = append(options, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    // Checked here as well as on accept: ballots also arrive from the
+    // journal, the DLQ and replay files.
+    if err := elgamal.VerifyBallot(cfg, v.PollID, v.VoterID, options, *v.Encrypted); err != nil {
+        return err
+    }
+    if err := insertVoter(tx, v); err != nil {
+        return err
+    }
+    choices := append([]models.EncryptedChoice(nil), v.Encrypted.Choices...)
+    sort.Slice(choices, func(i, j int) bool { return choices[i].OptionID < choices[j].OptionID })
+    for _, ch := range choices {
+        if _, err := tx.Exec(`insert into poll_option_tally(option_id, poll_id, a, b) values($1,$2,'1','1') on conflict (option_id) do nothing`, ch.OptionID, v.PollID); err != nil {
+            return err
+        }
+        var cur models.Ciphertext
+        if err := tx.QueryRow(`select a, b from poll_option_tally where option_id=$1 for update`, ch.OptionID).Scan(&cur.A, &cur.B); err != nil {
+            return err
+        }
+        sum, err := elgamal.Add(cur, ch.Ciphertext)
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`update poll_option_tally set a=$1, b=$2 where option_id=$3`, sum.A, sum.B, ch.OptionID); err != nil {
+            return err
+        }
+    }
+    if _, err := tx.Exec(`update poll_encryption set ballots = ballots + 1 where poll_id=$1`, v.PollID); err != nil {
+        return err
+    }
+    receipt := v.ReceiptID
+    if receipt == "" {
+        receipt = NewReceipt()
+    }
+    enc, err := json.Marshal(v.Encrypted)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(`insert into poll_ballots(poll_id, receipt, option_id, commitment, encrypted) values($1,$2,'',$3,$4)`, v.PollID, receipt, elgamal.Commitment(*v.Encrypted), enc)
+    return err
+}
+
+func (p *PostgresStore) SetPollEncryption(pollID string, cfg models.EncryptionConfig) error {
+    b, err := json.Marshal(cfg)
+    if err != nil {
+        return err
+    }
+    tx, err := p.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer func() { _ = tx.Rollback() }()
+    var voted bool
+    if err := tx.QueryRow(`select exists(select 1 from poll_voters where poll_id=$1) or exists(select 1 from poll_ballots where poll_id=$1) from polls where id=$1 for update`, pollID).Scan(&voted); err != nil {
+        if err == sql.ErrNoRows {
+            return errors.New("poll not found")
+        }
+        return err
+    }
+    if voted {
+        return errors.New("poll already has votes")
+    }
+    if _, err := tx.Exec(`delete from poll_option_tally where poll_id=$1`, pollID); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`insert into poll_encryption(poll_id, config) values($1,$2)
+        on conflict (poll_id) do update set config=excluded.config, ballots=0, decryption=null`, pollID, b); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (p *PostgresStore) GetEncryptedPoll(pollID string) (models.EncryptedPoll, bool) {
+    out := models.EncryptedPoll{PollID: pollID, Tally: map[string]models.Ciphertext{}}
+    var cfg, dec []byte
+    err := p.db.QueryRow(`select p.is_open, e.config, e.ballots, e.decryption from polls p join poll_encryption e on e.poll_id = p.id where p.id=$1`, pollID).Scan(&out.IsOpen, &cfg, &out.Ballots, &dec)
+    if err != nil {
+        return models.EncryptedPoll{}, false
+    }
+    if json.Unmarshal(cfg, &out.Config) != nil {
+        return models.EncryptedPoll{}, false
+    }
+    if dec != nil {
+        var d models.Decryption
+        if json.Unmarshal(dec, &d) == nil {
+            out.Decryption = &d
+        }
+    }
+    rows, err := p.db.Query(`select o.id, coalesce(t.a, '1'), coalesce(t.b, '1') from poll_options o left join poll_option_tally t on t.option_id = o.id where o.poll_id=$1`, pollID)
+    if err != nil {
+        return models.EncryptedPoll{}, false
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id string
+        var c models.Ciphertext
+        if err := rows.Scan(&id, &c.A, &c.B); err == nil {
+            out.Tally[id] = c
+        }
+    }
+    return out, true
+}
+
+func (p *PostgresStore) SetPollDecryption(pollID string, d models.Decryption) error {
+    b, err := json.Marshal(d)
+    if err != nil {
+        return err
+    }
+    tx, err := p.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer func() { _ = tx.Rollback() }()
+    var isOpen, decrypted bool
+    if err := tx.QueryRow(`select p.is_open, e.decryption is not null from polls p join poll_encryption e on e.poll_id = p.id where p.id=$1 for update`, pollID).Scan(&isOpen, &decrypted); err != nil {
+        if err == sql.ErrNoRows {
+            return errors.New("poll not found")
+        }
+        return err
+    }
+    if isOpen {
+        return errors.New("poll is still open")
+    }
+    if decrypted {
+        return errors.New("poll already decrypted")
+    }
+    for id, n := range d.Totals {
+        if _, err := tx.Exec(`update poll_options set votes=$1 where id=$2 and poll_id=$3`, n, id, pollID); err != nil {
+            return err
+        }
+    }
+    if _, err := tx.Exec(`update poll_encryption set decryption=$1 where poll_id=$2`, b, pollID); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func frozenErr(err error) error {
+    if strings.Contains(err.Error(), "poll is frozen") {
+        return errors.New("poll is frozen")
+    }
+    return err
+}
+
+func (p *PostgresStore) CertifyPoll(pollID string, issue CertifyFunc) (models.Certificate, error) {
+    tx, err := p.db.Begin()
+    if err != nil {
+        return models.Certificate{}, err
+    }
+    defer func() { _ = tx.Rollback() }()
+    // The row lock waits for votes that are still inserting ballots (they
+    // hold a key share lock on the poll) and keeps new ones, and reopening,
+    // out until the poll is frozen.
+    snap := PollSnapshot{ID: pollID}
+    var frozen, encrypted, decrypted bool
+    err = tx.QueryRow(`select p.question, p.is_open, p.frozen, e.poll_id is not null, e.decryption is not null
+        from polls p left join poll_encryption e on e.poll_id = p.id where p.id=$1 for update of p`, pollID).
+        Scan(&snap.Question, &snap.IsOpen, &frozen, &encrypted, &decrypted)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return models.Certificate{}, errors.New("poll not found")
+        }
+        return models.Certificate{}, err
+    }
+    if snap.IsOpen {
+        return models.Certificate{}, errors.New("poll is still open")
+    }
+    if frozen {
+        return models.Certificate{}, errors.New("poll already certified")
+    }
+    if encrypted && !decrypted {
+        return models.Certificate{}, errors.New("poll has not been decrypted")
+    }
+    // A frozen poll's ballots cannot be placed later.
+    if _, err := tx.Exec(ledgerLock); err != nil {
+        return models.Certificate{}, err
+    }
+    if _, err := tx.Exec(sequenceSQL, pollID); err != nil {
+        return models.Certificate{}, err
+    }
+    // optionVotes includes ballots the rollup has not counted yet.
+    rows, err := tx.Query(`select o.id, o.label, `+optionVotes+` from poll_options o where o.poll_id=$1`, pollID)
+    if err != nil {
+        return models.Certificate{}, err
+    }
+    for rows.Next() {
+        var o models.OptionItem
+        if err := rows.Scan(&o.ID, &o.Label, &o.Votes); err != nil {
+            rows.Close()
+            return models.Certificate{}, err
+        }
+        snap.Options = append(snap.Options, o)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return models.Certificate{}, err
+    }
+    ballots, err := scanBallots(tx, `select receipt, option_id, coalesce(commitment, ''), encrypted from poll_ballots
+        where poll_id=$1 order by position`, pollID)
+    if err != nil {
+        return models.Certificate{}, err
+    }
+    cert, err := issue(snap, ballots)
+    if err != nil {
+        return models.Certificate{}, err
+    }
+    if _, err := tx.Exec(`insert into poll_certificates(poll_id, document, signature, public_key) values($1,$2,$3,$4)`, pollID, cert.Document, cert.Signature, cert.PublicKey); err != nil {
+        if strings.Contains(err.Error(), "duplicate key") {
+            return models.Certificate{}, errors.New("poll already certified")
+        }
+        return models.Certificate{}, err
+    }
+    if _, err := tx.Exec(`update polls set frozen=true where id=$1`, pollID); err != nil {
+        return models.Certificate{}, err
+    }
+    if err := tx.Commit(); err != nil {
+        return models.Certificate{}, err
+    }
+    return cert, nil
+}
+
+func (p *PostgresStore) GetCertificate(pollID string) (models.Certificate, bool) {
+    c := models.Certificate{PollID: pollID}
+    err := p.db.QueryRow(`select document, signature, public_key from poll_certificates where poll_id=$1`, pollID).Scan(&c.Document, &c.Signature, &c.PublicKey)
+    if err != nil {
+        return models.Certificate{}, false
+    }
+    return c, true
+}
+
 func (p *PostgresStore) String() string { return fmt.Sprintf("PostgresStore(%p)", p) }
@@ -0,0 +1,249 @@
+package store
+
+import (
+    "errors"
+    "log"
+    "math/rand/v2"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// UnavailableError is returned without calling the backend while the
+// circuit is open. RetryAfter is how long until the next probe.
+type UnavailableError struct {
+    RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string { return "store unavailable: circuit open" }
+
+// IsUnavailable reports whether err means the store is refusing calls, and
+// for how long.
+func IsUnavailable(err error) (time.Duration, bool) {
+    var ue *UnavailableError
+    if errors.As(err, &ue) {
+        return ue.RetryAfter, true
+    }
+    return 0, false
+}
+
+// Resilient wraps a Store. Calls that are safe to repeat, other than
+// ApplyVote, are retried on transient errors with jittered backoff. Every
+// call feeds a circuit breaker: when too many fail in the window, the
+// circuit opens and calls fail fast with *UnavailableError until a probe
+// after the cooldown succeeds. Domain errors ("poll is closed") count as successes.
+type Resilient struct {
+    Store
+
+    attempts int
+    base     time.Duration
+    max      time.Duration
+
+    mu       sync.Mutex
+    window   time.Duration
+    minCalls int
+    ratio    float64
+    cooldown time.Duration
+    buckets  [10]breakerBucket
+    openedAt time.Time
+    open     bool
+    probing  bool
+}
+
+type breakerBucket struct {
+    start         time.Time
+    calls, failed int
+}
+
+// NewResilient wraps s, configured from STORE_RETRY_* and STORE_BREAKER_*.
+func NewResilient(s Store) *Resilient {
+    return &Resilient{
+        Store:    s,
+        attempts: intEnv("STORE_RETRY_ATTEMPTS", 3),
+        base:     durationEnv("STORE_RETRY_BACKOFF", 20*time.Millisecond),
+        max:      durationEnv("STORE_RETRY_MAX_BACKOFF", 500*time.Millisecond),
+        window:   durationEnv("STORE_BREAKER_WINDOW", 10*time.Second),
+        minCalls: intEnv("STORE_BREAKER_MIN_CALLS", 20),
+        ratio:    ratioEnv("STORE_BREAKER_FAILURE_RATIO", 0.5),
+        cooldown: durationEnv("STORE_BREAKER_COOLDOWN", 5*time.Second),
+    }
+}
+
+// allow reports whether a call may go to the backend. After the cooldown a
+// single probe is let through while the circuit stays open.
+func (r *Resilient) allow() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.open {
+        return nil
+    }
+    wait := r.cooldown - time.Since(r.openedAt)
+    if wait > 0 || r.probing {
+        if wait < time.Second {
+            wait = time.Second
+        }
+        return &UnavailableError{RetryAfter: wait}
+    }
+    r.probing = true
+    return nil
+}
+
+func (r *Resilient) record(failed bool) {
+    now := time.Now()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.open {
+        if !r.probing {
+            // A call that was let in before the circuit opened.
+            return
+        }
+        r.probing = false
+        if failed {
+            r.openedAt = now
+            return
+        }
+        r.open = false
+        log.Printf("store circuit closed")
+        r.buckets = [10]breakerBucket{}
+    }
+    span := r.window / time.Duration(len(r.buckets))
+    b := &r.buckets[int(now.UnixNano()/int64(span))%len(r.buckets)]
+    if now.Sub(b.start) >= span {
+        *b = breakerBucket{start: now.Truncate(span)}
+    }
+    b.calls++
+    if failed {
+        b.failed++
+    }
+    calls, fails := 0, 0
+    for _, b := range r.buckets {
+        if now.Sub(b.start) < r.window {
+            calls += b.calls
+            fails += b.failed
+        }
+    }
+    if calls >= r.minCalls && float64(fails) >= r.ratio*float64(calls) {
+        r.open = true
+        r.openedAt = now
+        log.Printf("store circuit open: %d of %d calls failed in %s", fails, calls, r.window)
+    }
+}
+
+// do runs fn through the breaker, retrying transient errors if retry is set.
+func (r *Resilient) do(retry bool, fn func() error) error {
+    attempts := 1
+    if retry {
+        attempts = r.attempts
+    }
+    var err error
+    for attempt := 1; ; attempt++ {
+        if err := r.allow(); err != nil {
+            return err
+        }
+        err = fn()
+        r.record(IsTransient(err))
+        if !IsTransient(err) || attempt >= attempts {
+            return err
+        }
+        d := r.base << (attempt - 1)
+        if d <= 0 || d > r.max {
+            d = r.max
+        }
+        time.Sleep(time.Duration(rand.Int64N(int64(d)) + 1))
+    }
+}
+
+// Open reports whether the circuit is open.
+func (r *Resilient) Open() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.open
+}
+
+func (r *Resilient) CheckPollAndOption(pollID, optionID string) error {
+    return r.do(true, func() error { return r.Store.CheckPollAndOption(pollID, optionID) })
+}
+
+// ApplyVote is not retried here: its callers (the vote processor and
+// replay) retry with their own policy, and retrying in both layers would
+// multiply the calls and backoffs for a failing vote.
+func (r *Resilient) ApplyVote(v models.VoteRequest) error {
+    return r.do(false, func() error { return r.Store.ApplyVote(v) })
+}
+
+func (r *Resilient) HasVoted(pollID, voterID string) (bool, error) {
+    var voted bool
+    err := r.do(true, func() error {
+        var err error
+        voted, err = r.Store.HasVoted(pollID, voterID)
+        return err
+    })
+    return voted, err
+}
+
+func (r *Resilient) CreatePoll(id, question string, isOpen bool) error {
+    return r.do(false, func() error { return r.Store.CreatePoll(id, question, isOpen) })
+}
+
+func (r *Resilient) UpdatePoll(id, question string, isOpen bool) error {
+    return r.do(true, func() error { return r.Store.UpdatePoll(id, question, isOpen) })
+}
+
+func (r *Resilient) DeletePoll(id string) error {
+    return r.do(false, func() error { return r.Store.DeletePoll(id) })
+}
+
+func (r *Resilient) AddOption(pollID, optionID, label string) error {
+    return r.do(false, func() error { return r.Store.AddOption(pollID, optionID, label) })
+}
+
+func (r *Resilient) UpdateOption(optionID, label string) error {
+    return r.do(true, func() error { return r.Store.UpdateOption(optionID, label) })
+}
+
+func (r *Resilient) DeleteOption(optionID string) error {
+    return r.do(false, func() error { return r.Store.DeleteOption(optionID) })
+}
+
+func durationEnv(name string, def time.Duration) time.Duration {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil || d <= 0 {
+        log.Printf("invalid %s=%q, using default %s", name, v, def)
+        return def
+    }
+    return d
+}
+
+func intEnv(name string, def int) int {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 {
+        log.Printf("invalid %s=%q, using default %d", name, v, def)
+        return def
+    }
+    return n
+}
+
+func ratioEnv(name string, def float64) float64 {
+    v := strings.TrimSpace(os.Getenv(name))
+    if v == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil || f <= 0 || f > 1 {
+        log.Printf("invalid %s=%q, using default %g", name, v, def)
+        return def
+    }
+    return f
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+    "io"
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// countingStore fails every vote with a transient error and counts calls.
+type countingStore struct {
+    Store
+    calls int
+}
+
+func (c *countingStore) ApplyVote(models.VoteRequest) error {
+    c.calls++
+    return io.ErrUnexpectedEOF
+}
+
+// ApplyVote is left to its callers to retry; other safe calls are retried
+// here.
+func TestResilientDoesNotRetryApplyVote(t *testing.T) {
+    t.Setenv("STORE_RETRY_ATTEMPTS", "3")
+    t.Setenv("STORE_RETRY_BACKOFF", "1ms")
+    cs := &countingStore{Store: New()}
+    r := NewResilient(cs)
+    if err := r.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1", VoteID: "id1"}); !IsTransient(err) {
+        t.Fatalf("err %v, want the transient error", err)
+    }
+    if cs.calls != 1 {
+        t.Fatalf("%d calls, want 1", cs.calls)
+    }
+}
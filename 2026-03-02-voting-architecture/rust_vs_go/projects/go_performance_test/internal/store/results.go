@@ -0,0 +1,354 @@
+package store
+
+import (
+    "log"
+    "os"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// Results cache modes. "versioned" rebuilds a poll's snapshot on the first
+// read after a change. "coalesced" rebuilds changed polls at most every
+// STORE_RESULTS_INTERVAL, so readers of a busy poll share one rebuild.
+const (
+    ResultsVersioned = "versioned"
+    ResultsCoalesced = "coalesced"
+)
+
+// Results keeps a precomputed snapshot per poll for result readers, with a
+// version that goes up whenever the snapshot changes. Votes and edits made
+// through it mark the poll changed. Changes it does not see, such as votes
+// applied by another instance, are picked up when a snapshot older than
+// STORE_RESULTS_MAX_AGE is rebuilt and differs from the cached one.
+//
+// Only Snapshot is served from the cache; GetPollSnapshot still reads the
+// store, for callers that must not see stale state.
+type Results struct {
+    Store
+
+    mode     string
+    interval time.Duration
+    maxAge   time.Duration
+
+    mu    sync.Mutex
+    polls map[string]*resultsEntry
+    // version is shared by all polls, so a deleted and re-created poll
+    // cannot repeat a version a reader has seen. It starts at the clock so
+    // versions keep rising across restarts.
+    version uint64
+    subs    map[int]func(pollID string, version uint64)
+    nextSub int
+
+    stop, done chan struct{}
+}
+
+type resultsEntry struct {
+    snap    PollSnapshot
+    version uint64
+    built   time.Time
+    dirty   bool
+    // building is closed when a rebuild in progress finishes.
+    building chan struct{}
+    // queued is set while a rebuild for subscribers is waiting to start.
+    queued bool
+}
+
+// ResultsFromEnv reads STORE_RESULTS_CACHE (versioned, coalesced or off).
+func ResultsFromEnv() string {
+    mode := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_RESULTS_CACHE")))
+    switch mode {
+    case "":
+        return ResultsVersioned
+    case ResultsVersioned, ResultsCoalesced, "off":
+        return mode
+    default:
+        log.Printf("invalid STORE_RESULTS_CACHE=%q, using %s", mode, ResultsVersioned)
+        return ResultsVersioned
+    }
+}
+
+// NewResults wraps s. In coalesced mode it rebuilds in the background until
+// Close.
+func NewResults(s Store, mode string) *Results {
+    r := &Results{
+        Store:    s,
+        mode:     mode,
+        interval: durationEnv("STORE_RESULTS_INTERVAL", 250*time.Millisecond),
+        maxAge:   durationEnv("STORE_RESULTS_MAX_AGE", time.Second),
+        polls:    make(map[string]*resultsEntry),
+        version:  uint64(time.Now().UnixNano()),
+        subs:     make(map[int]func(string, uint64)),
+        stop:     make(chan struct{}),
+        done:     make(chan struct{}),
+    }
+    if mode == ResultsCoalesced {
+        go r.run()
+    } else {
+        close(r.done)
+    }
+    return r
+}
+
+// Close stops background rebuilds.
+func (r *Results) Close() {
+    select {
+    case <-r.stop:
+    default:
+        close(r.stop)
+    }
+    <-r.done
+}
+
+// Unwrap returns the wrapped store.
+func (r *Results) Unwrap() Store { return r.Store }
+
+// Subscribe calls fn with the new version each time a poll's snapshot
+// changes, until cancel is called. fn runs on the goroutine that noticed
+// the change and must not block.
+func (r *Results) Subscribe(fn func(pollID string, version uint64)) (cancel func()) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    id := r.nextSub
+    r.nextSub++
+    r.subs[id] = fn
+    return func() {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        delete(r.subs, id)
+    }
+}
+
+// Snapshot returns a poll's results and their version.
+func (r *Results) Snapshot(pollID string) (PollSnapshot, uint64, bool) {
+    now := time.Now()
+    r.mu.Lock()
+    e := r.polls[pollID]
+    if e != nil && e.version != 0 && !r.stale(e, now) {
+        snap, v := e.snap, e.version
+        r.mu.Unlock()
+        return snap, v, true
+    }
+    r.mu.Unlock()
+    return r.rebuild(pollID)
+}
+
+// stale reports whether a read should rebuild e. In coalesced mode only a
+// missing or very old snapshot is rebuilt on read.
+func (r *Results) stale(e *resultsEntry, now time.Time) bool {
+    if now.Sub(e.built) >= r.maxAge {
+        return true
+    }
+    return e.dirty && r.mode == ResultsVersioned
+}
+
+// rebuild reads the poll from the store. Concurrent readers wait for one
+// rebuild instead of each querying the store.
+func (r *Results) rebuild(pollID string) (PollSnapshot, uint64, bool) {
+    r.mu.Lock()
+    e := r.polls[pollID]
+    if e == nil {
+        e = &resultsEntry{}
+        r.polls[pollID] = e
+    } else if e.building != nil {
+        wait := e.building
+        r.mu.Unlock()
+        <-wait
+        return r.Snapshot(pollID)
+    }
+    done := make(chan struct{})
+    e.building = done
+    e.dirty, e.queued = false, false
+    r.mu.Unlock()
+
+    snap, ok := r.Store.GetPollSnapshot(pollID)
+    if ok {
+        // Postgres returns rows in no particular order; sort so that equal
+        // results compare equal.
+        snap.Options = slices.Clone(snap.Options)
+        slices.SortFunc(snap.Options, func(a, b models.OptionItem) int {
+            if c := strings.Compare(a.Label, b.Label); c != 0 {
+                return c
+            }
+            return strings.Compare(a.ID, b.ID)
+        })
+        snap.Voters = slices.Clone(snap.Voters)
+        slices.Sort(snap.Voters)
+    }
+
+    r.mu.Lock()
+    e.building = nil
+    close(done)
+    if !ok {
+        if r.polls[pollID] == e {
+            delete(r.polls, pollID)
+        }
+        r.mu.Unlock()
+        return PollSnapshot{}, 0, false
+    }
+    first := e.version == 0
+    changed := !first && !sameSnapshot(e.snap, snap)
+    if first || changed {
+        r.version++
+        e.version = r.version
+    }
+    e.snap, e.built = snap, time.Now()
+    v := e.version
+    subs := r.subscribers(changed)
+    r.mu.Unlock()
+    for _, fn := range subs {
+        fn(pollID, v)
+    }
+    return snap, v, true
+}
+
+func (r *Results) subscribers(changed bool) []func(string, uint64) {
+    if !changed || len(r.subs) == 0 {
+        return nil
+    }
+    out := make([]func(string, uint64), 0, len(r.subs))
+    for _, fn := range r.subs {
+        out = append(out, fn)
+    }
+    return out
+}
+
+func sameSnapshot(a, b PollSnapshot) bool {
+    return a.Question == b.Question && a.IsOpen == b.IsOpen &&
+        slices.Equal(a.Options, b.Options) && slices.Equal(a.Voters, b.Voters)
+}
+
+// changed marks a cached poll for rebuilding. In versioned mode, while
+// there are subscribers, the poll is also rebuilt in the background so they
+// hear of the change without waiting for a reader. Changes that arrive
+// while a rebuild is queued share it.
+func (r *Results) changed(pollID string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    e, ok := r.polls[pollID]
+    if ok {
+        e.dirty = true
+    }
+    if !ok || r.mode != ResultsVersioned || len(r.subs) == 0 || e.queued {
+        return
+    }
+    e.queued = true
+    go r.rebuild(pollID)
+}
+
+// changedOption marks the cached poll that has optionID.
+func (r *Results) changedOption(optionID string) {
+    r.mu.Lock()
+    pollID := ""
+    for id, e := range r.polls {
+        if slices.ContainsFunc(e.snap.Options, func(o models.OptionItem) bool { return o.ID == optionID }) {
+            pollID = id
+            break
+        }
+    }
+    r.mu.Unlock()
+    if pollID != "" {
+        r.changed(pollID)
+    }
+}
+
+// run rebuilds dirty and expired polls every interval in coalesced mode.
+func (r *Results) run() {
+    defer close(r.done)
+    t := time.NewTicker(r.interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-r.stop:
+            return
+        case <-t.C:
+        }
+        now := time.Now()
+        r.mu.Lock()
+        ids := make([]string, 0)
+        for id, e := range r.polls {
+            if e.building == nil && (e.dirty || now.Sub(e.built) >= r.maxAge) {
+                ids = append(ids, id)
+            }
+        }
+        r.mu.Unlock()
+        for _, id := range ids {
+            r.rebuild(id)
+        }
+    }
+}
+
+func (r *Results) ApplyVote(v models.VoteRequest) error {
+    err := r.Store.ApplyVote(v)
+    if err == nil {
+        r.changed(v.PollID)
+    }
+    return err
+}
+
+func (r *Results) UpdatePoll(id, question string, isOpen bool) error {
+    err := r.Store.UpdatePoll(id, question, isOpen)
+    if err == nil {
+        r.changed(id)
+    }
+    return err
+}
+
+func (r *Results) DeletePoll(id string) error {
+    err := r.Store.DeletePoll(id)
+    if err == nil {
+        r.changed(id)
+    }
+    return err
+}
+
+func (r *Results) AddOption(pollID, optionID, label string) error {
+    err := r.Store.AddOption(pollID, optionID, label)
+    if err == nil {
+        r.changed(pollID)
+    }
+    return err
+}
+
+func (r *Results) UpdateOption(optionID, label string) error {
+    err := r.Store.UpdateOption(optionID, label)
+    if err == nil {
+        r.changedOption(optionID)
+    }
+    return err
+}
+
+func (r *Results) DeleteOption(optionID string) error {
+    err := r.Store.DeleteOption(optionID)
+    if err == nil {
+        r.changedOption(optionID)
+    }
+    return err
+}
+
+func (r *Results) AddVoter(pollID, voterID string) error {
+    err := r.Store.AddVoter(pollID, voterID)
+    if err == nil {
+        r.changed(pollID)
+    }
+    return err
+}
+
+func (r *Results) DeleteVoter(pollID, voterID string) error {
+    err := r.Store.DeleteVoter(pollID, voterID)
+    if err == nil {
+        r.changed(pollID)
+    }
+    return err
+}
+
+func (r *Results) SetPollDecryption(pollID string, d models.Decryption) error {
+    err := r.Store.SetPollDecryption(pollID, d)
+    if err == nil {
+        r.changed(pollID)
+    }
+    return err
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// A vote gives the poll a new version; a read without changes keeps it.
+func TestResultsVersionFollowsVotes(t *testing.T) {
+    mem := New()
+    if err := mem.CreatePoll("p1", "q?", true); err != nil {
+        t.Fatal(err)
+    }
+    if err := mem.AddOption("p1", "a", "A"); err != nil {
+        t.Fatal(err)
+    }
+    r := NewResults(mem, ResultsVersioned)
+    defer r.Close()
+
+    _, v1, ok := r.Snapshot("p1")
+    if !ok {
+        t.Fatal("poll not found")
+    }
+    if _, v, _ := r.Snapshot("p1"); v != v1 {
+        t.Fatalf("version moved from %d to %d without a change", v1, v)
+    }
+    if err := r.ApplyVote(models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1"}); err != nil {
+        t.Fatal(err)
+    }
+    snap, v2, _ := r.Snapshot("p1")
+    if v2 <= v1 {
+        t.Fatalf("version %d after a vote, want above %d", v2, v1)
+    }
+    if snap.Options[0].Votes != 1 {
+        t.Fatalf("votes %d, want 1", snap.Options[0].Votes)
+    }
+    if len(snap.Voters) != 1 || snap.Voters[0] != "v1" {
+        t.Fatalf("voters %v, want [v1]", snap.Voters)
+    }
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+    "crypto/rand"
+    "encoding/hex"
     "errors"
     "sort"
     "sync"
@@ -15,8 +17,31 @@ type Store interface {
 
     GetOption(id string) (*models.OptionItem, bool)
     GetPollSnapshot(id string) (PollSnapshot, bool)
-    ListPollSnapshots() []PollSnapshot
+    ListPollSnapshots() ([]PollSnapshot, error)
     ListOptions(pollID string) []models.OptionItem
+    // ListBallots returns a poll's ballots in ledger order: placed ballots
+    // by position, then any not yet placed.
+    ListBallots(pollID string) ([]models.Ballot, error)
+
+    // SequenceBallots places committed ballots that have no ledger position
+    // yet after the ones that do, and returns the number placed per poll,
+    // for every poll. Positions never change once given, so each poll's
+    // placed ballots only grow at the end.
+    SequenceBallots() (map[string]int, error)
+    // ListBallotsFrom returns the placed ballots of a poll from position
+    // from on, in order.
+    ListBallotsFrom(pollID string, from int) ([]models.Ballot, error)
+
+    SetPollEncryption(pollID string, cfg models.EncryptionConfig) error
+    GetEncryptedPoll(pollID string) (models.EncryptedPoll, bool)
+    SetPollDecryption(pollID string, d models.Decryption) error
+
+    // CertifyPoll locks a closed poll, calls issue with its state, then
+    // freezes the poll and stores the certificate issue returned, so the
+    // certificate always describes the frozen poll. The snapshot's Voters
+    // are not filled in; the ballots are in ledger order.
+    CertifyPoll(pollID string, issue CertifyFunc) (models.Certificate, error)
+    GetCertificate(pollID string) (models.Certificate, bool)
 
     CreatePoll(id, question string, isOpen bool) error
     UpdatePoll(id, question string, isOpen bool) error
@@ -28,18 +53,25 @@ type Store interface {
 
     AddVoter(pollID, voterID string) error
     DeleteVoter(pollID, voterID string) error
+    // HasVoted reports whether a vote from voterID has been counted.
+    HasVoted(pollID, voterID string) (bool, error)
 }
 
 type MemoryStore struct {
     mu          sync.RWMutex
     polls       map[string]*models.Poll
     optionIndex map[string]*models.OptionItem
+    // applied holds the IDs of votes already counted per poll, so a
+    // redelivered vote is a no-op. Like the poll's ballots, it is dropped
+    // with the poll.
+    applied map[string]map[string]struct{}
 }
 
 func New() *MemoryStore {
     return &MemoryStore{
         polls:       make(map[string]*models.Poll),
         optionIndex: make(map[string]*models.OptionItem),
+        applied:     make(map[string]map[string]struct{}),
     }
 }
 
@@ -75,6 +107,9 @@ func (s *MemoryStore) CheckPollAndOption(pollID, optionID string) error {
     if !p.IsOpen {
         return errors.New("poll is closed")
     }
+    if p.Encryption != nil {
+        return errors.New("poll requires encrypted ballots")
+    }
     if _, ok := p.Options[optionID]; !ok {
         return errors.New("option not found in poll")
     }
@@ -84,6 +119,24 @@ func (s *MemoryStore) CheckPollAndOption(pollID, optionID string) error {
 func (s *MemoryStore) ApplyVote(v models.VoteRequest) error {
     s.mu.Lock()
     defer s.mu.Unlock()
+    if _, ok := s.applied[v.PollID][v.VoteID]; ok && v.VoteID != "" {
+        return nil
+    }
+    if err := s.applyVote(v); err != nil {
+        return err
+    }
+    if v.VoteID != "" {
+        ids := s.applied[v.PollID]
+        if ids == nil {
+            ids = make(map[string]struct{})
+            s.applied[v.PollID] = ids
+        }
+        ids[v.VoteID] = struct{}{}
+    }
+    return nil
+}
+
+func (s *MemoryStore) applyVote(v models.VoteRequest) error {
     p, ok := s.polls[v.PollID]
     if !ok {
         return errors.New("poll not found")
@@ -91,6 +144,12 @@ func (s *MemoryStore) ApplyVote(v models.VoteRequest) error {
     if !p.IsOpen {
         return errors.New("poll is closed")
     }
+    if p.Encryption != nil {
+        return s.applyEncrypted(p, v)
+    }
+    if v.Encrypted != nil {
+        return errors.New("poll does not accept encrypted ballots")
+    }
     opt, ok := p.Options[v.OptionID]
     if !ok {
         return errors.New("option not found in poll")
@@ -98,11 +157,23 @@ func (s *MemoryStore) ApplyVote(v models.VoteRequest) error {
     if _, voted := p.Voters[v.VoterID]; voted {
         return errors.New("voter has already voted in this poll")
     }
+    receipt := v.ReceiptID
+    if receipt == "" {
+        receipt = NewReceipt()
+    }
     opt.Votes++
     p.Voters[v.VoterID] = struct{}{}
+    p.Ballots = append(p.Ballots, models.Ballot{Receipt: receipt, OptionID: v.OptionID})
     return nil
 }
 
+// NewReceipt returns a random, hex-encoded ballot receipt ID.
+func NewReceipt() string {
+    var b [16]byte
+    _, _ = rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
 type PollSnapshot struct {
     ID       string
     Question string
@@ -111,13 +182,12 @@ type PollSnapshot struct {
     Voters   []string
 }
 
-func (s *MemoryStore) GetPollSnapshot(id string) (PollSnapshot, bool) {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
-    p, ok := s.polls[id]
-    if !ok {
-        return PollSnapshot{}, false
-    }
+// CertifyFunc builds and signs the certificate of a poll from its state at
+// the moment it is frozen.
+type CertifyFunc func(snap PollSnapshot, ballots []models.Ballot) (models.Certificate, error)
+
+// snapshot copies p. Caller holds s.mu.
+func snapshot(p *models.Poll) PollSnapshot {
     snap := PollSnapshot{ID: p.ID, Question: p.Question, IsOpen: p.IsOpen}
     opts := make([]models.OptionItem, 0, len(p.Options))
     for _, o := range p.Options {
@@ -131,10 +201,20 @@ func (s *MemoryStore) GetPollSnapshot(id string) (PollSnapshot, bool) {
     }
     sort.Strings(voters)
     snap.Voters = voters
-    return snap, true
+    return snap
 }
 
-func (s *MemoryStore) ListPollSnapshots() []PollSnapshot {
+func (s *MemoryStore) GetPollSnapshot(id string) (PollSnapshot, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    p, ok := s.polls[id]
+    if !ok {
+        return PollSnapshot{}, false
+    }
+    return snapshot(p), true
+}
+
+func (s *MemoryStore) ListPollSnapshots() ([]PollSnapshot, error) {
     s.mu.RLock()
     defer s.mu.RUnlock()
     snaps := make([]PollSnapshot, 0, len(s.polls))
@@ -144,21 +224,7 @@ func (s *MemoryStore) ListPollSnapshots() []PollSnapshot {
     }
     sort.Strings(keys)
     for _, id := range keys {
-        p := s.polls[id]
-        snap := PollSnapshot{ID: p.ID, Question: p.Question, IsOpen: p.IsOpen}
-        opts := make([]models.OptionItem, 0, len(p.Options))
-        for _, o := range p.Options {
-            opts = append(opts, models.OptionItem{ID: o.ID, Label: o.Label, Votes: o.Votes})
-        }
-        sort.Slice(opts, func(i, j int) bool { return opts[i].Label < opts[j].Label })
-        snap.Options = opts
-        voters := make([]string, 0, len(p.Voters))
-        for v := range p.Voters {
-            voters = append(voters, v)
-        }
-        sort.Strings(voters)
-        snap.Voters = voters
-        snaps = append(snaps, snap)
+        snaps = append(snaps, snapshot(s.polls[id]))
     }
     sort.Slice(snaps, func(i, j int) bool {
         if snaps[i].Question == snaps[j].Question {
@@ -166,7 +232,7 @@ func (s *MemoryStore) ListPollSnapshots() []PollSnapshot {
         }
         return snaps[i].Question < snaps[j].Question
     })
-    return snaps
+    return snaps, nil
 }
 
 func (s *MemoryStore) ListOptions(pollID string) []models.OptionItem {
@@ -193,6 +259,37 @@ func (s *MemoryStore) ListOptions(pollID string) []models.OptionItem {
     return out
 }
 
+// Ballots are appended under the lock, so their order is already the
+// commit order and every ballot is placed at once.
+func (s *MemoryStore) ListBallots(pollID string) ([]models.Ballot, error) {
+    return s.ListBallotsFrom(pollID, 0)
+}
+
+func (s *MemoryStore) SequenceBallots() (map[string]int, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    out := make(map[string]int, len(s.polls))
+    for id, p := range s.polls {
+        out[id] = len(p.Ballots)
+    }
+    return out, nil
+}
+
+func (s *MemoryStore) ListBallotsFrom(pollID string, from int) ([]models.Ballot, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    p, ok := s.polls[pollID]
+    if !ok {
+        return nil, errors.New("poll not found")
+    }
+    if from < 0 || from > len(p.Ballots) {
+        from = len(p.Ballots)
+    }
+    out := make([]models.Ballot, len(p.Ballots)-from)
+    copy(out, p.Ballots[from:])
+    return out, nil
+}
+
 func (s *MemoryStore) CreatePoll(id, question string, isOpen bool) error {
     s.mu.Lock()
     defer s.mu.Unlock()
@@ -211,6 +308,9 @@ func (s *MemoryStore) UpdatePoll(id, question string, isOpen bool) error {
     if !ok {
         return errors.New("poll not found")
     }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
     p.Question = question
     p.IsOpen = isOpen
     return nil
@@ -223,10 +323,14 @@ func (s *MemoryStore) DeletePoll(id string) error {
     if !ok {
         return errors.New("poll not found")
     }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
     for oid := range p.Options {
         delete(s.optionIndex, oid)
     }
     delete(s.polls, id)
+    delete(s.applied, id)
     return nil
 }
 
@@ -237,6 +341,12 @@ func (s *MemoryStore) AddOption(pollID, optionID, label string) error {
     if !ok {
         return errors.New("poll not found")
     }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
+    if p.Encryption != nil {
+        return errEncryptedOptions
+    }
     if _, exists := p.Options[optionID]; exists {
         return errors.New("option already exists")
     }
@@ -253,6 +363,9 @@ func (s *MemoryStore) UpdateOption(optionID, label string) error {
     if !ok {
         return errors.New("option not found")
     }
+    if s.optionFrozen(optionID) {
+        return errors.New("poll is frozen")
+    }
     opt.Label = label
     return nil
 }
@@ -264,8 +377,14 @@ func (s *MemoryStore) DeleteOption(optionID string) error {
     if !ok {
         return errors.New("option not found")
     }
+    if s.optionFrozen(optionID) {
+        return errors.New("poll is frozen")
+    }
     for _, p := range s.polls {
         if _, ok := p.Options[optionID]; ok {
+            if p.Encryption != nil {
+                return errEncryptedOptions
+            }
             delete(p.Options, optionID)
             break
         }
@@ -282,6 +401,9 @@ func (s *MemoryStore) AddVoter(pollID, voterID string) error {
     if !ok {
         return errors.New("poll not found")
     }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
     if p.Voters == nil {
         p.Voters = map[string]struct{}{}
     }
@@ -299,9 +421,71 @@ func (s *MemoryStore) DeleteVoter(pollID, voterID string) error {
     if !ok {
         return errors.New("poll not found")
     }
+    if p.Frozen {
+        return errors.New("poll is frozen")
+    }
     if _, exists := p.Voters[voterID]; !exists {
         return errors.New("voter not found")
     }
     delete(p.Voters, voterID)
     return nil
 }
+
+func (s *MemoryStore) HasVoted(pollID, voterID string) (bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    p, ok := s.polls[pollID]
+    if !ok {
+        return false, errors.New("poll not found")
+    }
+    _, voted := p.Voters[voterID]
+    return voted, nil
+}
+
+func (s *MemoryStore) optionFrozen(optionID string) bool {
+    for _, p := range s.polls {
+        if _, ok := p.Options[optionID]; ok {
+            return p.Frozen
+        }
+    }
+    return false
+}
+
+// CertifyPoll freezes a closed poll and stores its certificate. Neither can
+// be undone.
+func (s *MemoryStore) CertifyPoll(pollID string, issue CertifyFunc) (models.Certificate, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    p, ok := s.polls[pollID]
+    if !ok {
+        return models.Certificate{}, errors.New("poll not found")
+    }
+    if p.IsOpen {
+        return models.Certificate{}, errors.New("poll is still open")
+    }
+    if p.Certificate != nil {
+        return models.Certificate{}, errors.New("poll already certified")
+    }
+    if p.Encryption != nil && p.Decryption == nil {
+        return models.Certificate{}, errors.New("poll has not been decrypted")
+    }
+    snap := snapshot(p)
+    snap.Voters = nil
+    c, err := issue(snap, append([]models.Ballot(nil), p.Ballots...))
+    if err != nil {
+        return models.Certificate{}, err
+    }
+    p.Frozen = true
+    p.Certificate = &c
+    return c, nil
+}
+
+func (s *MemoryStore) GetCertificate(pollID string) (models.Certificate, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    p, ok := s.polls[pollID]
+    if !ok || p.Certificate == nil {
+        return models.Certificate{}, false
+    }
+    return *p.Certificate, true
+}
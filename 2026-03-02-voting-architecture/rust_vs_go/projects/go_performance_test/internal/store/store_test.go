@@ -0,0 +1,52 @@
+package store
+
+import (
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// A redelivered vote counts once, and the record of applied vote IDs goes
+// with the poll.
+func TestMemoryStoreAppliedVotesArePerPoll(t *testing.T) {
+    s := New()
+    create := func() {
+        t.Helper()
+        if err := s.CreatePoll("p1", "q?", true); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.AddOption("p1", "a", "A"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    votes := func() int {
+        t.Helper()
+        snap, _ := s.GetPollSnapshot("p1")
+        return snap.Options[0].Votes
+    }
+    v := models.VoteRequest{PollID: "p1", OptionID: "a", VoterID: "v1", VoteID: "id1"}
+
+    create()
+    for range 2 {
+        if err := s.ApplyVote(v); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := votes(); n != 1 {
+        t.Fatalf("%d votes after a redelivery, want 1", n)
+    }
+
+    if err := s.DeletePoll("p1"); err != nil {
+        t.Fatal(err)
+    }
+    if len(s.applied) != 0 {
+        t.Fatalf("applied vote IDs kept after delete: %v", s.applied)
+    }
+    create()
+    if err := s.ApplyVote(v); err != nil {
+        t.Fatal(err)
+    }
+    if n := votes(); n != 1 {
+        t.Fatalf("%d votes in the re-created poll, want 1", n)
+    }
+}
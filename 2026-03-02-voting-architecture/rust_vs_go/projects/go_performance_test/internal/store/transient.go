@@ -0,0 +1,50 @@
+package store
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "io"
+    "net"
+    "strings"
+    "syscall"
+
+    "github.com/lib/pq"
+)
+
+// IsTransient reports whether err is worth retrying: lost connections,
+// timeouts and Postgres errors that go away on their own. Domain errors
+// such as "poll is closed" are never transient.
+func IsTransient(err error) bool {
+    if err == nil {
+        return false
+    }
+    if _, ok := IsUnavailable(err); ok {
+        return true
+    }
+    if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+        errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+        errors.Is(err, context.DeadlineExceeded) ||
+        errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+        errors.Is(err, syscall.EPIPE) {
+        return true
+    }
+    var ne net.Error
+    if errors.As(err, &ne) {
+        return true
+    }
+    var pe *pq.Error
+    if errors.As(err, &pe) {
+        switch pe.Code.Class() {
+        case "08", "40", "53", "57":
+            // connection exception, transaction rollback (serialization,
+            // deadlock), insufficient resources, operator intervention
+            return true
+        }
+        return false
+    }
+    msg := err.Error()
+    return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe") ||
+        strings.Contains(msg, "connection refused")
+}
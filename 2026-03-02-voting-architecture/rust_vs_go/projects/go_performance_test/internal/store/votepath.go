@@ -0,0 +1,160 @@
+package store
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "math/rand/v2"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// Vote paths for plaintext ballots. "cte" validates, records the voter,
+// counts and inserts the ballot in one prepared statement; "tx" runs the
+// same steps as separate statements in a transaction. Encrypted ballots
+// always take the transaction path.
+const (
+    VotePathCTE = "cte"
+    VotePathTx  = "tx"
+)
+
+// Result codes of voteCTE, in the order the rules are checked.
+const (
+    voteOK = iota
+    votePollNotFound
+    votePollClosed
+    votePollEncrypted
+    voteOptionNotFound
+    voteVoterConflict
+)
+
+// voteCTE takes poll, option, voter, vote ID, receipt, counter strategy and
+// counter slot. Data-modifying CTEs all run, so each write is guarded by
+// the rows of the step before it; only one of row_count and shard writes.
+const voteCTE = `with poll as (
+        select p.is_open, e.poll_id is not null as encrypted
+        from polls p left join poll_encryption e on e.poll_id = p.id
+        where p.id = $1::text
+    ), opt as (
+        select 1 from poll_options where id = $2::text and poll_id = $1::text
+    ), applied as (
+        select 1 from poll_voters where $4::text <> '' and vote_id = $4::text
+    ), voter as (
+        insert into poll_voters(poll_id, voter_id, vote_id)
+        select $1::text, $3::text, nullif($4::text, '')
+        where exists(select 1 from poll where is_open and not encrypted)
+          and exists(select 1 from opt)
+          and not exists(select 1 from applied)
+        on conflict do nothing
+        returning 1
+    ), row_count as (
+        update poll_options set votes = votes + 1
+        where id = $2::text and $6::text = 'row' and exists(select 1 from voter)
+        returning 1
+    ), shard as (
+        insert into poll_option_counts(option_id, poll_id, slot, votes)
+        select $2::text, $1::text, $7::integer, 1
+        where $6::text = 'sharded' and exists(select 1 from voter)
+        on conflict (option_id, slot) do update set votes = poll_option_counts.votes + 1
+        returning 1
+    ), ballot as (
+        insert into poll_ballots(poll_id, receipt, option_id, counted)
+        select $1::text, $5::text, $2::text, $6::text <> 'rollup' from voter
+        returning 1
+    )
+    select case
+        when exists(select 1 from applied) then 0
+        when not exists(select 1 from poll) then 1
+        when not (select is_open from poll) then 2
+        when (select encrypted from poll) then 3
+        when not exists(select 1 from opt) then 4
+        when not exists(select 1 from voter) then 5
+        else 0
+    end`
+
+// checkSQL answers CheckPollAndOption in one query.
+const checkSQL = `select p.is_open, e.poll_id is not null,
+        exists(select 1 from poll_options o where o.id = $2 and o.poll_id = p.id)
+    from polls p left join poll_encryption e on e.poll_id = p.id
+    where p.id = $1`
+
+func votePathFromEnv() string {
+    path := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_VOTE_PATH")))
+    switch path {
+    case "":
+        return VotePathCTE
+    case VotePathCTE, VotePathTx:
+        return path
+    default:
+        log.Printf("invalid STORE_VOTE_PATH=%q, using %s", path, VotePathCTE)
+        return VotePathCTE
+    }
+}
+
+// tunePool sizes the connection pool from DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME. Idle
+// connections default to the open limit so bursts do not reconnect.
+func tunePool(db *sql.DB) {
+    open := intEnv("DB_MAX_OPEN_CONNS", 64)
+    db.SetMaxOpenConns(open)
+    db.SetMaxIdleConns(intEnv("DB_MAX_IDLE_CONNS", open))
+    db.SetConnMaxLifetime(durationEnv("DB_CONN_MAX_LIFETIME", 30*time.Minute))
+    db.SetConnMaxIdleTime(durationEnv("DB_CONN_MAX_IDLE_TIME", 5*time.Minute))
+}
+
+// prepare readies the statements of the request and vote paths.
+func (p *PostgresStore) prepare() error {
+    var err error
+    if p.checkStmt, err = p.db.Prepare(checkSQL); err != nil {
+        return err
+    }
+    p.voteStmt, err = p.db.Prepare(voteCTE)
+    return err
+}
+
+// SetVotePath switches between VotePathCTE and VotePathTx, for comparing
+// them on a live database.
+func (p *PostgresStore) SetVotePath(path string) error {
+    if path != VotePathCTE && path != VotePathTx {
+        return errors.New("vote path must be cte or tx")
+    }
+    p.votePath = path
+    return nil
+}
+
+func (p *PostgresStore) applyVoteCTE(v models.VoteRequest) error {
+    receipt := v.ReceiptID
+    if receipt == "" {
+        receipt = NewReceipt()
+    }
+    slot := 0
+    if p.counter == CounterSharded {
+        slot = rand.IntN(p.shards)
+    }
+    var code int
+    if err := p.voteStmt.QueryRow(v.PollID, v.OptionID, v.VoterID, v.VoteID, receipt, p.counter, slot).Scan(&code); err != nil {
+        return err
+    }
+    switch code {
+    case voteOK:
+        return nil
+    case votePollNotFound:
+        return errors.New("poll not found")
+    case votePollClosed:
+        return errors.New("poll is closed")
+    case votePollEncrypted:
+        return errors.New("poll requires encrypted ballots")
+    case voteOptionNotFound:
+        return errors.New("option not found in poll")
+    default:
+        // Either the voter already voted or a concurrent delivery of this
+        // vote got there first.
+        if v.VoteID != "" && p.voteApplied(v.VoteID) {
+            return nil
+        }
+        return errors.New("voter has already voted in this poll")
+    }
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync/atomic"
+    "testing"
+
+    "github.com/thiagonasc/poll/internal/models"
+)
+
+// The vote path benchmarks need a Postgres database:
+//
+//    DB_URL=postgres://... go test -run '^$' -bench ApplyVote ./internal/store
+//
+// Each run votes into a fresh poll that is deleted afterwards. "hot" puts
+// every vote on one option, the worst case for row locks; "spread" uses
+// sixteen. -cpu sets how many voters run at once (eight per CPU).
+
+func BenchmarkApplyVoteCTE(b *testing.B) { benchmarkVotePath(b, VotePathCTE) }
+
+func BenchmarkApplyVoteTx(b *testing.B) { benchmarkVotePath(b, VotePathTx) }
+
+func benchmarkVotePath(b *testing.B, path string) {
+    dsn := strings.TrimSpace(os.Getenv("DB_URL"))
+    if dsn == "" {
+        b.Skip("DB_URL is not set")
+    }
+    st, closer, err := NewPostgres(dsn)
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer closer()
+    pg := st.(*PostgresStore)
+    if err := pg.SetVotePath(path); err != nil {
+        b.Fatal(err)
+    }
+    for _, options := range []int{1, 16} {
+        name := "hot"
+        if options > 1 {
+            name = "spread"
+        }
+        b.Run(name, func(b *testing.B) {
+            pollID := "bench-" + NewReceipt()
+            if err := pg.CreatePoll(pollID, "bench "+pollID, true); err != nil {
+                b.Fatal(err)
+            }
+            defer func() { _ = pg.DeletePoll(pollID) }()
+            opts := make([]string, options)
+            for i := range opts {
+                opts[i] = fmt.Sprintf("%s-%d", pollID, i)
+                if err := pg.AddOption(pollID, opts[i], fmt.Sprint("option ", i)); err != nil {
+                    b.Fatal(err)
+                }
+            }
+
+            var next atomic.Int64
+            b.SetParallelism(8)
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    i := next.Add(1)
+                    v := models.VoteRequest{PollID: pollID, OptionID: opts[i%int64(options)], VoterID: fmt.Sprint("voter-", i), VoteID: fmt.Sprint(pollID, "-", i)}
+                    if err := pg.ApplyVote(v); err != nil {
+                        b.Error(err)
+                        return
+                    }
+                }
+            })
+            b.StopTimer()
+            b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "votes/s")
+        })
+    }
+}
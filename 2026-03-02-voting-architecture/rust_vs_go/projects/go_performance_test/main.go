@@ -1,23 +1,33 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	reuseport "github.com/libp2p/go-reuseport"
 	"github.com/thiagonasc/poll/internal/api"
+	"github.com/thiagonasc/poll/internal/cli"
 )
 
 func main() {
 	if err := godotenv.Load(); err != nil {
 	}
 
+	if len(os.Args) > 1 {
+		if err := cli.Run(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	srv := api.NewServer()
 	srv.Routes()
 
@@ -35,22 +45,53 @@ func main() {
 	log.Printf("poll service starting on %s", addr)
 
 	useReuse := strings.TrimSpace(os.Getenv("ENABLE_REUSEPORT")) == "1"
-	var err error
-	if useReuse {
-		var ln net.Listener
-		ln, err = reuseport.Listen("tcp", addr)
-		if err != nil {
+	serveErr := make(chan error, 1)
+	go func() {
+		if useReuse {
+			ln, err := reuseport.Listen("tcp", addr)
+			if err == nil {
+				serveErr <- s.Serve(ln)
+				return
+			}
 			log.Printf("reuseport listen failed, falling back to standard listener: %v", err)
+		}
+		serveErr <- s.ListenAndServe()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	}
+	stop()
+
+	timeout := 30 * time.Second
+	if v := strings.TrimSpace(os.Getenv("SHUTDOWN_TIMEOUT")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			timeout = d
 		} else {
-			err = s.Serve(ln)
+			log.Printf("invalid SHUTDOWN_TIMEOUT=%q, using default %s", v, timeout)
 		}
 	}
-	if !useReuse {
-		err = s.ListenAndServe()
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(sctx); err != nil {
+		log.Printf("http shutdown: %v", err)
 	}
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("server error: %v", err)
+	rep := srv.Shutdown(sctx)
+	log.Printf("vote queue (%s): drained %d, persisted %d, lost %d", rep.Transport, rep.Drained, rep.Persisted, rep.Lost)
+	if rep.Backlog > 0 {
+		log.Printf("%d votes left in the shared queue for other instances", rep.Backlog)
+	}
+	if rep.SpillFile != "" {
+		log.Printf("unprocessed votes written to %s", rep.SpillFile)
+	}
+	if rep.Lost > 0 {
+		os.Exit(1)
 	}
-
-	srv.Close()
 }
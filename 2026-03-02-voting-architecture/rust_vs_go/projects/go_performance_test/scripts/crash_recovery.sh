@@ -0,0 +1,78 @@
+#!/usr/bin/env bash
+# Crash-recovery check for the file vote queue (VOTE_QUEUE=file).
+#
+# Fires votes at a running server, kills it with SIGKILL mid-run, restarts
+# it on the same queue directory and checks that every vote that got a 202
+# was counted. Needs a Postgres DB_URL: with the memory store, votes applied
+# before the crash die with the process, queue or no queue.
+#
+# The queue on its own is covered by TestFileCrashRecovery in
+# internal/queue (go test ./internal/queue); this checks the whole service.
+#
+#   DB_URL=postgres://... scripts/crash_recovery.sh [votes] [kill_after_seconds]
+set -euo pipefail
+
+: "${DB_URL:?set DB_URL to a Postgres database}"
+VOTES=${1:-20000}
+KILL_AFTER=${2:-2}
+PORT=${PORT:-18090}
+BASE="http://localhost:${PORT}"
+WORK=$(mktemp -d)
+trap 'kill -9 "${PID:-0}" 2>/dev/null || true; rm -rf "$WORK"' EXIT
+
+cd "$(dirname "$0")/.."
+go build -o "$WORK/poll" .
+
+start() {
+    PORT=$PORT STORE_BACKEND=postgres DB_URL=$DB_URL REDIS_URL= \
+        VOTE_QUEUE=file VOTE_QUEUE_DIR="$WORK/queue" \
+        "$WORK/poll" >>"$WORK/server.log" 2>&1 &
+    PID=$!
+    for _ in $(seq 50); do
+        curl -sf "$BASE/polls" >/dev/null && return
+        sleep 0.1
+    done
+    echo "server did not start" >&2
+    exit 1
+}
+
+start
+POLL="crash-$(date +%s)-$$"
+curl -sf -XPOST "$BASE/polls" -d "{\"id\":\"$POLL\",\"question\":\"crash test\",\"is_open\":true}" >/dev/null
+curl -sf -XPOST "$BASE/options" -d "{\"id\":\"$POLL-a\",\"poll_id\":\"$POLL\",\"label\":\"A\"}" >/dev/null
+
+seq "$VOTES" | xargs -P 64 -I{} sh -c \
+    "curl -s -o /dev/null -w '%{http_code}\n' -XPOST '$BASE/vote' -d '{\"poll_id\":\"$POLL\",\"option_id\":\"$POLL-a\",\"voter_id\":\"v{}\"}' || true" \
+    >"$WORK/codes" &
+LOAD=$!
+sleep "$KILL_AFTER"
+kill -9 "$PID"
+wait "$LOAD" || true
+
+ACCEPTED=$(grep -c '^202$' "$WORK/codes" || true)
+echo "accepted before crash: $ACCEPTED"
+
+start
+for _ in $(seq 100); do
+    COUNTED=$(curl -sf "$BASE/polls" | python3 -c "import json,sys
+for p in json.load(sys.stdin):
+    if p['id'] == '$POLL':
+        print(sum(o['votes'] for o in p['options']))" || true)
+    COUNTED=${COUNTED:-0}
+    [ "$COUNTED" -ge "$ACCEPTED" ] && break
+    sleep 0.2
+done
+echo "counted after recovery: $COUNTED"
+kill "$PID"
+
+if [ "$COUNTED" -lt "$ACCEPTED" ]; then
+    echo "FAIL: $((ACCEPTED - COUNTED)) accepted votes were lost" >&2
+    exit 1
+fi
+# A vote can be durable and counted even though the client never saw its
+# 202, so COUNTED may exceed ACCEPTED; it may not exceed what was sent.
+if [ "$COUNTED" -gt "$VOTES" ]; then
+    echo "FAIL: counted more votes than were sent" >&2
+    exit 1
+fi
+echo "OK"